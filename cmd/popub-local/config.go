@@ -0,0 +1,227 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/config"
+)
+
+type tunnelConfig struct {
+	LocalAddr        string `json:"local_addr" usage:"address of the local service, or unix:path for a Unix socket" arg:"address"`
+	RelayAddr        string `json:"relay_addr" usage:"address of popub-relay" arg:"address"`
+	Passphrase       string `json:"passphrase" usage:"passphrase shared with popub-relay, see also passphrase-from" arg:"passphrase"`
+	PassphraseParams string `json:"passphrase_params" usage:"salt and Argon2 parameters generated by popub keygen -params, the same as popub-relay" arg:"params"`
+	PassphraseFrom   string `json:"passphrase_from" usage:"read the passphrase from this source: file:path, env:NAME, credential:NAME (systemd LoadCredential=), or stdin" arg:"source"`
+	IdentityFrom     string `json:"identity_from" usage:"read the identity key generated by popub keygen -identity from this source, in the same form as passphrase-from" arg:"source"`
+	SSHKey           string `json:"ssh_key" usage:"authorize with this OpenSSH private key file, or with -ssh-agent, the public key file of the agent key to use" arg:"file"`
+	SSHAgent         string `json:"ssh_agent" usage:"sign with the SSH agent listening on this socket, such as $SSH_AUTH_SOCK" arg:"socket"`
+	RelayKey         string `json:"relay_key" usage:"only accept a relay with this relay key, printed by popub-relay" arg:"key"`
+	KnownRelays      string `json:"known_relays" usage:"record the relay key in this file on first use, and refuse a relay with another key, unless relay-key is set" arg:"file"`
+
+	PoolMin      int  `json:"pool_min" usage:"minimum number of idle tunnels waiting at the relay" arg:"number"`
+	PoolMax      int  `json:"pool_max" usage:"maximum number of idle tunnels waiting at the relay, used with -pool-adaptive" arg:"number"`
+	PoolAdaptive bool `json:"pool_adaptive" usage:"grow the number of idle tunnels according to the recent accept rate"`
+
+	Mux bool   `json:"mux" usage:"carry all connections over a single multiplexed relay link"`
+	UDP string `json:"udp" usage:"forward UDP datagrams from the relay to this address, requires -mux" arg:"address"`
+
+	ProxyProtocol string `json:"proxy_protocol" usage:"send the client address to the local service in a PROXY protocol header of this version: v1 or v2" arg:"version"`
+
+	PublicPort string `json:"public_port" usage:"ask the relay to open a public port for this tunnel: a port, a range such as 20000-20999, or any" arg:"port"`
+
+	publicPort bind.Range
+	identity   string
+}
+
+type localConfig struct {
+	config.Common
+	tunnelConfig
+
+	// Tunnels are named tunnels in addition to the one at the top level.
+	// Unspecified settings are taken from the top level.
+	Tunnels map[string]tunnelConfig `json:"tunnels"`
+
+	tunnels map[string]tunnelConfig
+}
+
+func defaultLocalConfig() localConfig {
+	return localConfig{
+		Common: config.DefaultCommon(),
+		tunnelConfig: tunnelConfig{
+			PoolMin: 1,
+			PoolMax: 16,
+		},
+	}
+}
+
+// resolveTunnels returns all tunnels to run, keyed by name. The tunnel at the
+// top level is named "", and only exists if local_addr is set there.
+func (c *localConfig) resolveTunnels(positions config.Positions) map[string]tunnelConfig {
+	tunnels := make(map[string]tunnelConfig)
+	if c.LocalAddr != "" || len(c.Tunnels) == 0 {
+		tunnels[""] = c.tunnelConfig
+	}
+	for name, t := range c.Tunnels {
+		config.Inherit(&t, c.tunnelConfig, positions, "tunnels."+name)
+		config.InheritSecret(&t.Passphrase, &t.PassphraseFrom, positions, "tunnels."+name+".passphrase")
+		tunnels[name] = t
+	}
+	return tunnels
+}
+
+// validate also resolves the tunnels to run.
+func (c *localConfig) validate(positions config.Positions) config.Errors {
+	var errs config.Errors
+	c.Common.Validate(&errs, positions)
+	c.tunnels = c.resolveTunnels(positions)
+	for _, name := range slices.Sorted(maps.Keys(c.tunnels)) {
+		t := c.tunnels[name]
+		prefix := ""
+		if name != "" {
+			errs.Check(!strings.ContainsAny(name, " \t\r\n[]"), positions, "tunnels."+name, "invalid tunnel name")
+			prefix = "tunnels." + name + "."
+		}
+		t.validate(&errs, positions, prefix)
+		c.tunnels[name] = t
+	}
+	return errs
+}
+
+func (t *tunnelConfig) validate(errs *config.Errors, positions config.Positions, prefix string) {
+	errs.Check(t.LocalAddr != "", positions, prefix+"local_addr", "required")
+	errs.Check(t.RelayAddr != "", positions, prefix+"relay_addr", "required")
+	// A tunnel with its own key may use a tenant without a passphrase.
+	config.LoadSecret(errs, positions, prefix+"passphrase", &t.Passphrase, t.PassphraseFrom, t.IdentityFrom != "" || t.SSHKey != "" || t.SSHAgent != "")
+	if t.Passphrase != "" {
+		err := common.CheckPassphrase(t.Passphrase, t.PassphraseParams)
+		path := prefix + "passphrase_params"
+		if t.PassphraseParams == "" {
+			path = prefix + "passphrase"
+		}
+		errs.Check(err == nil, positions, path, "%v", err)
+	}
+	errs.Check(t.PoolMin >= 1, positions, prefix+"pool_min", "must be at least 1")
+	errs.Check(!t.PoolAdaptive || t.PoolMax >= t.PoolMin, positions, prefix+"pool_max", "must not be less than pool_min")
+	if !t.PoolAdaptive {
+		// pool_max may also be inherited from the top level.
+		for _, path := range []string{prefix + "pool_max", "pool_max"} {
+			if _, ok := positions[path]; ok {
+				config.Warn(positions, path, "ignored unless pool_adaptive is set")
+				break
+			}
+		}
+	}
+	errs.Check(t.UDP == "" || t.Mux, positions, prefix+"udp", "requires mux")
+	errs.Check(t.ProxyProtocol == "" || t.ProxyProtocol == "v1" || t.ProxyProtocol == "v2", positions, prefix+"proxy_protocol", "expected v1 or v2, got %q", t.ProxyProtocol)
+	if t.IdentityFrom != "" {
+		var err error
+		t.identity, err = config.ReadSecret(t.IdentityFrom)
+		if err == nil {
+			_, err = common.ParseIdentity(t.identity)
+		}
+		errs.Check(err == nil, positions, prefix+"identity_from", "%v", err)
+	}
+	errs.Check(t.IdentityFrom == "" || (t.SSHKey == "" && t.SSHAgent == ""), positions, prefix+"ssh_key", "cannot be used with identity_from")
+	if t.IdentityFrom == "" && (t.SSHKey != "" || t.SSHAgent != "") {
+		_, err := common.SSHSigner(t.SSHKey, t.SSHAgent)
+		errs.Check(err == nil, positions, prefix+"ssh_key", "%v", err)
+	}
+	if t.RelayKey != "" {
+		_, err := common.ParsePublicKey(t.RelayKey)
+		errs.Check(err == nil, positions, prefix+"relay_key", "%v", err)
+	} else if t.KnownRelays != "" {
+		_, err := common.ReadKnownRelays(t.KnownRelays)
+		errs.Check(err == nil, positions, prefix+"known_relays", "%v", err)
+	}
+	if t.PublicPort != "" {
+		var err error
+		t.publicPort, err = bind.ParseRange(t.PublicPort)
+		errs.Check(err == nil, positions, prefix+"public_port", "%v", err)
+	}
+}
+
+// configLoader reads the configuration file and applies the command line,
+// which is done again on each reload.
+type configLoader struct {
+	path  string
+	flags *config.Flags
+	args  []string
+}
+
+func (l *configLoader) load() (*localConfig, config.Errors) {
+	cfg := defaultLocalConfig()
+	positions, errs := config.Load(l.path, &cfg, l.flags)
+	if len(l.args) >= 2 {
+		cfg.LocalAddr, cfg.RelayAddr = l.args[0], l.args[1]
+		positions["local_addr"] = config.Pos{File: "command line"}
+		positions["relay_addr"] = config.Pos{File: "command line"}
+	}
+	if len(l.args) == 3 {
+		cfg.Passphrase, cfg.PassphraseFrom = l.args[2], ""
+		positions["passphrase"] = config.Pos{File: "command line"}
+	}
+	errs = errs.Merge(cfg.validate(positions))
+	return &cfg, errs
+}
+
+// loadConfig parses the command line and the configuration file. It exits the
+// program if the configuration is invalid, or if only a check or a reload is
+// requested.
+func loadConfig() (*localConfig, *configLoader) {
+	defaults := defaultLocalConfig()
+	configPath := flag.String("config", "", "load configuration from this file (JSON, or KEY=VALUE lines)")
+	check := flag.Bool("check", false, "validate the configuration and exit")
+	reload := flag.Bool("reload", false, "validate the configuration, ask the running popub-local to reload it through control-socket, and exit")
+	flags := config.BindFlags(flag.CommandLine, &defaults)
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] [local_addr relay_addr [passphrase]]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Println()
+	}
+	flag.Parse()
+
+	if (flag.NArg() == 1 || flag.NArg() > 3) || flag.NFlag() == 0 && flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	config.WarnCommandLine(flag.CommandLine, "passphrase", flag.NArg() == 3)
+	loader := &configLoader{path: *configPath, flags: flags, args: flag.Args()}
+	cfg, errs := loader.load()
+	if len(errs) != 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		os.Exit(1)
+	}
+	if *check {
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+	if *reload {
+		config.SendReload(cfg.ControlSocket)
+	}
+	return cfg, loader
+}
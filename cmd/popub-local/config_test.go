@@ -0,0 +1,117 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/m13253/popub/internal/config"
+)
+
+// withDefaults returns the default settings of a tunnel, changed by set.
+func withDefaults(set func(t *tunnelConfig)) tunnelConfig {
+	t := defaultLocalConfig().tunnelConfig
+	set(&t)
+	return t
+}
+
+func TestResolveTunnels(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		args []string
+		want map[string]tunnelConfig
+	}{
+		{"top level only", `{"local_addr": "l", "relay_addr": "r", "passphrase": "p"}`, nil,
+			map[string]tunnelConfig{
+				"": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase = "l", "r", "p" }),
+			}},
+		{"inherited", `{"relay_addr": "r", "passphrase": "p", "pool_min": 2, "tunnels": {"web": {"local_addr": "w"}}}`, nil,
+			map[string]tunnelConfig{
+				"web": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase, t.PoolMin = "w", "r", "p", 2 }),
+			}},
+		{"overridden", `{"local_addr": "l", "relay_addr": "r", "passphrase": "p", "mux": true,
+			"tunnels": {"web": {"local_addr": "w", "passphrase": "q", "mux": false}}}`, nil,
+			map[string]tunnelConfig{
+				"":    withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase, t.Mux = "l", "r", "p", true }),
+				"web": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase = "w", "r", "q" }),
+			}},
+		{"passphrase_from in a tunnel", `{"relay_addr": "r", "passphrase": "p", "tunnels": {"web": {"local_addr": "w", "passphrase_from": "env:WEB"}}}`, nil,
+			map[string]tunnelConfig{
+				"web": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.PassphraseFrom = "w", "r", "env:WEB" }),
+			}},
+		{"passphrase in a tunnel", `{"relay_addr": "r", "passphrase_from": "env:TOP", "tunnels": {"web": {"local_addr": "w", "passphrase": "q"}}}`, nil,
+			map[string]tunnelConfig{
+				"web": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase = "w", "r", "q" }),
+			}},
+		{"passphrase_from inherited", `{"relay_addr": "r", "passphrase_from": "env:TOP", "tunnels": {"web": {"local_addr": "w"}}}`, nil,
+			map[string]tunnelConfig{
+				"web": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.PassphraseFrom = "w", "r", "env:TOP" }),
+			}},
+		{"flags at top level", `{"relay_addr": "r", "passphrase": "p", "tunnels": {"a": {"local_addr": "a"}, "b": {"local_addr": "b", "pool_min": 5}}}`,
+			[]string{"-pool-min", "3", "-relay-addr", "s"},
+			map[string]tunnelConfig{
+				"a": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase, t.PoolMin = "a", "s", "p", 3 }),
+				"b": withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.RelayAddr, t.Passphrase, t.PoolMin = "b", "s", "p", 5 }),
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultLocalConfig()
+			fs := flag.NewFlagSet("popub-local", flag.ContinueOnError)
+			flags := config.BindFlags(fs, &cfg)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "popub-local.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			positions, errs := config.Load(path, &cfg, flags)
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			got := cfg.resolveTunnels(positions)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTunnelChanges checks the changes logged when a tunnel is restarted on
+// reload, which must not show the passphrase.
+func TestTunnelChanges(t *testing.T) {
+	old := withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.Passphrase = "a", "old-secret" })
+	new := withDefaults(func(t *tunnelConfig) { t.LocalAddr, t.Passphrase, t.PoolMin = "a", "new-secret", 2 })
+	got := config.Changes(&old, &new, "tunnels.web")
+	want := []string{"tunnels.web.passphrase changed", "tunnels.web.pool_min: 1 → 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, change := range got {
+		if strings.Contains(change, "secret") {
+			t.Errorf("secret shown: %q", change)
+		}
+	}
+}
@@ -18,146 +18,328 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"bytes"
-	"crypto/cipher"
-	"crypto/ecdh"
-	"crypto/rand"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/bind"
 	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/config"
+	"github.com/m13253/popub/internal/control"
+	"github.com/m13253/popub/internal/drain"
 	"github.com/m13253/popub/internal/proxy_v2"
-	"golang.org/x/crypto/chacha20poly1305"
+	"github.com/m13253/popub/internal/systemd"
 )
 
 func main() {
-	if len(os.Args) != 4 {
-		fmt.Printf("Usage: %s local_addr relay_addr passphrase\n\n", os.Args[0])
-		return
+	cfg, loader := loadConfig()
+	err := cfg.Apply()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &supervisor{
+		ctx:      ctx,
+		loader:   loader,
+		conns:    drain.New(),
+		cfg:      cfg,
+		authKeys: make(map[string][]byte),
+		tunnels:  make(map[string]*runningTunnel),
 	}
-	localAddr, relayAddr, passphrase := os.Args[1], os.Args[2], os.Args[3]
-	authKey := common.PassphraseToPSK(passphrase)
+	s.mu.Lock()
+	for _, name := range slices.Sorted(maps.Keys(cfg.tunnels)) {
+		s.start(name, cfg.tunnels[name], nil)
+	}
+	s.mu.Unlock()
 
-	d := backoff.New()
-	for {
-		err := dialRelay(localAddr, relayAddr, authKey)
-		d.ProcessError(err)
+	if cfg.ControlSocket != "" {
+		controlListener, err := control.Listen(cfg.ControlSocket)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go control.Serve(ctx, controlListener, s.handleCommand)
 	}
+	go s.reloadOnSignal()
+	go systemd.Run(ctx, s.status)
+
+	<-ctx.Done()
+	_ = systemd.Notify("STOPPING=1")
+	// Wait for a reload in progress, so that no tunnel starts afterwards.
+	s.mu.Lock()
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	// A second signal terminates immediately.
+	stop()
+	active := s.conns.Len()
+	log.Printf("shutting down, waiting up to %.1f seconds for %d connections in progress", time.Duration(cfg.DrainTimeout).Seconds(), active)
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	remaining := s.conns.Shutdown(drainCtx)
+	log.Printf("shutdown: %d connections finished, %d closed", active-remaining, remaining)
 }
 
-func dialRelay(localAddr, relayAddr string, authKey []byte) error {
-	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
-		return err
+// supervisor runs the tunnels of the configuration, which may be reloaded.
+type supervisor struct {
+	ctx    context.Context
+	loader *configLoader
+	// conns are the connections in progress of all tunnels, including the
+	// ones removed by a reload.
+	conns *drain.Group
+	wg    sync.WaitGroup
+	// ready is set once systemd is told that the service is ready.
+	ready atomic.Bool
+
+	mu  sync.Mutex
+	cfg *localConfig
+	// Tunnels sharing the same passphrase only run Argon2 once.
+	authKeys map[string][]byte
+	tunnels  map[string]*runningTunnel
+}
+
+type runningTunnel struct {
+	t      *tunnel
+	cancel context.CancelFunc
+}
+
+// start runs a tunnel. A tunnel replacing old keeps its token, so that it
+// gets the same public port. The caller must hold s.mu.
+func (s *supervisor) start(name string, cfg tunnelConfig, old *tunnel) {
+	passphrase := cfg.Passphrase + "\x00" + cfg.PassphraseParams
+	authKey, ok := s.authKeys[passphrase]
+	if !ok {
+		var err error
+		// The passphrase is already checked by the configuration.
+		authKey, err = common.PassphraseToPSK(cfg.Passphrase, cfg.PassphraseParams)
+		if err != nil {
+			log.Printf("%s: %v", tunnelDisplayName(name), err)
+			return
+		}
+		s.authKeys[passphrase] = authKey
+	}
+	t := newTunnel(name, cfg, authKey, s.conns)
+	t.authorized = s.notifyReady
+	if old != nil {
+		t.token = old.token
 	}
 
-	relayConn, err := net.DialTimeout("tcp", relayAddr, common.NetworkTimeout)
-	if err != nil {
-		return err
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.tunnels[name] = &runningTunnel{t: t, cancel: cancel}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.run(ctx)
+	}()
+}
+
+// notifyReady tells systemd that the service is ready, once the first tunnel
+// is authorized by its relay.
+func (s *supervisor) notifyReady() {
+	if !s.ready.Swap(true) {
+		_ = systemd.Notify("READY=1")
+	}
+}
+
+// status summarizes the tunnels for systemctl status.
+func (s *supervisor) status() string {
+	s.mu.Lock()
+	n := len(s.tunnels)
+	s.mu.Unlock()
+	return fmt.Sprintf("%d tunnels, %d connections in progress", n, s.conns.Len())
+}
+
+func (s *supervisor) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		_ = s.reload()
+	}
+}
+
+func (s *supervisor) handleCommand(command string) error {
+	switch command {
+	case "reload":
+		return s.reload()
+	default:
+		return fmt.Errorf("unknown command: %q", command)
+	}
+}
+
+// reload reads the configuration again. Changed tunnels are restarted, and
+// removed ones are stopped, while their connections in progress keep running.
+// Nothing is changed if the new configuration is invalid.
+func (s *supervisor) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+
+	log.Println("reloading configuration")
+	_ = systemd.Notify(systemd.Reloading()...)
+	if s.ready.Load() {
+		defer systemd.Notify("READY=1")
+	}
+	cfg, errs := s.loader.load()
+	if len(errs) != 0 {
+		log.Printf("reload rejected:\n%v", errs)
+		return errs
 	}
-	relayTCPConn := relayConn.(*net.TCPConn)
+	for _, change := range config.Changes(&s.cfg.Common, &cfg.Common, "") {
+		log.Printf("%s (ignored until restart)", change)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.tunnels)) {
+		tc := cfg.tunnels[name]
+		old, ok := s.tunnels[name]
+		if !ok {
+			s.start(name, tc, nil)
+			log.Println("added", tunnelDisplayName(name))
+			continue
+		}
+		if reflect.DeepEqual(old.t.cfg, tc) {
+			continue
+		}
+		prefix := ""
+		if name != "" {
+			prefix = "tunnels." + name
+		}
+		for _, change := range config.Changes(&old.t.cfg, &tc, prefix) {
+			log.Println(change)
+		}
+		old.cancel()
+		s.start(name, tc, old.t)
+		log.Println("restarted", tunnelDisplayName(name))
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.tunnels)) {
+		if _, ok := cfg.tunnels[name]; !ok {
+			s.tunnels[name].cancel()
+			delete(s.tunnels, name)
+			log.Println("removed", tunnelDisplayName(name))
+		}
+	}
+	used := make(map[string]bool)
+	for _, t := range cfg.tunnels {
+		used[t.Passphrase+"\x00"+t.PassphraseParams] = true
+	}
+	maps.DeleteFunc(s.authKeys, func(passphrase string, _ []byte) bool {
+		return !used[passphrase]
+	})
 
-	_ = relayTCPConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-	nonce, err := common.WriteX25519(relayTCPConn, privkey.PublicKey(), authKey, &[chacha20poly1305.NonceSizeX]byte{})
+	s.cfg = cfg
+	log.Println("configuration reloaded")
+	return nil
+}
+
+func tunnelDisplayName(name string) string {
+	if name == "" {
+		return "the top-level tunnel"
+	}
+	return fmt.Sprintf("tunnel %q", name)
+}
+
+// handshake dials the relay and authorizes a relay link. The relay link is
+// closed if ctx is done before it is finished.
+func (t *tunnel) handshake(ctx context.Context, hello byte) (relayConn net.Conn, send, recv *common.CipherState, err error) {
+	d := net.Dialer{Timeout: common.NetworkTimeout}
+	relayConn, err = d.DialContext(ctx, "tcp", t.cfg.RelayAddr)
 	if err != nil {
-		relayTCPConn.Close()
-		return err
+		return
 	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = relayConn.Close()
+	})
+	defer stop()
 
-	_ = relayTCPConn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
-	pubkey, _, err := common.ReadX25519(relayTCPConn, authKey, &nonce)
+	send, recv, err = common.ClientHandshake(relayConn, t.authKey, t.keys)
 	if err != nil {
-		relayTCPConn.Close()
-		return fmt.Errorf("authorization failure: %v", err)
+		relayConn.Close()
+		return
 	}
 
-	psk, err := privkey.ECDH(pubkey)
+	t.log.Println("authorized:", relayConn.LocalAddr(), "→", relayConn.RemoteAddr())
+
+	if t.cfg.PublicPort != "" {
+		err = t.requestPort(relayConn, send, recv)
+		if err != nil {
+			relayConn.Close()
+			return
+		}
+	}
+
+	var buf [common.MaxPacketSize]byte
+	_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	err = common.WritePacket(relayConn, (&[256 - common.PacketOverhead]byte{hello, common.FeatureRekey})[:], send, buf[:])
 	if err != nil {
-		relayTCPConn.Close()
-		return err
+		relayConn.Close()
+		return
 	}
-	if len(psk) != chacha20poly1305.KeySize {
-		panic("ECDH returned incorrect key size")
+	if t.authorized != nil {
+		t.authorized()
 	}
+	return
+}
 
-	aead, err := chacha20poly1305.NewX(psk)
+// requestPort asks the relay to open a public port for the tunnel.
+func (t *tunnel) requestPort(relayConn net.Conn, send, recv *common.CipherState) error {
+	addr, err := bind.Request(relayConn, t.token, t.cfg.publicPort, send, recv)
 	if err != nil {
-		relayTCPConn.Close()
 		return err
 	}
+	t.setPublicAddr(addr)
+	return nil
+}
 
-	nonceSend := common.InitNonce(false)
-	nonceRecv := common.InitNonce(true)
-
-	log.Println("authorized:", relayTCPConn.LocalAddr(), "→", relayTCPConn.RemoteAddr())
-
-	var buf [common.MaxPacketSize]byte
-	_ = relayTCPConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-	err = common.WritePacket(relayTCPConn, (&[256 - common.PacketOverhead]byte{})[:], aead, &nonceSend, buf[:])
+func (t *tunnel) dialRelay(ctx context.Context, onAccept func()) error {
+	relayConn, send, recv, err := t.handshake(ctx, 0)
 	if err != nil {
-		relayTCPConn.Close()
 		return err
 	}
 
 	// Starting here, network error no longer increases the backoff counter.
 
-	for {
-		_ = relayTCPConn.SetReadDeadline(time.Now().Add(common.ExtendedNetworkTimeout))
-		packet, err := common.ReadPacket(relayTCPConn, aead, &nonceRecv, buf[:])
-		if err != nil {
-			relayTCPConn.Close()
-			log.Println(err)
-			return nil
-		}
-
-		if bytes.HasPrefix(packet, []byte{0}) {
-			_ = relayTCPConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-			err = common.WritePacket(relayTCPConn, (&[256 - common.PacketOverhead]byte{})[:], aead, &nonceSend, buf[:])
-			if err != nil {
-				relayTCPConn.Close()
-				log.Println(err)
-				return nil
-			}
-
-		} else if bytes.HasPrefix(packet, []byte{0xd}) {
-			proxyHeader := proxy_v2.ExtractProxyV2Header(packet)
-
-			_ = relayTCPConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-			err = common.WritePacket(relayTCPConn, (&[256 - common.PacketOverhead]byte{0xd})[:], aead, &nonceSend, buf[:])
-			if err != nil {
-				relayTCPConn.Close()
-				log.Println(err)
-				return nil
-			}
-			_ = relayConn.SetDeadline(time.Time{})
-
-			publicAddr, remoteAddr, err := proxy_v2.DecodeProxyV2Header(proxyHeader)
-			if err != nil {
-				relayTCPConn.Close()
-				log.Println(err)
-				return nil
-			}
-			log.Println("accept:", publicAddr, "←", remoteAddr)
-
-			go acceptConn(relayTCPConn, localAddr, aead, &nonceRecv, &nonceSend)
-			return nil
+	stop := context.AfterFunc(ctx, func() {
+		_ = relayConn.Close()
+	})
+	h, err := proxy_v2.ReadAccept(relayConn, send, recv)
+	if !stop() || err != nil {
+		relayConn.Close()
+		if ctx.Err() == nil {
+			t.log.Println(err)
 		}
+		return nil
 	}
+	publicAddr, remoteAddr := h.AcceptAddrs()
+	t.log.Println("accept:", publicAddr, "←", remoteAddr)
+	onAccept()
+
+	t.conns.Go(func(ctx context.Context) {
+		t.acceptConn(ctx, relayConn, h, send, recv)
+	})
+	return nil
 }
 
-func acceptConn(relayConn *net.TCPConn, localAddr string, aead cipher.AEAD, nonceRecv, nonceSend *[chacha20poly1305.NonceSizeX]byte) {
-	localConn, err := net.Dial("tcp", localAddr)
+func (t *tunnel) acceptConn(ctx context.Context, relayConn net.Conn, h *proxy_v2.Header, send, recv *common.CipherState) {
+	localConn, err := t.dialLocal(h)
 	if err != nil {
 		relayConn.Close()
-		log.Println(err)
+		t.log.Println(err)
 		return
 	}
-	localTCPConn := localConn.(*net.TCPConn)
 
-	go common.ForwardEncryptedToClear(relayConn, localTCPConn, aead, nonceRecv)
-	go common.ForwardClearToEncrypted(localTCPConn, relayConn, aead, nonceSend)
+	common.Forward(ctx, localConn, relayConn, send, recv)
 }
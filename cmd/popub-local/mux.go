@@ -0,0 +1,159 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/m13253/popub/internal/mux"
+	"github.com/m13253/popub/internal/proxy_v2"
+)
+
+// dialMux serves a multiplexed session until it is closed, or ctx is done.
+// In the latter case, the session is kept until the streams it carries are
+// finished, but new streams are refused.
+func (t *tunnel) dialMux(ctx context.Context) error {
+	relayConn, send, recv, err := t.handshake(ctx, mux.PacketHello)
+	if err != nil {
+		return err
+	}
+
+	// Starting here, network error no longer increases the backoff counter.
+
+	sess := mux.NewSession(relayConn, send, recv, false, t.log)
+	stop := context.AfterFunc(t.conns.Context(), func() {
+		_ = sess.Close()
+	})
+	go t.acceptFlows(sess)
+	go func() {
+		defer stop()
+		for {
+			st, err := sess.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					t.log.Println("multiplexed session closed:", err)
+				}
+				return
+			}
+			if ctx.Err() != nil {
+				st.Reset()
+				continue
+			}
+			t.conns.Go(func(ctx context.Context) {
+				t.acceptStream(ctx, st)
+			})
+		}
+	}()
+
+	select {
+	case <-sess.Done():
+	case <-ctx.Done():
+		sess.CloseWhenIdle()
+	}
+	return nil
+}
+
+func (t *tunnel) acceptStream(ctx context.Context, st *mux.Stream) {
+	h, err := proxy_v2.DecodeAcceptPayload(st.Header())
+	if err != nil {
+		st.Reset()
+		t.log.Println(err)
+		return
+	}
+	publicAddr, remoteAddr := h.AcceptAddrs()
+	t.log.Printf("accept: %s ← %s (stream %d)", publicAddr, remoteAddr, st.ID())
+
+	localConn, err := t.dialLocal(h)
+	if err != nil {
+		st.Reset()
+		t.log.Println(err)
+		return
+	}
+
+	mux.Forward(ctx, st, localConn)
+}
+
+func (t *tunnel) acceptFlows(sess *mux.Session) {
+	for {
+		f, err := sess.AcceptFlow()
+		if err != nil {
+			return
+		}
+		if t.cfg.UDP == "" {
+			t.log.Printf("rejecting UDP flow %d: no local UDP address configured", f.ID())
+			_ = f.Close()
+			continue
+		}
+		go t.acceptFlow(f)
+	}
+}
+
+func (t *tunnel) acceptFlow(f *mux.Flow) {
+	publicAddr, remoteAddr, err := proxy_v2.DecodeProxyV2Header(f.Header())
+	if err != nil {
+		_ = f.Close()
+		t.log.Println(err)
+		return
+	}
+	t.log.Printf("accept UDP: %s ← %s (flow %d)", publicAddr, remoteAddr, f.ID())
+
+	localConn, err := net.Dial("udp", t.cfg.UDP)
+	if err != nil {
+		_ = f.Close()
+		t.log.Println(err)
+		return
+	}
+
+	go func() {
+		<-f.Done()
+		_ = localConn.Close()
+	}()
+	go func() {
+		for {
+			datagram, err := f.Recv()
+			if err != nil {
+				return
+			}
+			_, err = localConn.Write(datagram)
+			if err != nil {
+				t.log.Println(err)
+			}
+		}
+	}()
+
+	var buf [65536]byte
+	for {
+		n, err := localConn.Read(buf[:])
+		if err != nil {
+			select {
+			case <-f.Done():
+			default:
+				t.log.Println(err)
+				_ = f.Close()
+			}
+			return
+		}
+		err = f.Send(buf[:n])
+		if err == mux.ErrDatagramTooLarge {
+			t.log.Printf("dropping UDP datagram from %s: %v (%d bytes)", t.cfg.UDP, err, n)
+		} else if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+)
+
+const poolAdaptInterval = 10 * time.Second
+
+// tunnelPool keeps a number of authorized idle tunnels waiting at the relay.
+// Each worker dials one tunnel at a time, and dials a new one as soon as the
+// previous one is handed off, so that the pool refills in parallel.
+type tunnelPool struct {
+	t *tunnel
+	// dial serves one tunnel until it is handed off, or ctx is done.
+	dial func(ctx context.Context, onAccept func()) error
+
+	minIdle  int
+	maxIdle  int
+	adaptive bool
+
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+	// workers stop each worker, which closes its idle tunnel.
+	workers []context.CancelFunc
+	target  int
+	accepts int
+}
+
+func newTunnelPool(t *tunnel) *tunnelPool {
+	return &tunnelPool{
+		t:        t,
+		dial:     t.dialRelay,
+		minIdle:  t.cfg.PoolMin,
+		maxIdle:  t.cfg.PoolMax,
+		adaptive: t.cfg.PoolAdaptive,
+		target:   t.cfg.PoolMin,
+	}
+}
+
+// Run keeps the pool filled until ctx is done, then waits for the workers to
+// stop.
+func (p *tunnelPool) Run(ctx context.Context) {
+	p.mu.Lock()
+	p.resizeLocked(ctx)
+	p.mu.Unlock()
+
+	if p.adaptive {
+		ticker := time.NewTicker(poolAdaptInterval)
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+				p.adapt(ctx)
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		ticker.Stop()
+	} else {
+		<-ctx.Done()
+	}
+	p.wg.Wait()
+}
+
+// OnAccept is called each time a tunnel is handed off.
+func (p *tunnelPool) OnAccept() {
+	p.mu.Lock()
+	p.accepts++
+	p.mu.Unlock()
+}
+
+// adapt sizes the pool to the number of connections accepted during the last
+// interval. When the accept rate drops, the pool shrinks halfway towards the
+// minimum each interval.
+func (p *tunnelPool) adapt(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	target := poolTarget(p.target, p.accepts, p.minIdle, p.maxIdle)
+	if target != p.target {
+		p.t.log.Printf("pool size: %d → %d (%d accepts in last %.1f seconds)", p.target, target, p.accepts, poolAdaptInterval.Seconds())
+		p.target = target
+	}
+	p.accepts = 0
+	p.resizeLocked(ctx)
+}
+
+// poolTarget returns the next pool size, from the current one and the number
+// of connections accepted during the last interval, within minIdle and
+// maxIdle.
+func poolTarget(target, accepts, minIdle, maxIdle int) int {
+	target = max(accepts, (target+minIdle)/2)
+	return min(max(target, minIdle), maxIdle)
+}
+
+// resizeLocked starts or stops workers to match the target. Stopping a worker
+// closes its idle tunnel, while the connections it was handed keep running.
+func (p *tunnelPool) resizeLocked(ctx context.Context) {
+	for len(p.workers) < p.target {
+		workerCtx, cancel := context.WithCancel(ctx)
+		p.workers = append(p.workers, cancel)
+		p.wg.Add(1)
+		go p.worker(workerCtx)
+	}
+	for len(p.workers) > p.target {
+		p.workers[len(p.workers)-1]()
+		p.workers = p.workers[:len(p.workers)-1]
+	}
+}
+
+func (p *tunnelPool) worker(ctx context.Context) {
+	defer p.wg.Done()
+	d := backoff.NewWithContext(ctx, p.t.log)
+	for ctx.Err() == nil {
+		err := p.dial(ctx, p.OnAccept)
+		if ctx.Err() != nil {
+			return
+		}
+		d.ProcessError(err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  int
+		accepts int
+		min     int
+		max     int
+		want    int
+	}{
+		{"idle at minimum", 2, 0, 2, 8, 2},
+		{"grows to accepts", 2, 5, 2, 8, 5},
+		{"clamped to maximum", 2, 20, 2, 8, 8},
+		{"shrinks halfway", 8, 0, 2, 8, 5},
+		{"shrinks to minimum", 3, 0, 2, 8, 2},
+		{"shrinks to accepts", 8, 6, 0, 8, 6},
+		{"without minimum", 1, 0, 0, 8, 0},
+		{"above maximum", 8, 8, 1, 4, 4},
+		{"below minimum", 1, 0, 4, 8, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := poolTarget(tt.target, tt.accepts, tt.min, tt.max); got != tt.want {
+				t.Errorf("poolTarget(%d, %d, %d, %d) = %d, want %d", tt.target, tt.accepts, tt.min, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPoolShrink checks that the idle tunnels of stopped workers are closed
+// when the pool shrinks.
+func TestPoolShrink(t *testing.T) {
+	var idle atomic.Int32
+	p := &tunnelPool{
+		t: &tunnel{log: log.New(io.Discard, "", 0)},
+		dial: func(ctx context.Context, onAccept func()) error {
+			idle.Add(1)
+			defer idle.Add(-1)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		minIdle:  1,
+		maxIdle:  8,
+		adaptive: true,
+		target:   1,
+	}
+	expectIdle := func(want int32) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for idle.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d idle tunnels, want %d", idle.Load(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.mu.Lock()
+	p.resizeLocked(ctx)
+	p.mu.Unlock()
+	expectIdle(1)
+
+	for range 6 {
+		p.OnAccept()
+	}
+	p.adapt(ctx)
+	expectIdle(6)
+	for _, want := range []int32{3, 2, 1, 1} {
+		p.adapt(ctx)
+		expectIdle(want)
+	}
+
+	cancel()
+	p.wg.Wait()
+	expectIdle(0)
+}
@@ -0,0 +1,147 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/drain"
+	"github.com/m13253/popub/internal/proxy_v2"
+)
+
+// tunnel publishes one local service through one relay. Each tunnel has its
+// own connections and backoff, so that a broken tunnel does not affect the
+// others in the same process.
+type tunnel struct {
+	name    string
+	cfg     tunnelConfig
+	authKey []byte
+	// keys are the relay key to check, and the identity or SSH key of the
+	// tunnel, used in each handshake.
+	keys common.ClientKeys
+	log  *log.Logger
+	// conns are the connections in progress, shared by all tunnels.
+	conns *drain.Group
+	// authorized, if not nil, is called after each successful handshake.
+	authorized func()
+
+	// token identifies this tunnel to the relay when asking for a public
+	// port, so that all relay links of the tunnel get the same port.
+	token bind.Token
+
+	mu         sync.Mutex
+	publicAddr string
+}
+
+func newTunnel(name string, cfg tunnelConfig, authKey []byte, conns *drain.Group) *tunnel {
+	prefix := ""
+	if name != "" {
+		prefix = "[" + name + "] "
+	}
+	t := &tunnel{
+		name:    name,
+		cfg:     cfg,
+		authKey: authKey,
+		log:     log.New(log.Writer(), prefix, log.Flags()|log.Lmsgprefix),
+		conns:   conns,
+	}
+	// The keys are already checked by the configuration.
+	if cfg.identity != "" {
+		t.keys.Identity, _ = common.ParseIdentity(cfg.identity)
+	} else if cfg.SSHKey != "" || cfg.SSHAgent != "" {
+		t.keys.SignSSH, _ = common.SSHSigner(cfg.SSHKey, cfg.SSHAgent)
+	}
+	t.keys.CheckRelay, _ = common.RelayKeyChecker(cfg.RelayKey, cfg.KnownRelays, cfg.RelayAddr, t.log)
+	_, _ = rand.Read(t.token[:])
+	return t
+}
+
+// setPublicAddr prints the public address assigned by the relay, when it is
+// different from the last one.
+func (t *tunnel) setPublicAddr(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if addr != t.publicAddr {
+		t.publicAddr = addr
+		t.log.Println("public address:", addr)
+	}
+}
+
+// run keeps the tunnel connected until ctx is done. Connections in progress
+// are left to t.conns.
+func (t *tunnel) run(ctx context.Context) {
+	if t.cfg.Mux {
+		d := backoff.NewWithContext(ctx, t.log)
+		for ctx.Err() == nil {
+			err := t.dialMux(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			d.ProcessError(err)
+		}
+		return
+	}
+	newTunnelPool(t).Run(ctx)
+}
+
+// proxyHeader returns the PROXY protocol header to send to the local service
+// before any data, or nil if none is configured. TLVs from the relay are
+// passed along in v2 headers.
+func (t *tunnel) proxyHeader(h *proxy_v2.Header) ([]byte, error) {
+	publicAddr, remoteAddr := h.AcceptAddrs()
+	switch t.cfg.ProxyProtocol {
+	case "v1":
+		return proxy_v2.EncodeProxyV1(publicAddr, remoteAddr), nil
+	case "v2":
+		return proxy_v2.EncodeProxyV2(publicAddr, remoteAddr, h.TLVs)
+	default:
+		return nil, nil
+	}
+}
+
+// dialLocal connects to the local service and sends the PROXY protocol header
+// if configured.
+func (t *tunnel) dialLocal(h *proxy_v2.Header) (net.Conn, error) {
+	header, err := t.proxyHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	localConn, err := common.Dial(t.cfg.LocalAddr, common.NetworkTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if header != nil {
+		_ = localConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+		_, err = localConn.Write(header)
+		if err != nil {
+			localConn.Close()
+			return nil, err
+		}
+		_ = localConn.SetWriteDeadline(time.Time{})
+	}
+	return localConn, nil
+}
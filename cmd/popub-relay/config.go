@@ -0,0 +1,462 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/m13253/popub"
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/config"
+)
+
+// tenantConfig holds the settings of one tenant. Each tenant has its own
+// passphrase and public listeners; a popub-local authorized with a tenant's
+// passphrase only receives connections from that tenant's listeners.
+type tenantConfig struct {
+	PublicAddr        []string `json:"public_addr" usage:"addresses to accept public connections on, separated by spaces; unix:path for a Unix socket, systemd:name for a socket passed by systemd" arg:"addresses"`
+	Passphrase        string   `json:"passphrase" usage:"passphrase shared with popub-local, see also passphrase-from" arg:"passphrase"`
+	PassphraseParams  string   `json:"passphrase_params" usage:"salt and Argon2 parameters generated by popub keygen -params, the same as popub-local" arg:"params"`
+	PassphraseFrom    string   `json:"passphrase_from" usage:"read the passphrase from this source: file:path, env:NAME, credential:NAME (systemd LoadCredential=), or stdin" arg:"source"`
+	RelayKeyFrom      string   `json:"relay_key_from" usage:"read the relay key, an identity key generated by popub keygen -identity, from this source, in the same form as passphrase-from" arg:"source"`
+	AuthorizedKeys    string   `json:"authorized_keys" usage:"only accept popub-local with an identity key listed in this file, see popub keygen -identity" arg:"file"`
+	SSHAuthorizedKeys string   `json:"ssh_authorized_keys" usage:"only accept popub-local with an SSH key listed in this OpenSSH authorized_keys file" arg:"file"`
+
+	// Keys are additional passphrases, keyed by name, to rotate the
+	// passphrase without updating every popub-local at once.
+	Keys map[string]keyConfig `json:"keys"`
+
+	PublicProxy        bool            `json:"public_proxy" usage:"expect a PROXY v1 or v2 header from a load balancer at the start of each public connection"`
+	PublicProxyTrusted []string        `json:"public_proxy_trusted" usage:"only accept PROXY headers from these networks, such as 10.0.0.0/8, separated by spaces" arg:"networks"`
+	PublicProxyTimeout config.Duration `json:"public_proxy_timeout" usage:"maximum duration to wait for the PROXY header" arg:"duration"`
+
+	QueueSize     int             `json:"queue_size" usage:"maximum number of public connections waiting for a tunnel" arg:"number"`
+	QueueTimeout  config.Duration `json:"queue_timeout" usage:"maximum duration a public connection waits for a tunnel" arg:"duration"`
+	QueueFallback string          `json:"queue_fallback" usage:"action on public connections that cannot be served: rst, close, or response" arg:"action"`
+	QueueResponse string          `json:"queue_response" usage:"file containing the data sent to the client when queue-fallback is response" arg:"file"`
+
+	PublicUDP  []string        `json:"public_udp" usage:"also forward UDP datagrams received on these addresses, through multiplexed tunnels" arg:"addresses"`
+	UDPTimeout config.Duration `json:"udp_timeout" usage:"idle duration after which a UDP flow expires" arg:"duration"`
+
+	BindPorts  []string        `json:"bind_ports" usage:"public ports popub-local may ask for, such as 20000-20999, separated by spaces" arg:"ports"`
+	BindMax    int             `json:"bind_max" usage:"maximum number of ports popub-local may ask for at the same time" arg:"number"`
+	BindHost   string          `json:"bind_host" usage:"host to open the requested ports on, which is also reported to popub-local" arg:"host"`
+	BindLinger config.Duration `json:"bind_linger" usage:"duration a requested port stays open after its last tunnel is gone" arg:"duration"`
+
+	response           []byte
+	publicProxyTrusted []netip.Prefix
+	authorizedKeys     []popub.AuthorizedKey
+	relayKey           string
+}
+
+// keyConfig is an additional passphrase of a tenant, accepted from not_before
+// until not_after, if they are set.
+type keyConfig struct {
+	Passphrase       string `json:"passphrase"`
+	PassphraseParams string `json:"passphrase_params"`
+	PassphraseFrom   string `json:"passphrase_from"`
+	NotBefore        string `json:"not_before"`
+	NotAfter         string `json:"not_after"`
+
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+type relayConfig struct {
+	config.Common
+
+	RelayAddr string `json:"relay_addr" usage:"address to accept popub-local connections on, shared by all tenants" arg:"address"`
+
+	tenantConfig
+
+	// Tenants are named tenants in addition to the one at the top level.
+	// Unspecified settings are taken from the top level.
+	Tenants map[string]tenantConfig `json:"tenants"`
+
+	tenants map[string]tenantConfig
+}
+
+func defaultRelayConfig() relayConfig {
+	return relayConfig{
+		Common: config.DefaultCommon(),
+		tenantConfig: tenantConfig{
+			PublicProxyTimeout: config.Duration(10 * time.Second),
+			QueueSize:          1024,
+			QueueTimeout:       config.Duration(30 * time.Second),
+			QueueFallback:      "close",
+			UDPTimeout:         config.Duration(60 * time.Second),
+			BindMax:            4,
+			BindLinger:         config.Duration(30 * time.Second),
+		},
+	}
+}
+
+// resolveTenants returns all tenants to serve, keyed by name. The tenant at
+// the top level is named "", and only exists if public_addr or bind_ports is
+// set there.
+func (c *relayConfig) resolveTenants(positions config.Positions) map[string]tenantConfig {
+	tenants := make(map[string]tenantConfig)
+	if len(c.PublicAddr) != 0 || len(c.BindPorts) != 0 || len(c.Tenants) == 0 {
+		tenants[""] = c.tenantConfig
+	}
+	for name, t := range c.Tenants {
+		config.Inherit(&t, c.tenantConfig, positions, "tenants."+name)
+		config.InheritSecret(&t.Passphrase, &t.PassphraseFrom, positions, "tenants."+name+".passphrase")
+		tenants[name] = t
+	}
+	return tenants
+}
+
+// validate also resolves the tenants to serve.
+func (c *relayConfig) validate(positions config.Positions) config.Errors {
+	var errs config.Errors
+	c.Common.Validate(&errs, positions)
+	errs.Check(c.RelayAddr != "", positions, "relay_addr", "required")
+
+	c.tenants = c.resolveTenants(positions)
+	passphrases := make(map[string]string)
+	addrs := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(c.tenants)) {
+		t := c.tenants[name]
+		prefix := ""
+		if name != "" {
+			errs.Check(!strings.ContainsAny(name, " \t\r\n[]"), positions, "tenants."+name, "invalid tenant name")
+			prefix = "tenants." + name + "."
+		}
+		t.validate(&errs, positions, prefix)
+		c.tenants[name] = t
+
+		// The passphrase is what tells tenants apart on the shared relay
+		// address.
+		if t.Passphrase != "" {
+			passphrase := t.Passphrase + "\x00" + t.PassphraseParams
+			other, ok := passphrases[passphrase]
+			errs.Check(!ok, positions, prefix+"passphrase", "same as the passphrase of %s", tenantDisplayName(other))
+			passphrases[passphrase] = name
+		}
+		for _, keyName := range slices.Sorted(maps.Keys(t.Keys)) {
+			k := t.Keys[keyName]
+			if k.Passphrase == "" {
+				continue
+			}
+			passphrase := k.Passphrase + "\x00" + k.PassphraseParams
+			other, ok := passphrases[passphrase]
+			errs.Check(!ok, positions, prefix+"keys."+keyName+".passphrase", "same as the passphrase of %s", tenantDisplayName(other))
+			passphrases[passphrase] = name
+		}
+		for i, addr := range t.PublicAddr {
+			other, ok := addrs["tcp "+addr]
+			errs.Check(!ok, positions, fmt.Sprintf("%spublic_addr[%d]", prefix, i), "already used by %s", tenantDisplayName(other))
+			addrs["tcp "+addr] = name
+		}
+		for i, addr := range t.PublicUDP {
+			other, ok := addrs["udp "+addr]
+			errs.Check(!ok, positions, fmt.Sprintf("%spublic_udp[%d]", prefix, i), "already used by %s", tenantDisplayName(other))
+			addrs["udp "+addr] = name
+		}
+	}
+	return errs
+}
+
+// validate also parses queue_fallback and reads queue_response, so that the
+// check mode catches unreadable files.
+func (t *tenantConfig) validate(errs *config.Errors, positions config.Positions, prefix string) {
+	errs.Check(len(t.PublicAddr) != 0 || len(t.BindPorts) != 0, positions, prefix+"public_addr", "required unless bind_ports is set")
+	// A tenant requiring keys may do without a passphrase.
+	config.LoadSecret(errs, positions, prefix+"passphrase", &t.Passphrase, t.PassphraseFrom, t.AuthorizedKeys != "" || t.SSHAuthorizedKeys != "")
+	if t.Passphrase != "" {
+		err := common.CheckPassphrase(t.Passphrase, t.PassphraseParams)
+		path := prefix + "passphrase_params"
+		if t.PassphraseParams == "" {
+			path = prefix + "passphrase"
+		}
+		errs.Check(err == nil, positions, path, "%v", err)
+	}
+	// The keys may be shared with the tenants inheriting them, so they are
+	// copied before their passphrases are read.
+	keys := make(map[string]keyConfig, len(t.Keys))
+	for _, name := range slices.Sorted(maps.Keys(t.Keys)) {
+		k := t.Keys[name]
+		k.validate(errs, positions, prefix+"keys."+name+".")
+		keys[name] = k
+	}
+	t.Keys = keys
+	errs.Check(t.QueueSize >= 1, positions, prefix+"queue_size", "must be at least 1")
+	errs.Check(t.QueueTimeout > 0, positions, prefix+"queue_timeout", "must be positive")
+	errs.Check(t.UDPTimeout > 0, positions, prefix+"udp_timeout", "must be positive")
+	errs.Check(t.BindMax >= 1, positions, prefix+"bind_max", "must be at least 1")
+	errs.Check(t.BindLinger >= 0, positions, prefix+"bind_linger", "must not be negative")
+
+	errs.Check(t.PublicProxyTimeout > 0, positions, prefix+"public_proxy_timeout", "must be positive")
+	t.publicProxyTrusted = nil
+	for i, s := range t.PublicProxyTrusted {
+		network, err := parseNetwork(s)
+		errs.Check(err == nil, positions, fmt.Sprintf("%spublic_proxy_trusted[%d]", prefix, i), "%v", err)
+		t.publicProxyTrusted = append(t.publicProxyTrusted, network)
+	}
+	// Headers are only trusted from Unix sockets without trusted networks.
+	if t.PublicProxy && len(t.PublicProxyTrusted) == 0 {
+		for _, addr := range t.PublicAddr {
+			if !strings.HasPrefix(addr, "unix:") {
+				errs.Check(false, positions, prefix+"public_proxy_trusted", "required when public_proxy is set on TCP addresses")
+				break
+			}
+		}
+	}
+
+	for i, s := range t.BindPorts {
+		r, err := bind.ParseRange(s)
+		if err == nil && r.IsAny() {
+			err = fmt.Errorf("invalid port range: %q", s)
+		}
+		errs.Check(err == nil, positions, fmt.Sprintf("%sbind_ports[%d]", prefix, i), "%v", err)
+	}
+
+	if t.RelayKeyFrom != "" {
+		var err error
+		t.relayKey, err = config.ReadSecret(t.RelayKeyFrom)
+		if err == nil {
+			_, err = common.ParseIdentity(t.relayKey)
+		}
+		errs.Check(err == nil, positions, prefix+"relay_key_from", "%v", err)
+	}
+	t.authorizedKeys = nil
+	if t.AuthorizedKeys != "" {
+		keys, err := readAuthorizedKeys(t.AuthorizedKeys, popub.ParseAuthorizedKeys)
+		errs.Check(err == nil, positions, prefix+"authorized_keys", "%v", err)
+		t.authorizedKeys = append(t.authorizedKeys, keys...)
+	}
+	if t.SSHAuthorizedKeys != "" {
+		keys, err := readAuthorizedKeys(t.SSHAuthorizedKeys, popub.ParseSSHAuthorizedKeys)
+		errs.Check(err == nil, positions, prefix+"ssh_authorized_keys", "%v", err)
+		t.authorizedKeys = append(t.authorizedKeys, keys...)
+	}
+
+	errs.Check(slices.Contains([]string{"rst", "close", "response"}, t.QueueFallback), positions, prefix+"queue_fallback", "invalid fallback action: %q (expected rst, close, or response)", t.QueueFallback)
+	if t.QueueFallback == "response" {
+		errs.Check(t.QueueResponse != "", positions, prefix+"queue_response", "required when queue_fallback is response")
+		if t.QueueResponse != "" {
+			var err error
+			t.response, err = os.ReadFile(t.QueueResponse)
+			errs.Check(err == nil, positions, prefix+"queue_response", "%v", err)
+		}
+	}
+}
+
+func (k *keyConfig) validate(errs *config.Errors, positions config.Positions, prefix string) {
+	config.LoadSecret(errs, positions, prefix+"passphrase", &k.Passphrase, k.PassphraseFrom, false)
+	if k.Passphrase != "" {
+		err := common.CheckPassphrase(k.Passphrase, k.PassphraseParams)
+		path := prefix + "passphrase_params"
+		if k.PassphraseParams == "" {
+			path = prefix + "passphrase"
+		}
+		errs.Check(err == nil, positions, path, "%v", err)
+	}
+	var err error
+	k.notBefore, err = parseTime(k.NotBefore)
+	errs.Check(err == nil, positions, prefix+"not_before", "%v", err)
+	k.notAfter, err = parseTime(k.NotAfter)
+	errs.Check(err == nil, positions, prefix+"not_after", "%v", err)
+	errs.Check(k.notBefore.IsZero() || k.notAfter.IsZero() || k.notAfter.After(k.notBefore), positions, prefix+"not_after", "must be after not_before")
+}
+
+// parseTime accepts a time in RFC 3339 format, or a date, which is midnight
+// in the local time zone. An empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %q (expected 2006-01-02T15:04:05Z07:00 or 2006-01-02)", s)
+}
+
+// relayTenants returns the settings of the tenants used by popub.Relay.
+func (c *relayConfig) relayTenants() map[string]popub.TenantConfig {
+	tenants := make(map[string]popub.TenantConfig)
+	for name, t := range c.tenants {
+		tenants[name] = t.relayConfig()
+	}
+	return tenants
+}
+
+// publicAddrs returns the tenant of each public address, keyed by "tcp " or
+// "udp " followed by the address.
+func (c *relayConfig) publicAddrs() map[string]string {
+	addrs := make(map[string]string)
+	for name, t := range c.tenants {
+		for _, addr := range t.PublicAddr {
+			addrs["tcp "+addr] = name
+		}
+		for _, addr := range t.PublicUDP {
+			addrs["udp "+addr] = name
+		}
+	}
+	return addrs
+}
+
+// relayConfig returns the settings of the tenant used by popub.Relay.
+func (t *tenantConfig) relayConfig() popub.TenantConfig {
+	// A zero linger means the default to popub.Relay.
+	bindLinger := time.Duration(t.BindLinger)
+	if bindLinger == 0 {
+		bindLinger = -1
+	}
+	var keys map[string]popub.TenantKey
+	for name, k := range t.Keys {
+		if keys == nil {
+			keys = make(map[string]popub.TenantKey)
+		}
+		keys[name] = popub.TenantKey{
+			Passphrase:       k.Passphrase,
+			PassphraseParams: k.PassphraseParams,
+			NotBefore:        k.notBefore,
+			NotAfter:         k.notAfter,
+		}
+	}
+	return popub.TenantConfig{
+		Passphrase:         t.Passphrase,
+		PassphraseParams:   t.PassphraseParams,
+		Keys:               keys,
+		PublicProxy:        t.PublicProxy,
+		PublicProxyTrusted: t.publicProxyTrusted,
+		PublicProxyTimeout: time.Duration(t.PublicProxyTimeout),
+		QueueSize:          t.QueueSize,
+		QueueTimeout:       time.Duration(t.QueueTimeout),
+		QueueFallback:      t.QueueFallback,
+		QueueResponse:      t.response,
+		UDPTimeout:         time.Duration(t.UDPTimeout),
+		BindPorts:          t.BindPorts,
+		BindMax:            t.BindMax,
+		BindHost:           t.BindHost,
+		BindLinger:         bindLinger,
+		RelayKey:           t.relayKey,
+		RequireIdentity:    t.AuthorizedKeys != "" || t.SSHAuthorizedKeys != "",
+		AuthorizedKeys:     t.authorizedKeys,
+	}
+}
+
+func readAuthorizedKeys(path string, parse func(io.Reader) ([]popub.AuthorizedKey, error)) ([]popub.AuthorizedKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// parseNetwork accepts a network such as 10.0.0.0/8, or a single address.
+func parseNetwork(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	network, err := netip.ParsePrefix(s)
+	if err != nil || network.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid network: %q", s)
+	}
+	return network.Masked(), nil
+}
+
+// tenantDisplayName matches the names used in the errors of popub.NewRelay.
+func tenantDisplayName(name string) string {
+	if name == "" {
+		return "the top-level tenant"
+	}
+	return fmt.Sprintf("tenant %q", name)
+}
+
+// configLoader reads the configuration file and applies the command line,
+// which is done again on each reload.
+type configLoader struct {
+	path  string
+	flags *config.Flags
+	args  []string
+}
+
+func (l *configLoader) load() (*relayConfig, config.Errors) {
+	cfg := defaultRelayConfig()
+	positions, errs := config.Load(l.path, &cfg, l.flags)
+	if len(l.args) >= 2 {
+		cfg.RelayAddr, cfg.PublicAddr = l.args[0], []string{l.args[1]}
+		positions["relay_addr"] = config.Pos{File: "command line"}
+		positions["public_addr"] = config.Pos{File: "command line"}
+	}
+	if len(l.args) == 3 {
+		cfg.Passphrase, cfg.PassphraseFrom = l.args[2], ""
+		positions["passphrase"] = config.Pos{File: "command line"}
+	}
+	errs = errs.Merge(cfg.validate(positions))
+	return &cfg, errs
+}
+
+// loadConfig parses the command line and the configuration file. It exits the
+// program if the configuration is invalid, or if only a check or a reload is
+// requested.
+func loadConfig() (*relayConfig, *configLoader) {
+	defaults := defaultRelayConfig()
+	configPath := flag.String("config", "", "load configuration from this file (JSON, or KEY=VALUE lines)")
+	check := flag.Bool("check", false, "validate the configuration and exit")
+	reload := flag.Bool("reload", false, "validate the configuration, ask the running popub-relay to reload it through control-socket, and exit")
+	flags := config.BindFlags(flag.CommandLine, &defaults)
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] [relay_addr public_addr [passphrase]]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Println()
+	}
+	flag.Parse()
+
+	if (flag.NArg() == 1 || flag.NArg() > 3) || flag.NFlag() == 0 && flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	config.WarnCommandLine(flag.CommandLine, "passphrase", flag.NArg() == 3)
+	loader := &configLoader{path: *configPath, flags: flags, args: flag.Args()}
+	cfg, errs := loader.load()
+	if len(errs) != 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		os.Exit(1)
+	}
+	if *check {
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+	if *reload {
+		config.SendReload(cfg.ControlSocket)
+	}
+	return cfg, loader
+}
@@ -0,0 +1,104 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m13253/popub/internal/config"
+)
+
+// withDefaults returns the default settings of a tenant, changed by set.
+func withDefaults(set func(t *tenantConfig)) tenantConfig {
+	t := defaultRelayConfig().tenantConfig
+	set(&t)
+	return t
+}
+
+func TestResolveTenants(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		args []string
+		want map[string]tenantConfig
+	}{
+		{"top level only", `{"public_addr": ":80", "passphrase": "p"}`, nil,
+			map[string]tenantConfig{
+				"": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.Passphrase = []string{":80"}, "p" }),
+			}},
+		{"inherited", `{"passphrase": "p", "queue_size": 8, "tenants": {"web": {"public_addr": [":80", ":8080"]}}}`, nil,
+			map[string]tenantConfig{
+				"web": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.Passphrase, t.QueueSize = []string{":80", ":8080"}, "p", 8 }),
+			}},
+		{"overridden", `{"public_addr": ":80", "passphrase": "p", "queue_timeout": "1m",
+			"tenants": {"web": {"public_addr": ":81", "passphrase": "q", "queue_timeout": "5s"}}}`, nil,
+			map[string]tenantConfig{
+				"": withDefaults(func(t *tenantConfig) {
+					t.PublicAddr, t.Passphrase, t.QueueTimeout = []string{":80"}, "p", config.Duration(time.Minute)
+				}),
+				"web": withDefaults(func(t *tenantConfig) {
+					t.PublicAddr, t.Passphrase, t.QueueTimeout = []string{":81"}, "q", config.Duration(5*time.Second)
+				}),
+			}},
+		{"passphrase_from in a tenant", `{"passphrase": "p", "tenants": {"web": {"public_addr": ":80", "passphrase_from": "env:WEB"}}}`, nil,
+			map[string]tenantConfig{
+				"web": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.PassphraseFrom = []string{":80"}, "env:WEB" }),
+			}},
+		{"passphrase in a tenant", `{"passphrase_from": "env:TOP", "tenants": {"web": {"public_addr": ":80", "passphrase": "q"}}}`, nil,
+			map[string]tenantConfig{
+				"web": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.Passphrase = []string{":80"}, "q" }),
+			}},
+		{"passphrase_from inherited", `{"passphrase_from": "env:TOP", "tenants": {"web": {"public_addr": ":80"}}}`, nil,
+			map[string]tenantConfig{
+				"web": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.PassphraseFrom = []string{":80"}, "env:TOP" }),
+			}},
+		{"flags at top level", `{"passphrase": "p", "tenants": {"a": {"public_addr": ":80"}, "b": {"public_addr": ":81", "queue_fallback": "close"}}}`,
+			[]string{"-queue-fallback", "rst", "-passphrase", "s"},
+			map[string]tenantConfig{
+				"a": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.Passphrase, t.QueueFallback = []string{":80"}, "s", "rst" }),
+				"b": withDefaults(func(t *tenantConfig) { t.PublicAddr, t.Passphrase, t.QueueFallback = []string{":81"}, "s", "close" }),
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultRelayConfig()
+			fs := flag.NewFlagSet("popub-relay", flag.ContinueOnError)
+			flags := config.BindFlags(fs, &cfg)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "popub-relay.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			positions, errs := config.Load(path, &cfg, flags)
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			got := cfg.resolveTenants(positions)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
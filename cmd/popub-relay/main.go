@@ -18,225 +18,271 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"bytes"
-	"crypto/cipher"
-	"crypto/ecdh"
-	"crypto/rand"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub"
 	"github.com/m13253/popub/internal/common"
-	"github.com/m13253/popub/internal/proxy_v2"
-	"golang.org/x/crypto/chacha20poly1305"
+	"github.com/m13253/popub/internal/config"
+	"github.com/m13253/popub/internal/control"
+	"github.com/m13253/popub/internal/systemd"
 )
 
 func main() {
-	if len(os.Args) != 4 {
-		fmt.Printf("Usage: %s relay_addr public_addr passphrase\n\n", os.Args[0])
-		return
-	}
-	relayAddr, publicAddr, passphrase := os.Args[1], os.Args[2], os.Args[3]
-	authKey := common.PassphraseToPSK(passphrase)
-
-	publicConnChan := make(chan *net.TCPConn)
-	go listenRelay(publicConnChan, relayAddr, authKey)
-	listenPublic(publicConnChan, publicAddr)
-}
-
-func listenRelay(publicConnChan chan *net.TCPConn, relayAddr string, authKey []byte) {
-	relayListener, err := net.Listen("tcp", relayAddr)
+	cfg, loader := loadConfig()
+	err := cfg.Apply()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	relayTCPListener := relayListener.(*net.TCPListener)
 
-	d := backoff.New()
-	for {
-		relayConn, err := relayTCPListener.AcceptTCP()
-		if !d.ProcessError(err) {
-			go authConn(relayConn, publicConnChan, authKey)
-		}
-	}
-}
-
-func listenPublic(publicConnChan chan<- *net.TCPConn, publicAddr string) {
-	publicListener, err := net.Listen("tcp", publicAddr)
+	relay, err := popub.NewRelay(popub.RelayConfig{Tenants: cfg.relayTenants(), Logger: log.Default()})
 	if err != nil {
 		log.Fatalln(err)
 	}
-	publicTCPListener := publicListener.(*net.TCPListener)
 
-	d := backoff.New()
-	for {
-		publicConn, err := publicTCPListener.AcceptTCP()
-		if !d.ProcessError(err) {
-			publicConnChan <- publicConn
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &server{
+		ctx:       ctx,
+		relay:     relay,
+		loader:    loader,
+		cfg:       cfg,
+		listeners: make(map[string]*publicListener),
+	}
+	for key, name := range cfg.publicAddrs() {
+		l, err := openPublic(key)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		s.serve(key, name, l)
 	}
-}
 
-func authConn(relayConn *net.TCPConn, publicConnChan chan *net.TCPConn, authKey []byte) {
-	_ = relayConn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
-	pubkey, nonce, err := common.ReadX25519(relayConn, authKey, &[chacha20poly1305.NonceSizeX]byte{})
-	if err != nil {
-		log.Printf("authorization failure from %s: %v", relayConn.RemoteAddr(), err)
-		relayConn.Close()
-		return
+	if cfg.ControlSocket != "" {
+		controlListener, err := control.Listen(cfg.ControlSocket)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go control.Serve(ctx, controlListener, s.handleCommand)
 	}
+	go s.reloadOnSignal()
 
-	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	relayListener, err := listenRelay(cfg.RelayAddr)
 	if err != nil {
-		log.Println(err)
-		relayConn.Close()
-		return
+		log.Fatalln(err)
 	}
-
-	psk, err := privkey.ECDH(pubkey)
+	_ = systemd.Notify("READY=1")
+	go systemd.Run(ctx, s.status)
+	err = relay.Serve(ctx, relayListener, nil)
 	if err != nil {
-		log.Println(err)
-		relayConn.Close()
-		return
-	}
-	if len(psk) != chacha20poly1305.KeySize {
-		panic("ECDH returned incorrect key size")
+		log.Fatalln(err)
 	}
 
-	aead, err := chacha20poly1305.NewX(psk)
-	if err != nil {
-		log.Println(err)
-		relayConn.Close()
-		return
-	}
+	// A second signal terminates immediately.
+	stop()
+	_ = systemd.Notify("STOPPING=1")
+	log.Printf("shutting down, waiting up to %.1f seconds for connections in progress", time.Duration(cfg.DrainTimeout).Seconds())
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	_ = relay.Shutdown(drainCtx)
+}
 
-	nonceRecv := common.InitNonce(false)
-	nonceSend := common.InitNonce(true)
+// server keeps the public listeners in line with the configuration, which
+// may be reloaded.
+type server struct {
+	ctx    context.Context
+	relay  *popub.Relay
+	loader *configLoader
 
-	_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-	_, err = common.WriteX25519(relayConn, privkey.PublicKey(), authKey, &nonce)
-	if err != nil {
-		log.Println(err)
-		relayConn.Close()
-		return
+	mu        sync.Mutex
+	cfg       *relayConfig
+	listeners map[string]*publicListener
+}
+
+// publicListener is a public address served for a tenant. It is keyed by
+// "tcp " or "udp " followed by the address.
+type publicListener struct {
+	tenant string
+	opened openedListener
+	cancel context.CancelFunc
+}
+
+// openedListener is either a TCP or Unix socket listener, or a UDP socket.
+type openedListener struct {
+	listener net.Listener
+	udpConn  *net.UDPConn
+}
+
+func openPublic(key string) (openedListener, error) {
+	network, addr, _ := strings.Cut(key, " ")
+	if network == "udp" {
+		conn, err := listenUDP(addr)
+		return openedListener{udpConn: conn}, err
 	}
+	listener, err := common.Listen(addr)
+	return openedListener{listener: listener}, err
+}
 
-	var buf [common.MaxRecvBufferSize]byte
-	for {
-		_ = relayConn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
-		packet, err := common.ReadPacket(relayConn, aead, &nonceRecv, buf[:])
-		if err != nil {
-			log.Println(err)
-			relayConn.Close()
-			return
-		}
+func (l openedListener) Close() {
+	if l.listener != nil {
+		_ = l.listener.Close()
+	}
+	if l.udpConn != nil {
+		_ = l.udpConn.Close()
+	}
+}
 
-		if bytes.HasPrefix(packet, []byte{0}) {
-			break
+// serve starts serving an opened listener for the named tenant. The caller
+// must hold s.mu, or be the only goroutine using s.
+func (s *server) serve(key, name string, l openedListener) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.listeners[key] = &publicListener{tenant: name, opened: l, cancel: cancel}
+	go func() {
+		var err error
+		if l.udpConn != nil {
+			err = s.relay.ServePublicUDP(ctx, name, l.udpConn)
+		} else {
+			err = s.relay.ServePublic(ctx, name, l.listener)
 		}
-	}
-	_ = relayConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}()
+}
 
-	log.Println("authorized:", relayConn.LocalAddr(), "←", relayConn.RemoteAddr())
+// status summarizes the relay for systemctl status.
+func (s *server) status() string {
+	stats := s.relay.Stats()
+	return fmt.Sprintf("%d links, %d pending, %d active connections, %d accepted in total", stats.Links, stats.Pending, stats.Active, stats.Accepted)
+}
 
-	recvChan := make(chan []byte, 1)
+func (s *server) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		_ = s.reload()
+	}
+}
 
-	go relayLoopRecv(relayConn, recvChan, aead, &nonceRecv)
-	go relayLoopSend(relayConn, publicConnChan, recvChan, aead, &nonceSend, &nonceRecv)
+func (s *server) handleCommand(command string) error {
+	switch command {
+	case "reload":
+		return s.reload()
+	default:
+		return fmt.Errorf("unknown command: %q", command)
+	}
 }
 
-func relayLoopSend(relayConn *net.TCPConn, publicConnChan chan *net.TCPConn, recvChan <-chan []byte, aead cipher.AEAD, nonceSend, nonceRecv *[chacha20poly1305.NonceSizeX]byte) {
-	var publicConn *net.TCPConn
-	pingBalance := 0
-	pingTicker := time.NewTicker(common.PingInterval)
-
-	var buf [common.MaxPacketSize]byte
-	for {
-		select {
-		case publicConn = <-publicConnChan:
-			pingTicker.Stop()
-
-			log.Println("accept:", publicConn.LocalAddr(), "←", publicConn.RemoteAddr())
-			proxyHeader := proxy_v2.EncodeProxyV2Header(publicConn)
-
-			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-			err := common.WritePacket(relayConn, proxyHeader[:], aead, nonceSend, buf[:])
-			if err != nil {
-				log.Println(err)
-				relayConn.Close()
-				publicConnChan <- publicConn
-				return
-			}
-			_ = relayConn.SetWriteDeadline(time.Time{})
-			goto accepted
-
-		case packet, ok := <-recvChan:
-			if !ok {
-				pingTicker.Stop()
-				return
-			} else if bytes.HasPrefix(packet, []byte{0}) && pingBalance > 0 {
-				pingBalance -= 1
-			}
+// reload reads the configuration again and applies it. Nothing is changed if
+// the new configuration is invalid, or a new public address cannot be opened.
+func (s *server) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Println("reloading configuration")
+	_ = systemd.Notify(systemd.Reloading()...)
+	defer systemd.Notify("READY=1")
+	cfg, errs := s.loader.load()
+	if len(errs) != 0 {
+		log.Printf("reload rejected:\n%v", errs)
+		return errs
+	}
+	for _, change := range config.Changes(&s.cfg.Common, &cfg.Common, "") {
+		log.Printf("%s (ignored until restart)", change)
+	}
+	if cfg.RelayAddr != s.cfg.RelayAddr {
+		log.Printf("relay_addr: %s → %s (ignored until restart)", s.cfg.RelayAddr, cfg.RelayAddr)
+	}
 
-		case <-pingTicker.C:
-			if pingBalance > 1 {
-				log.Println("connection timed out")
-				pingTicker.Stop()
-				relayConn.Close()
-				return
+	// Addresses moved to another tenant are only opened after being closed.
+	addrs := cfg.publicAddrs()
+	opened := make(map[string]openedListener)
+	var moved []string
+	for _, key := range slices.Sorted(maps.Keys(addrs)) {
+		if l, ok := s.listeners[key]; ok {
+			if l.tenant != addrs[key] {
+				moved = append(moved, key)
 			}
-			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
-			err := common.WritePacket(relayConn, (&[256 - common.PacketOverhead]byte{})[:], aead, nonceSend, buf[:])
-			if err != nil {
-				log.Println(err)
-				pingTicker.Stop()
-				relayConn.Close()
-				return
+			continue
+		}
+		l, err := openPublic(key)
+		if err != nil {
+			for _, l := range opened {
+				l.Close()
 			}
-			pingBalance += 1
+			log.Println("reload rejected:", err)
+			return err
 		}
+		opened[key] = l
 	}
 
-accepted:
-	for {
-		select {
-		case packet, ok := <-recvChan:
-			if !ok {
-				publicConnChan <- publicConn
-				return
-			} else if bytes.HasPrefix(packet, []byte{0xd}) {
-				go common.ForwardClearToEncrypted(publicConn, relayConn, aead, nonceSend)
-				go common.ForwardEncryptedToClear(relayConn, publicConn, aead, nonceRecv)
-				return
-			}
-
-		case <-time.After(common.NetworkTimeout):
-			log.Println("connection timed out")
-			relayConn.Close()
-			publicConnChan <- publicConn
-			return
+	err := s.relay.Reload(popub.RelayConfig{Tenants: cfg.relayTenants()})
+	if err != nil {
+		for _, l := range opened {
+			l.Close()
 		}
+		log.Println("reload rejected:", err)
+		return err
 	}
-}
-
-func relayLoopRecv(relayConn *net.TCPConn, recvChan chan<- []byte, aead cipher.AEAD, nonceRecv *[chacha20poly1305.NonceSizeX]byte) {
-	var buf [common.MaxRecvBufferSize]byte
-	for {
-		packet, err := common.ReadPacket(relayConn, aead, nonceRecv, buf[:])
+	for _, key := range slices.Sorted(maps.Keys(s.listeners)) {
+		if name, ok := addrs[key]; !ok || name != s.listeners[key].tenant {
+			// Close synchronously, so that moved addresses can be opened
+			// again.
+			s.listeners[key].cancel()
+			s.listeners[key].opened.Close()
+			delete(s.listeners, key)
+			log.Println("closed", key)
+		}
+	}
+	var errOpen error
+	for _, key := range moved {
+		l, err := openPublic(key)
 		if err != nil {
 			log.Println(err)
-			relayConn.Close()
-			break
+			errOpen = errors.Join(errOpen, err)
+			continue
 		}
+		opened[key] = l
+	}
+	for _, key := range slices.Sorted(maps.Keys(opened)) {
+		s.serve(key, addrs[key], opened[key])
+		log.Printf("opened %s for %s", key, tenantDisplayName(addrs[key]))
+	}
 
-		packet = bytes.Clone(packet) // Allow reusing buf
-		recvChan <- packet
+	s.cfg = cfg
+	log.Println("configuration reloaded")
+	return errOpen
+}
 
-		if !bytes.HasPrefix(packet, []byte{0}) {
-			break
-		}
+// listenRelay listens on a TCP address, or the socket passed by systemd with
+// the "systemd:" prefix.
+func listenRelay(addr string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemd.Listener(name)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUDP listens on a UDP address, or the socket passed by systemd with the
+// "systemd:" prefix.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemd.UDPConn(name)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
 	}
-	close(recvChan)
+	return net.ListenUDP("udp", udpAddr)
 }
@@ -0,0 +1,159 @@
+/*
+Popub -- A port forwarding program
+Copyright (C) 2016 Star Brilliant <m13253@hotmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/config"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "keygen":
+		keygen(os.Args[2:])
+	case "pubkey":
+		pubkey(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Printf("Usage: %s keygen [options]\n       %s pubkey source\n\nRun \"%s keygen -h\" for the options.\n", os.Args[0], os.Args[0], os.Args[0])
+}
+
+// keygen prints a random key, passphrase parameters with a random salt, or an
+// identity key.
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "", "write to this new `file`, readable only by the owner, instead of standard output")
+	params := flags.Bool("params", false, "generate passphrase_params with a random salt, instead of a key")
+	identity := flags.Bool("identity", false, "generate an identity key for popub-local, instead of a key, and print its public key for authorized_keys of popub-relay")
+	time := flags.Uint("time", 3, "Argon2 time cost, used with -params")
+	memory := flags.Uint("memory", 64*1024, "Argon2 memory cost in KiB, used with -params")
+	threads := flags.Uint("threads", 4, "Argon2 parallelism, used with -params")
+	flags.Usage = func() {
+		fmt.Printf("Usage: %s keygen [options]\n\n", os.Args[0])
+		fmt.Println("Generates a random key, to be used instead of the passphrase of both popub-local")
+		fmt.Println("and popub-relay, or with -params, the passphrase_params shared by both.")
+		fmt.Println("With -identity, generates the identity key of popub-local. Its public key is")
+		fmt.Println("printed to standard output with -out, or to standard error otherwise.")
+		fmt.Println("\nOptions:")
+		flags.PrintDefaults()
+		fmt.Println()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *params && *identity {
+		fmt.Fprintln(os.Stderr, "-params cannot be used with -identity")
+		os.Exit(2)
+	}
+
+	var s, public string
+	if *identity {
+		s, public = common.GenerateIdentity()
+	} else if *params {
+		if *time > 1<<32-1 || *memory > 1<<32-1 || *threads > 255 {
+			fmt.Fprintln(os.Stderr, "Argon2 parameters out of range")
+			os.Exit(1)
+		}
+		p := common.NewKDFParams(uint32(*time), uint32(*memory), uint8(*threads))
+		s = p.String()
+		// Catch parameters Argon2 does not accept.
+		_, err := common.ParseKDFParams(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		s = common.GenerateKey()
+	}
+
+	if *out == "" {
+		fmt.Println(s)
+		if public != "" {
+			fmt.Fprintln(os.Stderr, "public key:", public)
+		}
+		return
+	}
+	err := writeNew(*out, s+"\n")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if public != "" {
+		fmt.Println(public)
+	}
+}
+
+// pubkey prints the public key of an identity key, read from a source such as
+// file:path, in the same form as passphrase_from.
+func pubkey(args []string) {
+	if len(args) != 1 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fmt.Printf("Usage: %s pubkey source\n\n", os.Args[0])
+		fmt.Println("Prints the public key of the identity key of popub-local, read from the source:")
+		fmt.Println("file:path, env:NAME, credential:NAME, or stdin.")
+		os.Exit(2)
+	}
+	s, err := config.ReadSecret(args[0])
+	if err == nil {
+		var privkey *ecdh.PrivateKey
+		privkey, err = common.ParseIdentity(s)
+		if err == nil {
+			fmt.Println(common.FormatPublicKey(privkey.PublicKey()))
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// writeNew writes to a new file, which only the owner can read.
+func writeNew(path, s string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(s)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
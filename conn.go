@@ -0,0 +1,131 @@
+package popub
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/mux"
+)
+
+// tunnelConn is a connection handed off on a relay link in classic mode.
+// Data is encrypted in the same way as between popub-local and popub-relay.
+type tunnelConn struct {
+	link       *relayLink
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readMu  sync.Mutex
+	readBuf [common.MaxRecvBufferSize]byte
+	pending []byte
+
+	writeMu  sync.Mutex
+	writeBuf [common.MaxPacketSize]byte
+}
+
+func newTunnelConn(link *relayLink, publicAddr, remoteAddr net.Addr) *tunnelConn {
+	return &tunnelConn{
+		link:       link,
+		localAddr:  publicAddr,
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		packet, err := common.ReadPacket(c.link.conn, c.link.recv, c.readBuf[:])
+		if err != nil {
+			return 0, err
+		}
+		c.pending = packet
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) != 0 {
+		n := min(len(p), common.MaxBodySize)
+		err := common.WritePacket(c.link.conn, p[:n], c.link.send, c.writeBuf[:])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the client that no more data will be sent, if the relay
+// link supports half-close.
+func (c *tunnelConn) CloseWrite() error {
+	return common.CloseWrite(c.link.conn)
+}
+
+func (c *tunnelConn) CloseRead() error {
+	return common.CloseRead(c.link.conn)
+}
+
+func (c *tunnelConn) Close() error {
+	return c.link.conn.Close()
+}
+
+// LocalAddr returns the public address which the client connected to.
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the address of the client.
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	return c.link.conn.SetDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	return c.link.conn.SetReadDeadline(t)
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.link.conn.SetWriteDeadline(t)
+}
+
+// streamConn is a connection handed off as a stream in multiplexed mode.
+// Streams do not support deadlines.
+type streamConn struct {
+	*mux.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return os.ErrNoDeadline
+}
@@ -1,30 +1,48 @@
 package backoff
 
 import (
+	"context"
 	"log"
 	"math"
 	"time"
 )
 
+// MaxDelay may be changed by the configuration before any retry happens.
+var MaxDelay = 3 * time.Minute
+
 type Retryer struct {
 	retryCount uint64
+	logger     *log.Logger
+	ctx        context.Context
 }
 
 func New() *Retryer {
+	return NewWithLogger(log.Default())
+}
+
+func NewWithLogger(logger *log.Logger) *Retryer {
+	return NewWithContext(context.Background(), logger)
+}
+
+// NewWithContext returns a Retryer whose delays end early when ctx is done.
+func NewWithContext(ctx context.Context, logger *log.Logger) *Retryer {
 	return &Retryer{
 		retryCount: 0,
+		logger:     logger,
+		ctx:        ctx,
 	}
 }
 
 func (d *Retryer) getDuration() time.Duration {
-	if d.retryCount >= 12 {
-		return 3 * time.Minute
+	// Avoid overflowing time.Duration
+	if d.retryCount >= 40 {
+		return MaxDelay
 	}
-	return time.Duration(
+	return min(time.Duration(
 		math.RoundToEven(
-			math.Pow(1.618033988749895, float64(d.retryCount-1)) * float64(time.Second),
+			math.Pow(1.618033988749895, float64(d.retryCount-1))*float64(time.Second),
 		),
-	)
+	), MaxDelay)
 }
 
 func (d *Retryer) reset() {
@@ -34,18 +52,23 @@ func (d *Retryer) reset() {
 func (d *Retryer) sleep() {
 	if d.retryCount == 0 {
 		d.retryCount++
-		log.Printf("retry #1 after 0.0 seconds")
+		d.logger.Printf("retry #1 after 0.0 seconds")
 	} else {
 		dur := d.getDuration()
 		d.retryCount++
-		log.Printf("retry #%d after %.1f seconds", d.retryCount, float64(dur)*1e-9)
-		time.Sleep(dur)
+		d.logger.Printf("retry #%d after %.1f seconds", d.retryCount, float64(dur)*1e-9)
+		timer := time.NewTimer(dur)
+		select {
+		case <-timer.C:
+		case <-d.ctx.Done():
+			timer.Stop()
+		}
 	}
 }
 
 func (d *Retryer) ProcessError(err error) bool {
 	if err != nil {
-		log.Println(err)
+		d.logger.Println(err)
 		d.sleep()
 		return true
 	}
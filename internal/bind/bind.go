@@ -0,0 +1,154 @@
+// Package bind implements the packets with which popub-local asks popub-relay
+// to open a public port on demand.
+package bind
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+const (
+	// PacketBind is sent by L before the first ping to request a public
+	// port, and by R to reply to it.
+	PacketBind = 0x62
+
+	TokenSize = 16
+
+	statusOK    = 0
+	statusError = 1
+
+	packetSize = 256 - common.PacketOverhead
+)
+
+// Token identifies the popub-local tunnel which requests a port, so that all
+// relay links of the same tunnel share the port.
+type Token [TokenSize]byte
+
+// Range is an inclusive range of port numbers. The zero Range means any port
+// permitted by the relay.
+type Range struct {
+	Min uint16
+	Max uint16
+}
+
+// ParseRange parses "any", a single port such as "8080", or a range such as
+// "20000-20999".
+func ParseRange(s string) (Range, error) {
+	if s == "any" {
+		return Range{}, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil || lo == 0 {
+		return Range{}, fmt.Errorf("invalid port range: %q", s)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.ParseUint(last, 10, 16)
+		if err != nil || hi < lo {
+			return Range{}, fmt.Errorf("invalid port range: %q", s)
+		}
+	}
+	return Range{Min: uint16(lo), Max: uint16(hi)}, nil
+}
+
+func (r Range) IsAny() bool {
+	return r.Min == 0
+}
+
+func (r Range) Contains(port uint16) bool {
+	return r.Min <= port && port <= r.Max
+}
+
+func (r Range) String() string {
+	switch {
+	case r.IsAny():
+		return "any"
+	case r.Min == r.Max:
+		return strconv.Itoa(int(r.Min))
+	default:
+		return fmt.Sprintf("%d-%d", r.Min, r.Max)
+	}
+}
+
+func EncodeRequest(token Token, r Range) [packetSize]byte {
+	var buf [packetSize]byte
+	buf[0] = PacketBind
+	copy(buf[1:], token[:])
+	binary.BigEndian.PutUint16(buf[1+TokenSize:], r.Min)
+	binary.BigEndian.PutUint16(buf[3+TokenSize:], r.Max)
+	return buf
+}
+
+func DecodeRequest(packet []byte) (token Token, r Range, err error) {
+	if len(packet) < 5+TokenSize || packet[0] != PacketBind {
+		err = errors.New("invalid bind request")
+		return
+	}
+	copy(token[:], packet[1:])
+	r.Min = binary.BigEndian.Uint16(packet[1+TokenSize:])
+	r.Max = binary.BigEndian.Uint16(packet[3+TokenSize:])
+	if r.Max < r.Min {
+		err = errors.New("invalid bind request")
+	}
+	return
+}
+
+// EncodeReply encodes the public address assigned to the tunnel, or the
+// reason why the request is refused if bindErr is not nil.
+func EncodeReply(addr string, bindErr error) [packetSize]byte {
+	var buf [packetSize]byte
+	buf[0] = PacketBind
+	text := addr
+	if bindErr != nil {
+		buf[1] = statusError
+		text = bindErr.Error()
+	}
+	text = text[:min(len(text), packetSize-4)]
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(text)))
+	copy(buf[4:], text)
+	return buf
+}
+
+// DecodeReply returns the public address, or an error containing the reason
+// why the relay refused the request.
+func DecodeReply(packet []byte) (addr string, err error) {
+	if len(packet) < 4 || packet[0] != PacketBind {
+		return "", errors.New("invalid bind reply")
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if 4+length > len(packet) {
+		return "", errors.New("invalid bind reply")
+	}
+	text := string(packet[4 : 4+length])
+	if packet[1] != statusOK {
+		return "", fmt.Errorf("relay refused to bind: %s", text)
+	}
+	return text, nil
+}
+
+// Request asks the relay to open a public port on an authorized connection,
+// and returns the public address assigned to the tunnel.
+func Request(conn net.Conn, token Token, r Range, send, recv *common.CipherState) (string, error) {
+	var buf [common.MaxRecvBufferSize]byte
+	request := EncodeRequest(token, r)
+	_ = conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	err := common.WritePacket(conn, request[:], send, buf[:])
+	if err != nil {
+		return "", err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
+	packet, err := common.ReadPacket(conn, recv, buf[:])
+	if err != nil {
+		return "", err
+	}
+	return DecodeReply(packet)
+}
@@ -0,0 +1,190 @@
+package bind
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Range
+		ok   bool
+	}{
+		{"any", Range{}, true},
+		{"8080", Range{8080, 8080}, true},
+		{"20000-20999", Range{20000, 20999}, true},
+		{"1-65535", Range{1, 65535}, true},
+		{"0", Range{}, false},
+		{"65536", Range{}, false},
+		{"20999-20000", Range{}, false},
+		{"20000-", Range{}, false},
+		{"-20000", Range{}, false},
+		{"1-2-3", Range{}, false},
+		{"", Range{}, false},
+		{"http", Range{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRange(%q) = %v, %v, want %v, ok=%v", tt.s, got, err, tt.want, tt.ok)
+		}
+		if tt.ok && got.String() != tt.s {
+			t.Errorf("%v.String() = %q, want %q", got, got.String(), tt.s)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	token := Token{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		name string
+		r    Range
+	}{
+		{"any", Range{}},
+		{"single", Range{8080, 8080}},
+		{"range", Range{20000, 20999}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := EncodeRequest(token, tt.r)
+			if len(packet) != 256-common.PacketOverhead {
+				t.Errorf("request size = %d", len(packet))
+			}
+			gotToken, gotRange, err := DecodeRequest(packet[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotToken != token || gotRange != tt.r {
+				t.Errorf("got %x %v, want %x %v", gotToken, gotRange, token, tt.r)
+			}
+		})
+	}
+}
+
+func TestDecodeRequestInvalid(t *testing.T) {
+	valid := EncodeRequest(Token{}, Range{20000, 20999})
+	reversed := EncodeRequest(Token{}, Range{20999, 20000})
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"type only", valid[:1]},
+		{"truncated token", valid[:1+TokenSize-1]},
+		{"truncated range", valid[:1+TokenSize+3]},
+		{"wrong type", append([]byte{0}, valid[1:]...)},
+		{"reversed range", reversed[:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := DecodeRequest(tt.packet); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+	if _, _, err := DecodeRequest(valid[:1+TokenSize+4]); err != nil {
+		t.Errorf("request without padding: %v", err)
+	}
+}
+
+func TestReply(t *testing.T) {
+	long := strings.Repeat("a", 1000)
+	tests := []struct {
+		name    string
+		addr    string
+		err     error
+		want    string
+		wantErr string
+	}{
+		{"address", "192.0.2.1:20000", nil, "192.0.2.1:20000", ""},
+		{"IPv6 address", "[2001:db8::1]:20000", nil, "[2001:db8::1]:20000", ""},
+		{"error", "", errors.New("no free port in 20000-20999"), "", "relay refused to bind: no free port in 20000-20999"},
+		{"empty error", "", errors.New(""), "", "relay refused to bind: "},
+		{"oversized error", "", errors.New(long), "", "relay refused to bind: " + long[:256-common.PacketOverhead-4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := EncodeReply(tt.addr, tt.err)
+			if len(packet) != 256-common.PacketOverhead {
+				t.Errorf("reply size = %d", len(packet))
+			}
+			got, err := DecodeReply(packet[:])
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got %q, %v, want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReplyInvalid(t *testing.T) {
+	valid := EncodeReply("192.0.2.1:20000", nil)
+	tooLong := valid
+	tooLong[2], tooLong[3] = 0xff, 0xff
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"truncated", valid[:3]},
+		{"truncated text", valid[:4+len("192.0.2.1:20000")-1]},
+		{"wrong type", append([]byte{0}, valid[1:]...)},
+		{"length beyond packet", tooLong[:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr, err := DecodeReply(tt.packet); err == nil {
+				t.Errorf("got %q, want an error", addr)
+			}
+		})
+	}
+}
+
+func TestRequestOverConn(t *testing.T) {
+	key := make([]byte, 32)
+	localSend, localRecv, err := common.NewCipherStates(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relaySend, relayRecv, err := common.NewCipherStates(key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localConn, relayConn := net.Pipe()
+	defer localConn.Close()
+	defer relayConn.Close()
+
+	token := Token{42}
+	go func() {
+		var buf [common.MaxRecvBufferSize]byte
+		packet, err := common.ReadPacket(relayConn, relayRecv, buf[:])
+		if err != nil {
+			relayConn.Close()
+			return
+		}
+		gotToken, r, err := DecodeRequest(packet)
+		if err == nil && (gotToken != token || r != (Range{8080, 8080})) {
+			err = errors.New("unexpected request")
+		}
+		reply := EncodeReply("192.0.2.1:8080", err)
+		_ = common.WritePacket(relayConn, reply[:], relaySend, buf[:])
+	}()
+
+	addr, err := Request(localConn, token, Range{8080, 8080}, localSend, localRecv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "192.0.2.1:8080" {
+		t.Errorf("got %q, want %q", addr, "192.0.2.1:8080")
+	}
+}
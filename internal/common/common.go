@@ -1,36 +1,42 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
 
-const (
+// These may be changed by the configuration before any connection is made.
+var (
 	PingInterval           = 60 * time.Second
 	NetworkTimeout         = 60 * time.Second
 	ExtendedNetworkTimeout = 90 * time.Second
+	// A session key is replaced once it has sealed RekeyBytes bytes, or
+	// after RekeyInterval, unless they are zero.
+	RekeyBytes    int64 = 1 << 30
+	RekeyInterval       = time.Hour
+)
 
+const (
 	PacketOverhead    = 2 + chacha20poly1305.Overhead + chacha20poly1305.Overhead
 	MaxPacketSize     = 16384
 	MaxBodySize       = MaxPacketSize - PacketOverhead
 	MaxRecvBufferSize = MaxBodySize + chacha20poly1305.Overhead
 )
 
-func PassphraseToPSK(passphrase string) []byte {
-	return argon2.IDKey([]byte(passphrase), []byte("popub"), 1, 64*1024, 4, chacha20poly1305.KeySize)
-}
-
 func InitNonce(isRelayToLocalDirection bool) (nonce [chacha20poly1305.NonceSizeX]byte) {
 	if isRelayToLocalDirection {
 		nonce[chacha20poly1305.NonceSizeX-1] = 1
@@ -67,23 +73,38 @@ func IncreaseNonce(nonce *[chacha20poly1305.NonceSizeX]byte) {
 }
 
 func ReadX25519(r io.Reader, auth_key []byte, last_nonce *[chacha20poly1305.NonceSizeX]byte) (pubkey *ecdh.PublicKey, new_nonce [chacha20poly1305.NonceSizeX]byte, err error) {
-	aead, err := chacha20poly1305.NewX(auth_key)
-	if err != nil {
-		return
-	}
+	_, pubkey, new_nonce, err = ReadX25519Any(r, [][]byte{auth_key}, last_nonce)
+	return
+}
 
+// ReadX25519Any is like ReadX25519, but tries each key in auth_keys, and
+// returns the index of the first one that opens the message.
+func ReadX25519Any(r io.Reader, auth_keys [][]byte, last_nonce *[chacha20poly1305.NonceSizeX]byte) (index int, pubkey *ecdh.PublicKey, new_nonce [chacha20poly1305.NonceSizeX]byte, err error) {
 	var buf [chacha20poly1305.NonceSizeX + curve25519.PointSize + chacha20poly1305.Overhead + 184 + chacha20poly1305.NonceSizeX]byte
 	_, err = io.ReadFull(r, buf[:chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead+184])
 	if err != nil {
 		return
 	}
 	copy(buf[chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead+184:], last_nonce[:])
-	pubkeyBuf, err := aead.Open(
-		buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX],
-		buf[:chacha20poly1305.NonceSizeX],
-		buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead],
-		buf[chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead:],
-	)
+
+	var pubkeyBuf []byte
+	for index = range auth_keys {
+		var aead cipher.AEAD
+		aead, err = chacha20poly1305.NewX(auth_keys[index])
+		if err != nil {
+			return
+		}
+		var tmp [curve25519.PointSize]byte
+		pubkeyBuf, err = aead.Open(
+			tmp[:0],
+			buf[:chacha20poly1305.NonceSizeX],
+			buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead],
+			buf[chacha20poly1305.NonceSizeX+curve25519.PointSize+chacha20poly1305.Overhead:],
+		)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return
 	}
@@ -127,7 +148,178 @@ func WriteX25519(w io.Writer, pubkey *ecdh.PublicKey, auth_key []byte, last_nonc
 	return
 }
 
-func ReadPacket(r io.Reader, aead cipher.AEAD, nonce *[chacha20poly1305.NonceSizeX]byte, tmp []byte) ([]byte, error) {
+// ClientKeys are the optional keys of ClientHandshake.
+type ClientKeys struct {
+	// CheckRelay, if not nil, asks the relay for its relay key, and checks it
+	// once the relay proves that it owns it.
+	CheckRelay func(*ecdh.PublicKey) error
+	// Identity, if not nil, is sent to the relay.
+	Identity *ecdh.PrivateKey
+	// SignSSH, if not nil, signs the session for the relay. It is not used
+	// along with Identity.
+	SignSSH SSHSignFunc
+}
+
+// ClientHandshake authorizes conn to the relay with the key derived from the
+// passphrase, and returns both directions of the relay link. The relay key
+// and the identity in keys are mixed into the session key.
+func ClientHandshake(conn net.Conn, authKey []byte, keys ClientKeys) (send, recv *CipherState, err error) {
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+	nonce, err := WriteX25519(conn, privkey.PublicKey(), authKey, &[chacha20poly1305.NonceSizeX]byte{})
+	if err != nil {
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(NetworkTimeout))
+	pubkey, _, err := ReadX25519(conn, authKey, &nonce)
+	if err != nil {
+		err = fmt.Errorf("authorization failure: %v", err)
+		return
+	}
+
+	psk, err := privkey.ECDH(pubkey)
+	if err != nil {
+		return
+	}
+	if len(psk) != chacha20poly1305.KeySize {
+		panic("ECDH returned incorrect key size")
+	}
+
+	send, recv, err = NewCipherStates(psk, false)
+	if err != nil {
+		return
+	}
+
+	var buf [MaxPacketSize]byte
+	if keys.CheckRelay != nil {
+		var packet [256 - PacketOverhead]byte
+		packet[0] = PacketRelayKey
+		_ = conn.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+		err = WritePacket(conn, packet[:], send, buf[:])
+		if err != nil {
+			return
+		}
+		var relayKey *ecdh.PublicKey
+		relayKey, psk, err = readRelayKey(conn, privkey, psk, send, recv, buf[:])
+		if err != nil {
+			err = fmt.Errorf("relay key: %v", err)
+			return
+		}
+		err = keys.CheckRelay(relayKey)
+		if err != nil {
+			return
+		}
+	}
+
+	if keys.Identity != nil {
+		var packet [256 - PacketOverhead]byte
+		packet[0] = PacketIdentity
+		copy(packet[1:], keys.Identity.PublicKey().Bytes())
+		_ = conn.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+		err = WritePacket(conn, packet[:], send, buf[:])
+		if err != nil {
+			return
+		}
+		var identityDH []byte
+		identityDH, err = keys.Identity.ECDH(pubkey)
+		if err != nil {
+			return
+		}
+		var key []byte
+		key, err = MixIdentity(psk, identityDH)
+		if err != nil {
+			return
+		}
+		err = SetKeys(key, send, recv)
+		if err != nil {
+			return
+		}
+		// The relay acknowledges an identity it accepts with the mixed key,
+		// and closes the connection otherwise.
+		_ = conn.SetReadDeadline(time.Now().Add(NetworkTimeout))
+		var reply []byte
+		reply, err = ReadPacket(conn, recv, buf[:])
+		if err == nil && !bytes.HasPrefix(reply, []byte{PacketIdentity}) {
+			err = errors.New("unexpected packet")
+		}
+		if err != nil {
+			err = fmt.Errorf("identity refused by the relay: %v", err)
+		}
+	} else if keys.SignSSH != nil {
+		var packet []byte
+		packet, err = EncodeSSHPacket(keys.SignSSH, psk)
+		if err != nil {
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+		err = WritePacket(conn, packet, send, buf[:])
+		if err != nil {
+			return
+		}
+		// The relay acknowledges an SSH key it accepts, and closes the
+		// connection otherwise.
+		_ = conn.SetReadDeadline(time.Now().Add(NetworkTimeout))
+		var reply []byte
+		reply, err = ReadPacket(conn, recv, buf[:])
+		if err == nil && !bytes.HasPrefix(reply, []byte{PacketSSH}) {
+			err = errors.New("unexpected packet")
+		}
+		if err != nil {
+			err = fmt.Errorf("SSH key refused by the relay: %v", err)
+		}
+	}
+	return
+}
+
+// readRelayKey reads the relay key, then its proof, which is a packet sealed
+// with the key mixed with it. The mixed key is returned, and set on send and
+// recv.
+func readRelayKey(conn net.Conn, privkey *ecdh.PrivateKey, ephkey []byte, send, recv *CipherState, buf []byte) (*ecdh.PublicKey, []byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(NetworkTimeout))
+	reply, err := ReadPacket(conn, recv, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(reply) < 1+curve25519.PointSize || reply[0] != PacketRelayKey {
+		return nil, nil, errors.New("unexpected packet")
+	}
+	if bytes.Equal(reply[1:1+curve25519.PointSize], make([]byte, curve25519.PointSize)) {
+		return nil, nil, errors.New("not configured on the relay")
+	}
+	relayKey, err := ecdh.X25519().NewPublicKey(reply[1 : 1+curve25519.PointSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	relayDH, err := privkey.ECDH(relayKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephkey, err = MixRelayKey(ephkey, relayDH)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = SetKeys(ephkey, send, recv)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := ReadPacket(conn, recv, buf)
+	if err == nil && !bytes.HasPrefix(proof, []byte{PacketRelayKey}) {
+		err = errors.New("unexpected packet")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("proof failed for %s: %v", FormatPublicKey(relayKey), err)
+	}
+	return relayKey, ephkey, nil
+}
+
+// ReadPacket reads and opens a packet. When the packet is the last one sealed
+// with the key of c, the next key is used from then on.
+func ReadPacket(r io.Reader, c *CipherState, tmp []byte) ([]byte, error) {
 	_ = tmp[MaxRecvBufferSize-1]
 
 	// Read the packet length
@@ -135,12 +327,14 @@ func ReadPacket(r io.Reader, aead cipher.AEAD, nonce *[chacha20poly1305.NonceSiz
 	if err != nil {
 		return nil, err
 	}
-	packetLenBuf, err := aead.Open(tmp[:0], nonce[:], tmp[:2+chacha20poly1305.Overhead], nil)
-	IncreaseNonce(nonce)
+	packetLenBuf, err := c.aead.Open(tmp[:0], c.nonce[:], tmp[:2+chacha20poly1305.Overhead], nil)
+	IncreaseNonce(&c.nonce)
 	if err != nil {
 		return nil, err
 	}
 	packetLen := int(binary.BigEndian.Uint16(packetLenBuf))
+	rekey := packetLen&rekeyFlag != 0
+	packetLen &^= rekeyFlag
 	if packetLen > MaxBodySize {
 		return nil, fmt.Errorf("packet size too big: %d", packetLen)
 	}
@@ -150,16 +344,27 @@ func ReadPacket(r io.Reader, aead cipher.AEAD, nonce *[chacha20poly1305.NonceSiz
 	if err != nil {
 		return nil, err
 	}
-	bodyBuf, err := aead.Open(tmp[:0], nonce[:], tmp[:packetLen+chacha20poly1305.Overhead], nil)
-	IncreaseNonce(nonce)
+	bodyBuf, err := c.aead.Open(tmp[:0], c.nonce[:], tmp[:packetLen+chacha20poly1305.Overhead], nil)
+	IncreaseNonce(&c.nonce)
 	if err != nil {
 		return nil, err
 	}
 
+	if rekey {
+		// The peer rekeys, so it understands rekeyed packets.
+		c.peerRekeys.Store(true)
+		err = c.ratchet()
+		if err != nil {
+			return nil, err
+		}
+	}
 	return bodyBuf, nil
 }
 
-func WritePacket(w io.Writer, packet []byte, aead cipher.AEAD, nonce *[chacha20poly1305.NonceSizeX]byte, tmp []byte) error {
+// WritePacket seals and sends a packet. Once the key of c is due to be
+// replaced, the packet is marked as the last one sealed with it, and the next
+// key is used from then on.
+func WritePacket(w io.Writer, packet []byte, c *CipherState, tmp []byte) error {
 	packetLen := len(packet)
 	if packetLen > MaxBodySize {
 		panic(fmt.Errorf("packet size too big: %d", len(packet)))
@@ -167,24 +372,39 @@ func WritePacket(w io.Writer, packet []byte, aead cipher.AEAD, nonce *[chacha20p
 
 	_ = tmp[packetLen+PacketOverhead-1]
 
-	binary.BigEndian.PutUint16(tmp[:2], uint16(packetLen))
-	packetLenBuf := aead.Seal(tmp[:0], nonce[:], tmp[:2], nil)
-	IncreaseNonce(nonce)
+	rekey := c.rekeyDue()
+	if rekey {
+		binary.BigEndian.PutUint16(tmp[:2], uint16(packetLen|rekeyFlag))
+	} else {
+		binary.BigEndian.PutUint16(tmp[:2], uint16(packetLen))
+	}
+	packetLenBuf := c.aead.Seal(tmp[:0], c.nonce[:], tmp[:2], nil)
+	IncreaseNonce(&c.nonce)
 	if len(packetLenBuf) != 2+chacha20poly1305.Overhead {
 		panic("aead.Seal did not return the correct buffer length")
 	}
 
-	bodyBuf := aead.Seal(tmp[2+chacha20poly1305.Overhead:2+chacha20poly1305.Overhead], nonce[:], packet, nil)
-	IncreaseNonce(nonce)
+	bodyBuf := c.aead.Seal(tmp[2+chacha20poly1305.Overhead:2+chacha20poly1305.Overhead], c.nonce[:], packet, nil)
+	IncreaseNonce(&c.nonce)
 	if len(bodyBuf) != packetLen+chacha20poly1305.Overhead {
 		panic("aead.Seal did not return the correct buffer length")
 	}
+	c.sealed += int64(packetLen)
 
+	if rekey {
+		err := c.ratchet()
+		if err != nil {
+			return err
+		}
+	}
 	_, err := w.Write(tmp[:packetLen+PacketOverhead])
 	return err
 }
 
-func ForwardClearToEncrypted(clearConn, cryptConn *net.TCPConn, aead cipher.AEAD, nonceSend *[chacha20poly1305.NonceSizeX]byte) {
+// ForwardClearToEncrypted reads from clearConn and sends the data as packets
+// on cryptConn until clearConn reaches EOF, which is passed on as a half-close.
+// See CloseWrite for connections which do not support half-close.
+func ForwardClearToEncrypted(clearConn, cryptConn net.Conn, send *CipherState) {
 	var plainBuf [MaxBodySize]byte
 	var cipherBuf [MaxPacketSize]byte
 
@@ -192,10 +412,10 @@ func ForwardClearToEncrypted(clearConn, cryptConn *net.TCPConn, aead cipher.AEAD
 		n, err := clearConn.Read(plainBuf[:])
 		if err != nil {
 			if err == io.EOF {
-				_ = cryptConn.CloseWrite()
-				_ = clearConn.CloseRead()
+				_ = CloseWrite(cryptConn)
+				_ = CloseRead(clearConn)
 			} else {
-				log.Println(err)
+				logForwardError(err)
 				_ = cryptConn.Close()
 				_ = clearConn.Close()
 			}
@@ -205,9 +425,9 @@ func ForwardClearToEncrypted(clearConn, cryptConn *net.TCPConn, aead cipher.AEAD
 		if n == 0 {
 			continue
 		}
-		err = WritePacket(cryptConn, plainBuf[:n], aead, nonceSend, cipherBuf[:])
+		err = WritePacket(cryptConn, plainBuf[:n], send, cipherBuf[:])
 		if err != nil {
-			log.Println(err)
+			logForwardError(err)
 			_ = clearConn.Close()
 			_ = cryptConn.Close()
 			break
@@ -215,17 +435,20 @@ func ForwardClearToEncrypted(clearConn, cryptConn *net.TCPConn, aead cipher.AEAD
 	}
 }
 
-func ForwardEncryptedToClear(cryptConn, clearConn *net.TCPConn, aead cipher.AEAD, nonceRecv *[chacha20poly1305.NonceSizeX]byte) {
+// ForwardEncryptedToClear receives packets from cryptConn and writes them to
+// clearConn until cryptConn reaches EOF, which is passed on as a half-close.
+// See CloseWrite for connections which do not support half-close.
+func ForwardEncryptedToClear(cryptConn, clearConn net.Conn, recv *CipherState) {
 	var cipherBuf [MaxPacketSize]byte
 
 	for {
-		packet, err := ReadPacket(cryptConn, aead, nonceRecv, cipherBuf[:])
+		packet, err := ReadPacket(cryptConn, recv, cipherBuf[:])
 		if err != nil {
 			if err == io.EOF {
-				_ = clearConn.CloseWrite()
-				_ = cryptConn.CloseRead()
+				_ = CloseWrite(clearConn)
+				_ = CloseRead(cryptConn)
 			} else {
-				log.Println(err)
+				logForwardError(err)
 				_ = clearConn.Close()
 				_ = cryptConn.Close()
 			}
@@ -237,10 +460,40 @@ func ForwardEncryptedToClear(cryptConn, clearConn *net.TCPConn, aead cipher.AEAD
 		}
 		_, err = clearConn.Write(packet)
 		if err != nil {
-			log.Println(err)
+			logForwardError(err)
 			_ = cryptConn.Close()
 			_ = clearConn.Close()
 			break
 		}
 	}
 }
+
+// Forward copies data between clearConn and cryptConn in both directions,
+// and closes both once both directions are finished, or when ctx is done.
+func Forward(ctx context.Context, clearConn, cryptConn net.Conn, send, recv *CipherState) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = clearConn.Close()
+		_ = cryptConn.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ForwardClearToEncrypted(clearConn, cryptConn, send)
+	}()
+	ForwardEncryptedToClear(cryptConn, clearConn, recv)
+	wg.Wait()
+	_ = clearConn.Close()
+	_ = cryptConn.Close()
+}
+
+// logForwardError logs an error, unless it is caused by the other direction
+// having closed the connection already.
+func logForwardError(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	log.Println(err)
+}
@@ -0,0 +1,343 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeRelay answers ClientHandshake like popub-relay, for a single tenant.
+type fakeRelay struct {
+	authKey []byte
+	// relayKey is nil if the relay has none. claimedKey, if not nil, is
+	// sent instead of the public key of relayKey.
+	relayKey   *ecdh.PrivateKey
+	claimedKey *ecdh.PublicKey
+	// identities and sshKeys are the accepted keys.
+	identities [][]byte
+	sshKeys    []ssh.PublicKey
+}
+
+// serve runs the handshake, then echoes the packets after the mode packet,
+// whose rekey feature is honored.
+func (r *fakeRelay) serve(conn net.Conn) error {
+	defer conn.Close()
+	_, pubkey, nonce, err := ReadX25519Any(conn, [][]byte{r.authKey}, &[chacha20poly1305.NonceSizeX]byte{})
+	if err != nil {
+		return err
+	}
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := WriteX25519(conn, privkey.PublicKey(), r.authKey, &nonce); err != nil {
+		return err
+	}
+	psk, err := privkey.ECDH(pubkey)
+	if err != nil {
+		return err
+	}
+	send, recv, err := NewCipherStates(psk, true)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	for {
+		packet, err := ReadPacket(conn, recv, buf)
+		if err != nil {
+			return err
+		}
+		switch packet[0] {
+		case PacketRelayKey:
+			reply := [256 - PacketOverhead]byte{PacketRelayKey}
+			if r.relayKey != nil {
+				copy(reply[1:], r.relayKey.PublicKey().Bytes())
+			}
+			if r.claimedKey != nil {
+				copy(reply[1:], r.claimedKey.Bytes())
+			}
+			if err := WritePacket(conn, reply[:], send, buf); err != nil || r.relayKey == nil {
+				return err
+			}
+			relayDH, err := r.relayKey.ECDH(pubkey)
+			if err != nil {
+				return err
+			}
+			if psk, err = MixRelayKey(psk, relayDH); err != nil {
+				return err
+			}
+			if err := SetKeys(psk, send, recv); err != nil {
+				return err
+			}
+			if err := WritePacket(conn, reply[:1], send, buf); err != nil {
+				return err
+			}
+		case PacketIdentity:
+			identityDH, err := privkey.ECDH(mustPublicKey(packet[1:33]))
+			if err != nil {
+				return err
+			}
+			key, err := MixIdentity(psk, identityDH)
+			if err != nil {
+				return err
+			}
+			if err := SetKeys(key, send, recv); err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(r.identities, func(k []byte) bool { return bytes.Equal(k, packet[1:33]) }) {
+				return errors.New("unknown identity")
+			}
+			if err := WritePacket(conn, []byte{PacketIdentity}, send, buf); err != nil {
+				return err
+			}
+		case PacketSSH:
+			sshKey, err := DecodeSSHPacket(packet, psk)
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(r.sshKeys, func(k ssh.PublicKey) bool { return bytes.Equal(k.Marshal(), sshKey.Marshal()) }) {
+				return errors.New("unknown SSH key")
+			}
+			if err := WritePacket(conn, []byte{PacketSSH}, send, buf); err != nil {
+				return err
+			}
+		default:
+			if len(packet) > 1 && packet[1]&FeatureRekey != 0 {
+				send.EnableRekey()
+			}
+			for {
+				packet, err := ReadPacket(conn, recv, buf)
+				if err != nil {
+					return nil
+				}
+				if err := WritePacket(conn, bytes.Clone(packet), send, make([]byte, MaxPacketSize)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func mustPublicKey(b []byte) *ecdh.PublicKey {
+	pubkey, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		panic(err)
+	}
+	return pubkey
+}
+
+func newSSHSigner(t *testing.T) (SSHSignFunc, ssh.PublicKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(data []byte) (ssh.PublicKey, *ssh.Signature, error) {
+		sig, err := signSSH(signer, data)
+		return signer.PublicKey(), sig, err
+	}, signer.PublicKey()
+}
+
+func TestClientHandshake(t *testing.T) {
+	authKey := bytes.Repeat([]byte{1}, chacha20poly1305.KeySize)
+	otherKey := bytes.Repeat([]byte{2}, chacha20poly1305.KeySize)
+	relayKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRelayKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIdentity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signSSH, sshKey := newSSHSigner(t)
+	signOtherSSH, _ := newSSHSigner(t)
+	pin := func(want *ecdh.PublicKey) func(*ecdh.PublicKey) error {
+		return func(got *ecdh.PublicKey) error {
+			if !got.Equal(want) {
+				return errors.New("relay key mismatch")
+			}
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		relay   fakeRelay
+		authKey []byte
+		keys    ClientKeys
+		wantErr string
+	}{
+		{
+			name:  "passphrase",
+			relay: fakeRelay{authKey: authKey},
+		},
+		{
+			name:    "wrong passphrase",
+			relay:   fakeRelay{authKey: authKey},
+			authKey: otherKey,
+			wantErr: "authorization failure",
+		},
+		{
+			name:  "relay key",
+			relay: fakeRelay{authKey: authKey, relayKey: relayKey},
+			keys:  ClientKeys{CheckRelay: pin(relayKey.PublicKey())},
+		},
+		{
+			name:    "relay key not configured",
+			relay:   fakeRelay{authKey: authKey},
+			keys:    ClientKeys{CheckRelay: pin(relayKey.PublicKey())},
+			wantErr: "not configured on the relay",
+		},
+		{
+			name:    "wrong relay key",
+			relay:   fakeRelay{authKey: authKey, relayKey: otherRelayKey},
+			keys:    ClientKeys{CheckRelay: pin(relayKey.PublicKey())},
+			wantErr: "relay key mismatch",
+		},
+		{
+			name:    "relay key not owned by the relay",
+			relay:   fakeRelay{authKey: authKey, relayKey: otherRelayKey, claimedKey: relayKey.PublicKey()},
+			keys:    ClientKeys{CheckRelay: pin(relayKey.PublicKey())},
+			wantErr: "proof failed",
+		},
+		{
+			name:  "identity",
+			relay: fakeRelay{authKey: authKey, identities: [][]byte{identity.PublicKey().Bytes()}},
+			keys:  ClientKeys{Identity: identity},
+		},
+		{
+			name:    "rejected identity",
+			relay:   fakeRelay{authKey: authKey, identities: [][]byte{identity.PublicKey().Bytes()}},
+			keys:    ClientKeys{Identity: otherIdentity},
+			wantErr: "identity refused by the relay",
+		},
+		{
+			name:  "relay key and identity",
+			relay: fakeRelay{authKey: authKey, relayKey: relayKey, identities: [][]byte{identity.PublicKey().Bytes()}},
+			keys:  ClientKeys{CheckRelay: pin(relayKey.PublicKey()), Identity: identity},
+		},
+		{
+			name:  "SSH key",
+			relay: fakeRelay{authKey: authKey, sshKeys: []ssh.PublicKey{sshKey}},
+			keys:  ClientKeys{SignSSH: signSSH},
+		},
+		{
+			name:    "rejected SSH key",
+			relay:   fakeRelay{authKey: authKey, sshKeys: []ssh.PublicKey{sshKey}},
+			keys:    ClientKeys{SignSSH: signOtherSSH},
+			wantErr: "SSH key refused by the relay",
+		},
+		{
+			name:  "relay key and SSH key",
+			relay: fakeRelay{authKey: authKey, relayKey: relayKey, sshKeys: []ssh.PublicKey{sshKey}},
+			keys:  ClientKeys{CheckRelay: pin(relayKey.PublicKey()), SignSSH: signSSH},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localConn, relayConn := net.Pipe()
+			defer localConn.Close()
+			go tt.relay.serve(relayConn)
+
+			authKey := tt.authKey
+			if authKey == nil {
+				authKey = tt.relay.authKey
+			}
+			_ = localConn.SetDeadline(time.Now().Add(5 * time.Second))
+			send, recv, err := ClientHandshake(localConn, authKey, tt.keys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Both ends use the same keys after the handshake.
+			buf := make([]byte, MaxPacketSize)
+			for _, packet := range [][]byte{{0}, []byte("echo")} {
+				if err := WritePacket(localConn, packet, send, buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			echo, err := ReadPacket(localConn, recv, buf)
+			if err != nil || string(echo) != "echo" {
+				t.Errorf("got %q, %v, want %q", echo, err, "echo")
+			}
+		})
+	}
+}
+
+func TestHandshakeRekey(t *testing.T) {
+	setRekeyLimits(t, 1500, 0)
+	authKey := bytes.Repeat([]byte{1}, chacha20poly1305.KeySize)
+	tests := []struct {
+		name     string
+		features byte
+		rekeyed  bool
+	}{
+		{"rekey", FeatureRekey, true},
+		{"peer without rekey", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localConn, relayConn := net.Pipe()
+			defer localConn.Close()
+			relay := fakeRelay{authKey: authKey}
+			go relay.serve(relayConn)
+
+			_ = localConn.SetDeadline(time.Now().Add(5 * time.Second))
+			send, recv, err := ClientHandshake(localConn, authKey, ClientKeys{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sendKey, recvKey := bytes.Clone(send.key), bytes.Clone(recv.key)
+
+			buf := make([]byte, MaxPacketSize)
+			if err := WritePacket(localConn, []byte{0, tt.features}, send, buf); err != nil {
+				t.Fatal(err)
+			}
+			packet := make([]byte, 1000)
+			for i := range 4 {
+				packet[0] = byte(i)
+				if err := WritePacket(localConn, packet, send, buf); err != nil {
+					t.Fatal(err)
+				}
+				echo, err := ReadPacket(localConn, recv, buf)
+				if err != nil || !bytes.Equal(echo, packet) {
+					t.Fatalf("packet %d: got %d bytes, %v", i, len(echo), err)
+				}
+			}
+			if rekeyed := !bytes.Equal(recv.key, recvKey); rekeyed != tt.rekeyed {
+				t.Errorf("relay rekeyed: %v, want %v", rekeyed, tt.rekeyed)
+			}
+			if rekeyed := !bytes.Equal(send.key, sendKey); rekeyed != tt.rekeyed {
+				t.Errorf("local rekeyed: %v, want %v", rekeyed, tt.rekeyed)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// IdentityPrefix starts the private identity key of popub-local,
+	// generated by popub keygen -identity.
+	IdentityPrefix = "popub-identity:"
+	// PublicKeyPrefix starts the public key of an identity, listed in the
+	// authorized keys of the relay.
+	PublicKeyPrefix = "popub-pub:"
+
+	// PacketIdentity is sent by popub-local right after the handshake, with
+	// the public key of its identity.
+	PacketIdentity = 0x69
+	// PacketRelayKey is sent by popub-local right after the handshake, to
+	// ask for the public key of the relay.
+	PacketRelayKey = 0x72
+)
+
+// GenerateIdentity returns a new private identity key and its public key.
+func GenerateIdentity() (identity, publicKey string) {
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return IdentityPrefix + base64.RawURLEncoding.EncodeToString(privkey.Bytes()), FormatPublicKey(privkey.PublicKey())
+}
+
+// ParseIdentity parses a private identity key returned by GenerateIdentity.
+func ParseIdentity(s string) (*ecdh.PrivateKey, error) {
+	encoded, ok := strings.CutPrefix(s, IdentityPrefix)
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if !ok || err != nil {
+		return nil, errors.New("invalid identity: expected the output of popub keygen -identity")
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// ParsePublicKey parses a public key returned by FormatPublicKey.
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(s, PublicKeyPrefix)
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if !ok || err != nil {
+		return nil, errors.New("invalid public key: expected " + PublicKeyPrefix + " followed by base64url")
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// FormatPublicKey returns the public key, starting with PublicKeyPrefix.
+func FormatPublicKey(pubkey *ecdh.PublicKey) string {
+	return PublicKeyPrefix + base64.RawURLEncoding.EncodeToString(pubkey.Bytes())
+}
+
+// MixIdentity returns the key used after popub-local sends its identity. It is
+// derived from ephkey, and from identityDH, the X25519 of the identity key of
+// L and the ephemeral key of R, so that only the owner of the identity can use
+// it, while keeping forward secrecy.
+func MixIdentity(ephkey, identityDH []byte) ([]byte, error) {
+	return mixKey(ephkey, identityDH, "popub identity")
+}
+
+// MixRelayKey returns the key used after the relay sends its public key. It is
+// the same as MixIdentity, with relayDH, the X25519 of the ephemeral key of L
+// and the relay key.
+func MixRelayKey(ephkey, relayDH []byte) ([]byte, error) {
+	return mixKey(ephkey, relayDH, "popub relay key")
+}
+
+func mixKey(ephkey, dh []byte, info string) ([]byte, error) {
+	return hkdf.Key(sha256.New, append(append([]byte(nil), ephkey...), dh...), nil, info, chacha20poly1305.KeySize)
+}
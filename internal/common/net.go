@@ -0,0 +1,73 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/m13253/popub/internal/systemd"
+)
+
+// CloseWrite tells the peer that no more data will be sent, if conn supports
+// half-close, such as *net.TCPConn, *net.UnixConn and *tls.Conn. Otherwise,
+// conn is closed entirely, since that is the only way to signal the end of
+// data, and any data still arriving from the peer is lost.
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// CloseRead stops receiving on conn, if it supports half-close. Otherwise, it
+// does nothing, and the connection is left for the other direction to close.
+func CloseRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+// SplitNetwork splits an address such as "unix:/run/app.sock" into the
+// network and the address. Names starting with "@" are in the abstract
+// namespace. Addresses without the "unix:" prefix are TCP addresses.
+func SplitNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// Dial connects to a TCP address, or a Unix socket with the "unix:" prefix.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	network, address := SplitNetwork(addr)
+	return net.DialTimeout(network, address, timeout)
+}
+
+// Listen listens on a TCP address, or a Unix socket with the "unix:" prefix.
+// A stale Unix socket left by a previous process is removed first. With the
+// "systemd:" prefix, it uses the socket of that name passed by systemd.
+func Listen(addr string) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(addr, "systemd:"); ok {
+		return systemd.Listener(name)
+	}
+	network, address := SplitNetwork(addr)
+	listener, err := net.Listen(network, address)
+	if network != "unix" || !errors.Is(err, syscall.EADDRINUSE) || strings.HasPrefix(address, "@") {
+		return listener, err
+	}
+
+	conn, dialErr := net.DialTimeout(network, address, NetworkTimeout)
+	if dialErr == nil {
+		conn.Close()
+		return nil, err
+	}
+	if info, statErr := os.Lstat(address); statErr != nil || info.Mode().Type() != os.ModeSocket {
+		return nil, err
+	}
+	_ = os.Remove(address)
+	return net.Listen(network, address)
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyPrefix starts a random key generated by popub keygen, which is used as
+// the pre-shared key directly, instead of being derived from a passphrase.
+const KeyPrefix = "popub-key:"
+
+// KDFParams are the Argon2id parameters deriving the pre-shared key from a
+// passphrase.
+type KDFParams struct {
+	Time uint32
+	// Memory is in KiB.
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+}
+
+// Limits of KDFParams, so that a typo cannot make the key take hours or
+// exhaust the memory. RFC 9106 recommends at most 2 GiB.
+const (
+	MaxKDFTime   = 32
+	MaxKDFMemory = 4 * 1024 * 1024
+)
+
+// LegacyKDFParams are used when no parameters are configured, so that
+// existing deployments keep working. The salt is the same everywhere.
+var LegacyKDFParams = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4, Salt: []byte("popub")}
+
+// NewKDFParams returns parameters with a random salt.
+func NewKDFParams(time, memory uint32, threads uint8) KDFParams {
+	p := KDFParams{Time: time, Memory: memory, Threads: threads, Salt: make([]byte, 16)}
+	_, _ = rand.Read(p.Salt)
+	return p
+}
+
+// ParseKDFParams parses parameters in the form returned by String, such as
+// "argon2id:t=3,m=65536,p=4:SALT", where SALT is in unpadded base64url.
+func ParseKDFParams(s string) (KDFParams, error) {
+	invalid := fmt.Errorf("invalid passphrase parameters: %q (expected argon2id:t=TIME,m=MEMORY,p=THREADS:SALT)", s)
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != "argon2id" {
+		return KDFParams{}, invalid
+	}
+	var p KDFParams
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(parts[1], ",") {
+		key, value, _ := strings.Cut(field, "=")
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || seen[key] {
+			return KDFParams{}, invalid
+		}
+		seen[key] = true
+		switch key {
+		case "t":
+			p.Time = uint32(n)
+		case "m":
+			p.Memory = uint32(n)
+		case "p":
+			if n > 255 {
+				return KDFParams{}, invalid
+			}
+			p.Threads = uint8(n)
+		default:
+			return KDFParams{}, invalid
+		}
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(seen) != 3 {
+		return KDFParams{}, invalid
+	}
+	p.Salt = salt
+	return p, p.check()
+}
+
+func (p KDFParams) check() error {
+	switch {
+	case p.Time < 1:
+		return errors.New("invalid passphrase parameters: t must be at least 1")
+	case p.Time > MaxKDFTime:
+		return fmt.Errorf("invalid passphrase parameters: t must be at most %d", MaxKDFTime)
+	case p.Memory > MaxKDFMemory:
+		return fmt.Errorf("invalid passphrase parameters: m must be at most %d", MaxKDFMemory)
+	case p.Threads < 1:
+		return errors.New("invalid passphrase parameters: p must be at least 1")
+	case p.Memory < 8*uint32(p.Threads):
+		return errors.New("invalid passphrase parameters: m must be at least 8 times p")
+	case len(p.Salt) < 8:
+		return errors.New("invalid passphrase parameters: salt must be at least 8 bytes")
+	}
+	return nil
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("argon2id:t=%d,m=%d,p=%d:%s", p.Time, p.Memory, p.Threads, base64.RawURLEncoding.EncodeToString(p.Salt))
+}
+
+// GenerateKey returns a random key, starting with KeyPrefix.
+func GenerateKey() string {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, _ = rand.Read(key)
+	return KeyPrefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// CheckPassphrase reports the errors PassphraseToPSK would return, without
+// running Argon2.
+func CheckPassphrase(passphrase, params string) error {
+	_, _, err := parsePassphrase(passphrase, params)
+	return err
+}
+
+// PassphraseToPSK derives the pre-shared key from a passphrase, using params
+// parsed by ParseKDFParams, or LegacyKDFParams if params is empty. A key
+// generated by GenerateKey is used directly, without params.
+func PassphraseToPSK(passphrase, params string) ([]byte, error) {
+	key, p, err := parsePassphrase(passphrase, params)
+	if err != nil || key != nil {
+		return key, err
+	}
+	return argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize), nil
+}
+
+func parsePassphrase(passphrase, params string) (key []byte, p KDFParams, err error) {
+	if encoded, ok := strings.CutPrefix(passphrase, KeyPrefix); ok {
+		key, err = base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil || len(key) != chacha20poly1305.KeySize {
+			return nil, p, errors.New("invalid key: expected the output of popub keygen")
+		}
+		if params != "" {
+			return nil, p, errors.New("passphrase parameters cannot be used with a key")
+		}
+		return key, p, nil
+	}
+	if params == "" {
+		return nil, LegacyKDFParams, nil
+	}
+	p, err = ParseKDFParams(params)
+	return nil, p, err
+}
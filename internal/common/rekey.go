@@ -0,0 +1,95 @@
+package common
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// FeatureRekey is set in the second byte of the mode packet by popub-local,
+// which tells the relay that it understands rekeyed packets.
+const FeatureRekey = 0x01
+
+// rekeyFlag is set in the length of the last packet sealed with a key. Both
+// ends switch that direction to the next key after it.
+const rekeyFlag = 0x8000
+
+// CipherState is one direction of a relay link: its key, which is replaced
+// from time to time by the next one in a ratchet, and its nonce.
+type CipherState struct {
+	key   []byte
+	aead  cipher.AEAD
+	nonce [chacha20poly1305.NonceSizeX]byte
+
+	// peerRekeys is shared by both directions of a relay link, and is set
+	// once the peer is known to understand rekeyed packets.
+	peerRekeys *atomic.Bool
+	// rekeyNow rekeys on the next packet sent.
+	rekeyNow bool
+	// sealed is the number of bytes sent with the key, since keyTime.
+	sealed  int64
+	keyTime time.Time
+}
+
+// NewCipherStates returns both directions of a relay link whose session key
+// is key. isRelay tells which end of the relay link this is.
+func NewCipherStates(key []byte, isRelay bool) (send, recv *CipherState, err error) {
+	peerRekeys := new(atomic.Bool)
+	send = &CipherState{nonce: InitNonce(isRelay), peerRekeys: peerRekeys}
+	recv = &CipherState{nonce: InitNonce(!isRelay), peerRekeys: peerRekeys}
+	err = SetKeys(key, send, recv)
+	return
+}
+
+// SetKeys replaces the key of both directions, when the handshake mixes
+// another key into it.
+func SetKeys(key []byte, send, recv *CipherState) error {
+	for _, c := range []*CipherState{send, recv} {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return err
+		}
+		c.key, c.aead, c.sealed, c.keyTime = bytes.Clone(key), aead, 0, time.Now()
+	}
+	return nil
+}
+
+// EnableRekey is called on the sending direction when the peer tells that it
+// understands rekeyed packets. The first rekey is done on the next packet, so
+// that the peer knows it may rekey as well.
+func (c *CipherState) EnableRekey() {
+	c.peerRekeys.Store(true)
+	c.rekeyNow = true
+}
+
+// rekeyDue tells whether the next packet sent is the last one with the key.
+func (c *CipherState) rekeyDue() bool {
+	if !c.peerRekeys.Load() || RekeyBytes == 0 && RekeyInterval == 0 {
+		return false
+	}
+	return c.rekeyNow ||
+		RekeyBytes != 0 && c.sealed >= RekeyBytes ||
+		RekeyInterval != 0 && time.Since(c.keyTime) >= RekeyInterval
+}
+
+// ratchet replaces the key with the next one. The previous key cannot be
+// recovered from it, so that the packets sealed with it stay secret if the
+// current key leaks.
+func (c *CipherState) ratchet() error {
+	key, err := hkdf.Key(sha256.New, c.key, nil, "popub rekey", chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	clear(c.key)
+	c.key, c.aead, c.sealed, c.keyTime, c.rekeyNow = key, aead, 0, time.Now(), false
+	return nil
+}
@@ -0,0 +1,238 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// setRekeyLimits changes RekeyBytes and RekeyInterval for the duration of a
+// test.
+func setRekeyLimits(t *testing.T, bytes int64, interval time.Duration) {
+	oldBytes, oldInterval := RekeyBytes, RekeyInterval
+	RekeyBytes, RekeyInterval = bytes, interval
+	t.Cleanup(func() {
+		RekeyBytes, RekeyInterval = oldBytes, oldInterval
+	})
+}
+
+// link is both ends of a relay link, whose packets go through a buffer.
+type link struct {
+	localSend, localRecv *CipherState
+	relaySend, relayRecv *CipherState
+}
+
+func newLink(t *testing.T) *link {
+	key := bytes.Repeat([]byte{1}, chacha20poly1305.KeySize)
+	var l link
+	var err error
+	l.localSend, l.localRecv, err = NewCipherStates(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.relaySend, l.relayRecv, err = NewCipherStates(key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &l
+}
+
+// transfer sends a packet of size bytes from send to recv, and returns
+// whether it is flagged as the last one of its key.
+func transfer(t *testing.T, send, recv *CipherState, size int) (flagged bool) {
+	t.Helper()
+	packet := make([]byte, size)
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+	key := bytes.Clone(send.key)
+	var buf bytes.Buffer
+	err := WritePacket(&buf, packet, send, make([]byte, MaxPacketSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagged = sealedLength(t, buf.Bytes(), key, recv.nonce)&rekeyFlag != 0
+	got, err := ReadPacket(&buf, recv, make([]byte, MaxRecvBufferSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, packet) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(packet))
+	}
+	if !bytes.Equal(send.key, recv.key) {
+		t.Fatal("keys differ after the packet")
+	}
+	return
+}
+
+// sealedLength opens the length of a sealed packet.
+func sealedLength(t *testing.T, sealed, key []byte, nonce [chacha20poly1305.NonceSizeX]byte) uint16 {
+	t.Helper()
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := aead.Open(nil, nonce[:], sealed[:2+chacha20poly1305.Overhead], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint16(length)
+}
+
+func TestRekey(t *testing.T) {
+	tests := []struct {
+		name string
+		// enable is set when popub-local sends FeatureRekey, so that the
+		// relay calls EnableRekey.
+		enable   bool
+		bytes    int64
+		interval time.Duration
+		wait     time.Duration
+		// relay and local are the packets flagged as the last of their
+		// key in each direction.
+		relay []int
+		local []int
+	}{
+		{"peer without rekey", false, 2500, 0, 0, nil, nil},
+		{"disabled", true, 0, 0, 0, nil, nil},
+		{"first packet", true, 1 << 30, time.Hour, 0, []int{0}, nil},
+		{"by bytes", true, 2500, 0, 0, []int{0, 4}, []int{3, 7}},
+		{"by interval", true, 0, 50 * time.Millisecond, 60 * time.Millisecond, []int{0, 1, 2, 3, 4, 5, 6, 7}, []int{1, 2, 3, 4, 5, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRekeyLimits(t, tt.bytes, tt.interval)
+			l := newLink(t)
+			if tt.enable {
+				l.relaySend.EnableRekey()
+			}
+
+			// popub-local learns from the first rekey of the relay that
+			// it may rekey as well.
+			var relay, local []int
+			for i := range 8 {
+				if transfer(t, l.relaySend, l.localRecv, 1000) {
+					relay = append(relay, i)
+				}
+				if transfer(t, l.localSend, l.relayRecv, 1000) {
+					local = append(local, i)
+				}
+				time.Sleep(tt.wait)
+			}
+			if fmt.Sprint(relay) != fmt.Sprint(tt.relay) {
+				t.Errorf("relay rekeyed after packets %v, want %v", relay, tt.relay)
+			}
+			if fmt.Sprint(local) != fmt.Sprint(tt.local) {
+				t.Errorf("local rekeyed after packets %v, want %v", local, tt.local)
+			}
+		})
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	setRekeyLimits(t, 1<<30, time.Hour)
+	l := newLink(t)
+	l.relaySend.EnableRekey()
+	oldKey := bytes.Clone(l.relaySend.key)
+	stale := *l.localRecv
+
+	var buf bytes.Buffer
+	tmp := make([]byte, MaxPacketSize)
+	for range 2 {
+		err := WritePacket(&buf, []byte("packet"), l.relaySend, tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Equal(l.relaySend.key, oldKey) {
+		t.Fatal("key not replaced")
+	}
+	sealed := bytes.Clone(buf.Bytes())
+
+	// The next key is the same on both sides, and derived from the
+	// previous one only.
+	for range 2 {
+		if _, err := ReadPacket(&buf, l.localRecv, tmp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := &CipherState{key: bytes.Clone(oldKey)}
+	if err := other.ratchet(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(other.key, l.localRecv.key) {
+		t.Error("next key differs from the ratchet of the previous one")
+	}
+
+	// A peer which does not follow the rekey cannot open the packets
+	// sealed with the next key.
+	stale.peerRekeys = new(atomic.Bool)
+	r := bytes.NewReader(sealed)
+	packet, err := readWithoutRekey(r, &stale, tmp)
+	if err != nil || string(packet) != "packet" {
+		t.Fatalf("first packet: %q, %v", packet, err)
+	}
+	if _, err := readWithoutRekey(r, &stale, tmp); err == nil {
+		t.Error("packet after the rekey opened with the previous key")
+	}
+}
+
+// readWithoutRekey reads a packet like a peer which ignores rekeyFlag.
+func readWithoutRekey(r io.Reader, c *CipherState, tmp []byte) ([]byte, error) {
+	aead := c.aead
+	packet, err := ReadPacket(r, c, tmp)
+	c.aead = aead
+	return packet, err
+}
+
+func TestReadPacketInvalid(t *testing.T) {
+	l := newLink(t)
+	tmp := make([]byte, MaxPacketSize)
+	var valid bytes.Buffer
+	if err := WritePacket(&valid, []byte("packet"), l.relaySend, tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// A length beyond MaxBodySize, sealed properly.
+	oversized := make([]byte, 2+chacha20poly1305.Overhead)
+	aead, err := chacha20poly1305.NewX(l.relaySend.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead.Seal(oversized[:0], l.localRecv.nonce[:], binary.BigEndian.AppendUint16(nil, MaxBodySize+1), nil)
+
+	corrupted := bytes.Clone(valid.Bytes())
+	corrupted[len(corrupted)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"truncated length", valid.Bytes()[:2+chacha20poly1305.Overhead-1]},
+		{"truncated body", valid.Bytes()[:valid.Len()-1]},
+		{"oversized", append(oversized, make([]byte, MaxPacketSize)...)},
+		{"corrupted", corrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv := *l.localRecv
+			packet, err := ReadPacket(bytes.NewReader(tt.input), &recv, tmp)
+			if err == nil {
+				t.Errorf("got %q, want an error", packet)
+			}
+		})
+	}
+	recv := *l.localRecv
+	_, err = ReadPacket(bytes.NewReader(oversized), &recv, tmp)
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("oversized length: %v, want packet size too big", err)
+	}
+}
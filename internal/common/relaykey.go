@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// knownRelaysMu serializes the updates of known relays files, as the tunnels
+// of a process may meet a new relay at the same time.
+var knownRelaysMu sync.Mutex
+
+// RelayKeyChecker returns the function passed to ClientHandshake to check the
+// relay key of relayAddr. It compares the key against relayKey if it is set,
+// or otherwise against the key recorded in the knownRelays file, where a key
+// seen for the first time is recorded and logged to logger. It returns nil if
+// both are empty.
+func RelayKeyChecker(relayKey, knownRelays, relayAddr string, logger *log.Logger) (func(*ecdh.PublicKey) error, error) {
+	if relayKey != "" {
+		expected, err := ParsePublicKey(relayKey)
+		if err != nil {
+			return nil, err
+		}
+		return func(pubkey *ecdh.PublicKey) error {
+			if !pubkey.Equal(expected) {
+				return fmt.Errorf("relay key mismatch: expected %s, got %s", relayKey, FormatPublicKey(pubkey))
+			}
+			return nil
+		}, nil
+	}
+	if knownRelays != "" {
+		_, err := ReadKnownRelays(knownRelays)
+		if err != nil {
+			return nil, err
+		}
+		return func(pubkey *ecdh.PublicKey) error {
+			trusted, err := checkKnownRelay(knownRelays, relayAddr, pubkey)
+			if trusted {
+				logger.Printf("trusting the relay key of %s on first use: %s", relayAddr, FormatPublicKey(pubkey))
+			}
+			return err
+		}, nil
+	}
+	return nil, nil
+}
+
+// ReadKnownRelays reads the relay keys recorded in a known relays file, keyed
+// by relay address. A missing file has no relays.
+//
+// Each line has a relay address and its relay key:
+//
+//	my.server.addr:46687 popub-pub:…
+//
+// Empty lines and lines starting with "#" are skipped.
+func ReadKnownRelays(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	relays := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a relay address and a relay key", path, line)
+		}
+		if _, err := ParsePublicKey(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if _, ok := relays[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is listed twice", path, line, fields[0])
+		}
+		relays[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return relays, nil
+}
+
+// checkKnownRelay compares pubkey against the key of relayAddr in the known
+// relays file. A relay not in the file yet is appended to it, and trusted is
+// true.
+func checkKnownRelay(path, relayAddr string, pubkey *ecdh.PublicKey) (trusted bool, err error) {
+	knownRelaysMu.Lock()
+	defer knownRelaysMu.Unlock()
+
+	relays, err := ReadKnownRelays(path)
+	if err != nil {
+		return false, err
+	}
+	got := FormatPublicKey(pubkey)
+	if expected, ok := relays[relayAddr]; ok {
+		if expected != got {
+			return false, fmt.Errorf("relay key mismatch: expected %s as recorded in %s, got %s; someone else knowing the passphrase may be impersonating the relay, or if the relay key was replaced, remove it from the file", expected, path, got)
+		}
+		return false, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", relayAddr, got)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
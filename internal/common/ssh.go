@@ -0,0 +1,172 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// PacketSSH is sent by popub-local right after the handshake, with an SSH
+// public key and its signature of the session.
+const PacketSSH = 0x73
+
+// SSHSignFunc signs data with an SSH key, and returns its public key.
+type SSHSignFunc func(data []byte) (ssh.PublicKey, *ssh.Signature, error)
+
+// SSHSigner returns a function signing with the private key in keyFile. With
+// agentSocket, it signs with the key of the SSH agent listening there instead,
+// which is the one whose public key is in keyFile, or the first one if keyFile
+// is empty. The agent is connected to on each signature, so that it may be
+// restarted.
+func SSHSigner(keyFile, agentSocket string) (SSHSignFunc, error) {
+	if agentSocket == "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s is protected by a passphrase, add it to ssh-agent and use ssh-agent instead", keyFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		return func(data []byte) (ssh.PublicKey, *ssh.Signature, error) {
+			sig, err := signSSH(signer, data)
+			return signer.PublicKey(), sig, err
+		}, nil
+	}
+
+	var want ssh.PublicKey
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		want, _, _, _, err = ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: expected a public key, such as id_ed25519.pub: %v", keyFile, err)
+		}
+	}
+	return func(data []byte) (ssh.PublicKey, *ssh.Signature, error) {
+		conn, err := net.Dial("unix", agentSocket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ssh-agent: %v", err)
+		}
+		defer conn.Close()
+		signers, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			return nil, nil, fmt.Errorf("ssh-agent: %v", err)
+		}
+		for _, signer := range signers {
+			if want == nil || bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+				sig, err := signSSH(signer, data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("ssh-agent: %v", err)
+				}
+				return signer.PublicKey(), sig, nil
+			}
+		}
+		if want == nil {
+			return nil, nil, errors.New("ssh-agent has no keys")
+		}
+		return nil, nil, fmt.Errorf("ssh-agent does not have the key in %s", keyFile)
+	}, nil
+}
+
+// signSSH signs data, using SHA-256 rather than SHA-1 for RSA keys.
+func signSSH(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// sshSessionData is what an SSH key signs, which is bound to the session, so
+// that the signature cannot be used in another one. It is wrapped like the
+// signatures of ssh-keygen -Y sign, in the "popub" namespace, so that it
+// cannot be mistaken for an SSH login or a signature of another program.
+func sshSessionData(ephkey []byte) ([]byte, error) {
+	data, err := hkdf.Key(sha256.New, ephkey, nil, "popub ssh", 32)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum512(data)
+	return append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{"popub", "", "sha512", hash[:]})...), nil
+}
+
+// EncodeSSHPacket signs the session of ephkey with sign, and returns the SSH
+// packet.
+func EncodeSSHPacket(sign SSHSignFunc, ephkey []byte) ([]byte, error) {
+	data, err := sshSessionData(ephkey)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, sig, err := sign(data)
+	if err != nil {
+		return nil, err
+	}
+	packet := []byte{PacketSSH}
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(pubkey.Marshal())))
+	packet = append(packet, pubkey.Marshal()...)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(ssh.Marshal(sig))))
+	packet = append(packet, ssh.Marshal(sig)...)
+	if len(packet) > MaxBodySize {
+		return nil, errors.New("SSH key too large")
+	}
+	if len(packet) < 256-PacketOverhead {
+		packet = append(packet, make([]byte, 256-PacketOverhead-len(packet))...)
+	}
+	return packet, nil
+}
+
+// DecodeSSHPacket returns the SSH public key in packet, after checking its
+// signature of the session of ephkey.
+func DecodeSSHPacket(packet, ephkey []byte) (ssh.PublicKey, error) {
+	fields := make([][]byte, 2)
+	rest := packet[1:]
+	for i := range fields {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			return nil, errors.New("packet too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		fields[i], rest = rest[2:2+n], rest[2+n:]
+	}
+	pubkey, err := ssh.ParsePublicKey(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	var sig ssh.Signature
+	err = ssh.Unmarshal(fields[1], &sig)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, errors.New("RSA signatures with SHA-1 are not accepted")
+	}
+	data, err := sshSessionData(ephkey)
+	if err != nil {
+		return nil, err
+	}
+	err = pubkey.Verify(data, &sig)
+	if err != nil {
+		return nil, err
+	}
+	return pubkey, nil
+}
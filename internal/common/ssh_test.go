@@ -0,0 +1,168 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDecodeSSHPacket(t *testing.T) {
+	sign, pubkey := newSSHSigner(t)
+	ephkey := bytes.Repeat([]byte{1}, 32)
+	packet, err := EncodeSSHPacket(sign, ephkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != 256-PacketOverhead {
+		t.Errorf("packet size = %d, want %d", len(packet), 256-PacketOverhead)
+	}
+	got, err := DecodeSSHPacket(packet, ephkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Marshal(), pubkey.Marshal()) {
+		t.Error("public key differs")
+	}
+
+	// Fields of the packet, to build invalid ones.
+	keyLen := int(binary.BigEndian.Uint16(packet[1:]))
+	sigOffset := 3 + keyLen
+	sigLen := int(binary.BigEndian.Uint16(packet[sigOffset:]))
+	withByte := func(i int, b byte) []byte {
+		p := bytes.Clone(packet)
+		p[i] = b
+		return p
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		ephkey []byte
+	}{
+		{"other session", packet, bytes.Repeat([]byte{2}, 32)},
+		{"type only", packet[:1], ephkey},
+		{"truncated key length", packet[:2], ephkey},
+		{"truncated key", packet[:3+keyLen-1], ephkey},
+		{"truncated signature length", packet[:sigOffset+1], ephkey},
+		{"truncated signature", packet[:sigOffset+2+sigLen-1], ephkey},
+		{"key length beyond packet", withByte(1, 0xff), ephkey},
+		{"signature length beyond packet", withByte(sigOffset, 0xff), ephkey},
+		{"corrupted key", withByte(3+keyLen-1, packet[3+keyLen-1]^1), ephkey},
+		{"corrupted signature", withByte(sigOffset+2+sigLen-1, packet[sigOffset+2+sigLen-1]^1), ephkey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeSSHPacket(tt.packet, tt.ephkey); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestDecodeSSHPacketRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephkey := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name string
+		sign SSHSignFunc
+		ok   bool
+	}{
+		{"SHA-256", func(data []byte) (ssh.PublicKey, *ssh.Signature, error) {
+			sig, err := signSSH(signer, data)
+			return signer.PublicKey(), sig, err
+		}, true},
+		{"SHA-1", func(data []byte) (ssh.PublicKey, *ssh.Signature, error) {
+			sig, err := signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSA)
+			return signer.PublicKey(), sig, err
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := EncodeSSHPacket(tt.sign, ephkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = DecodeSSHPacket(packet, ephkey)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// TestSSHSig checks that the signed data is that of ssh-keygen -Y sign -n popub.
+func TestSSHSig(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyFile).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, out)
+	}
+
+	// ssh-keygen signs the hash of the session, wrapped in the SSHSIG blob.
+	ephkey := bytes.Repeat([]byte{1}, 32)
+	data, err := sshSessionData(ephkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := hkdf.Key(sha256.New, ephkey, nil, "popub ssh", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgFile := filepath.Join(dir, "session")
+	if err := os.WriteFile(msgFile, session, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-n", "popub", "-f", keyFile, msgFile).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, out)
+	}
+	armored, err := os.ReadFile(msgFile + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(armored)
+	if block == nil || !bytes.HasPrefix(block.Bytes, []byte("SSHSIG")) {
+		t.Fatalf("unexpected signature file: %s", armored)
+	}
+	var envelope struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len("SSHSIG"):], &envelope); err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := ssh.ParsePublicKey(envelope.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(envelope.Signature, &sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := pubkey.Verify(data, &sig); err != nil {
+		t.Errorf("signature of ssh-keygen does not verify: %v", err)
+	}
+}
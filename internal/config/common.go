@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/control"
+)
+
+// Common holds the settings shared by popub-local and popub-relay.
+type Common struct {
+	NetworkTimeout Duration `json:"network_timeout" usage:"maximum duration of handshakes and network writes" arg:"duration"`
+	PingInterval   Duration `json:"ping_interval" usage:"duration between pings sent by the relay" arg:"duration"`
+	PingTimeout    Duration `json:"ping_timeout" usage:"duration without pings after which an idle tunnel is considered dead" arg:"duration"`
+	RekeyBytes     int64    `json:"rekey_bytes" usage:"number of bytes sent on a tunnel after which its key is replaced, or 0 to only rekey after rekey-interval" arg:"number"`
+	RekeyInterval  Duration `json:"rekey_interval" usage:"duration after which the key of a tunnel is replaced, or 0 to only rekey after rekey-bytes" arg:"duration"`
+	RetryMaxDelay  Duration `json:"retry_max_delay" usage:"maximum duration between retries" arg:"duration"`
+	DrainTimeout   Duration `json:"drain_timeout" usage:"maximum duration to wait for connections in progress on SIGINT or SIGTERM" arg:"duration"`
+	LogFile        string   `json:"log_file" usage:"append logs to this file instead of standard error" arg:"file"`
+	ControlSocket  string   `json:"control_socket" usage:"accept commands, such as reload, on this Unix socket" arg:"path"`
+	LogTimestamps  bool     `json:"log_timestamps" usage:"prefix each log line with date and time"`
+}
+
+func DefaultCommon() Common {
+	return Common{
+		NetworkTimeout: Duration(common.NetworkTimeout),
+		PingInterval:   Duration(common.PingInterval),
+		PingTimeout:    Duration(common.ExtendedNetworkTimeout),
+		RekeyBytes:     common.RekeyBytes,
+		RekeyInterval:  Duration(common.RekeyInterval),
+		RetryMaxDelay:  Duration(backoff.MaxDelay),
+		DrainTimeout:   Duration(30 * time.Second),
+		LogTimestamps:  true,
+	}
+}
+
+func (c *Common) Validate(errs *Errors, positions Positions) {
+	errs.Check(c.NetworkTimeout > 0, positions, "network_timeout", "must be positive")
+	errs.Check(c.PingInterval > 0, positions, "ping_interval", "must be positive")
+	errs.Check(c.PingTimeout > c.PingInterval, positions, "ping_timeout", "must be longer than ping_interval")
+	errs.Check(c.RekeyBytes >= 0, positions, "rekey_bytes", "must not be negative")
+	errs.Check(c.RekeyInterval >= 0, positions, "rekey_interval", "must not be negative")
+	errs.Check(c.RetryMaxDelay > 0, positions, "retry_max_delay", "must be positive")
+	errs.Check(c.DrainTimeout >= 0, positions, "drain_timeout", "must not be negative")
+}
+
+// Apply sets up the global timeouts and the logger.
+func (c *Common) Apply() error {
+	common.NetworkTimeout = time.Duration(c.NetworkTimeout)
+	common.PingInterval = time.Duration(c.PingInterval)
+	common.ExtendedNetworkTimeout = time.Duration(c.PingTimeout)
+	common.RekeyBytes = c.RekeyBytes
+	common.RekeyInterval = time.Duration(c.RekeyInterval)
+	backoff.MaxDelay = time.Duration(c.RetryMaxDelay)
+
+	if c.LogTimestamps {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(0)
+	}
+	if c.LogFile != "" {
+		f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+// Load reads the configuration file at path into the struct pointed to by v,
+// then applies the command line flags. If path is empty, only the flags are
+// applied.
+func Load(path string, v any, flags *Flags) (Positions, Errors) {
+	positions := Positions{"": Pos{File: "command line"}}
+	if path != "" {
+		node, err := ParseFile(path)
+		if err != nil {
+			var errs Errors
+			if errors.As(err, &errs) {
+				return positions, errs
+			}
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) {
+				err = pathErr.Err
+			}
+			return positions, Errors{{Pos: Pos{File: path}, Msg: err.Error()}}
+		}
+		errs := Decode(node, v, positions)
+		if len(errs) != 0 {
+			flags.ApplyTo(v, positions)
+			return positions, errs
+		}
+	}
+	flags.ApplyTo(v, positions)
+	return positions, nil
+}
+
+// SendReload asks the running program to reload its configuration through
+// the control socket, and exits.
+func SendReload(controlSocket string) {
+	if controlSocket == "" {
+		fmt.Fprintln(os.Stderr, "control_socket is required for -reload")
+		os.Exit(1)
+	}
+	err := control.Send(controlSocket, "reload")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reload failed:", err)
+		os.Exit(1)
+	}
+	fmt.Println("reloaded")
+	os.Exit(0)
+}
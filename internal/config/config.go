@@ -0,0 +1,411 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a string, such as "30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type Error struct {
+	Pos  Pos
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Pos.File == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, msg)
+}
+
+// Errors collects every problem found in a configuration, so that all of
+// them can be reported at once.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Merge appends the errors in more, except those about keys that already
+// have an error, which are usually consequences of the earlier ones.
+func (errs Errors) Merge(more Errors) Errors {
+	seen := make(map[string]bool)
+	for _, err := range errs {
+		seen[err.Path] = true
+	}
+	for _, err := range more {
+		if err.Path == "" || !seen[err.Path] {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Positions records where each configuration key was set. Keys of nested
+// values are joined with dots, such as "tunnels.web.local_addr".
+type Positions map[string]Pos
+
+// Of returns the position of a key, or the position of the closest parent if
+// the key was not set.
+func (p Positions) Of(path string) Pos {
+	for {
+		if pos, ok := p[path]; ok {
+			return pos
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return p[""]
+		}
+		path = path[:i]
+	}
+}
+
+// Check records an error at the position of path if ok is false.
+func (errs *Errors) Check(ok bool, positions Positions, path, format string, args ...any) {
+	if !ok {
+		*errs = append(*errs, &Error{Pos: positions.Of(path), Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+}
+
+// Warn prints a warning about the setting at path, which does not prevent
+// the program from running.
+func Warn(positions Positions, path, format string, args ...any) {
+	err := &Error{Pos: positions.Of(path), Path: path, Msg: fmt.Sprintf(format, args...)}
+	fmt.Fprintln(os.Stderr, "warning:", err)
+}
+
+// Decode stores the values in node into the struct pointed to by v, using
+// the "json" tags of its fields. Unknown keys and type mismatches are all
+// collected into the returned Errors.
+func Decode(node *Node, v any, positions Positions) Errors {
+	var errs Errors
+	positions[""] = node.Pos
+	decodeValue(node, reflect.ValueOf(v).Elem(), "", positions, &errs)
+	return errs
+}
+
+var durationType = reflect.TypeFor[Duration]()
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func decodeValue(node *Node, v reflect.Value, path string, positions Positions, errs *Errors) {
+	fail := func(expected string) {
+		if node.Lenient {
+			*errs = append(*errs, &Error{Pos: node.Pos, Path: path, Msg: fmt.Sprintf("expected %s, got %q", expected, node.Scalar)})
+		} else {
+			*errs = append(*errs, &Error{Pos: node.Pos, Path: path, Msg: fmt.Sprintf("expected %s, got %s", expected, node.Kind)})
+		}
+	}
+
+	if v.Type() == durationType {
+		if node.Kind != KindString {
+			fail("a duration string such as \"30s\"")
+			return
+		}
+		d, err := time.ParseDuration(node.Scalar)
+		if err != nil {
+			*errs = append(*errs, &Error{Pos: node.Pos, Path: path, Msg: err.Error()})
+			return
+		}
+		v.SetInt(int64(d))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if node.Kind != KindString {
+			fail("a string")
+			return
+		}
+		v.SetString(node.Scalar)
+
+	case reflect.Bool:
+		if node.Kind == KindBool {
+			v.SetBool(node.Bool)
+			return
+		}
+		if node.Kind == KindString && node.Lenient {
+			b, err := parseBool(node.Scalar)
+			if err == nil {
+				v.SetBool(b)
+				return
+			}
+		}
+		fail("a boolean")
+
+	case reflect.Int, reflect.Int64, reflect.Uint16:
+		if node.Kind != KindNumber && !(node.Kind == KindString && node.Lenient) {
+			fail("an integer")
+			return
+		}
+		if v.Kind() == reflect.Uint16 {
+			i, err := strconv.ParseUint(node.Scalar, 10, 16)
+			if err != nil {
+				fail("an integer between 0 and 65535")
+				return
+			}
+			v.SetUint(i)
+			return
+		}
+		i, err := strconv.ParseInt(node.Scalar, 10, 64)
+		if err != nil {
+			fail("an integer")
+			return
+		}
+		v.SetInt(i)
+
+	case reflect.Slice:
+		// A single string is accepted where a list of strings is expected.
+		// Strings from environment files are split by white space instead.
+		if node.Kind == KindString && v.Type().Elem().Kind() == reflect.String {
+			items := []string{node.Scalar}
+			if node.Lenient {
+				items = strings.Fields(node.Scalar)
+			}
+			v.Set(reflect.ValueOf(items).Convert(v.Type()))
+			return
+		}
+		if node.Kind != KindArray {
+			fail("an array")
+			return
+		}
+		slice := reflect.MakeSlice(v.Type(), len(node.Items), len(node.Items))
+		for i, item := range node.Items {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			positions[itemPath] = item.Pos
+			decodeValue(item, slice.Index(i), itemPath, positions, errs)
+		}
+		v.Set(slice)
+
+	case reflect.Map:
+		if node.Kind != KindObject {
+			fail("an object")
+			return
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(node.Keys))
+		for _, key := range node.Keys {
+			keyPath := joinPath(path, key)
+			positions[keyPath] = node.KeyPos[key]
+			elem := reflect.New(v.Type().Elem()).Elem()
+			decodeValue(node.Fields[key], elem, keyPath, positions, errs)
+			m.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+		v.Set(m)
+
+	case reflect.Struct:
+		if node.Kind != KindObject {
+			fail("an object")
+			return
+		}
+		fields := structFields(v.Type())
+		for _, key := range node.Keys {
+			keyPath := joinPath(path, key)
+			index, ok := fields[key]
+			if !ok {
+				*errs = append(*errs, &Error{Pos: node.KeyPos[key], Path: keyPath, Msg: "unknown key"})
+				continue
+			}
+			positions[keyPath] = node.KeyPos[key]
+			decodeValue(node.Fields[key], v.FieldByIndex(index), keyPath, positions, errs)
+		}
+
+	default:
+		panic("config: unsupported type " + v.Type().String())
+	}
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean: %q", s)
+	}
+}
+
+// structFields maps keys to field indices. Fields of embedded structs are
+// treated as if they were in the outer struct.
+func structFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for _, field := range reflect.VisibleFields(t) {
+		if field.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = field.Index
+		}
+	}
+	return fields
+}
+
+// Flags binds command line flags to the scalar fields of a configuration
+// struct. Each key has a flag of the same name, with "_" replaced by "-".
+// Flags are applied after the configuration file is loaded, so that they
+// take precedence.
+type Flags struct {
+	target  reflect.Value
+	applied []func(reflect.Value, Positions)
+}
+
+// BindFlags registers a flag for each scalar field of the struct pointed to
+// by v. The current values of the fields are used as defaults. The help text
+// is taken from the "usage" tag; fields without one are skipped. The word in
+// the "arg" tag, if any, is shown as the name of the flag argument.
+func BindFlags(fs *flag.FlagSet, v any) *Flags {
+	f := &Flags{target: reflect.ValueOf(v).Elem()}
+	for _, field := range reflect.VisibleFields(f.target.Type()) {
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		usage := field.Tag.Get("usage")
+		if field.Anonymous || key == "" || key == "-" || usage == "" {
+			continue
+		}
+		if arg := field.Tag.Get("arg"); arg != "" {
+			usage = strings.Replace(usage, arg, "`"+arg+"`", 1)
+		}
+		fv := &flagValue{
+			flags: f,
+			key:   key,
+			index: field.Index,
+		}
+		if value := f.target.FieldByIndex(field.Index); !value.IsZero() {
+			fv.def = fmt.Sprint(value.Interface())
+		}
+		fs.Var(fv, strings.ReplaceAll(key, "_", "-"), usage)
+	}
+	return f
+}
+
+// Apply stores the values of the flags set on the command line.
+func (f *Flags) Apply(positions Positions) {
+	for _, apply := range f.applied {
+		apply(f.target, positions)
+	}
+}
+
+// ApplyTo stores the values of the flags into another struct of the same type
+// as the one passed to BindFlags, such as when reloading the configuration.
+func (f *Flags) ApplyTo(v any, positions Positions) {
+	target := reflect.ValueOf(v).Elem()
+	for _, apply := range f.applied {
+		apply(target, positions)
+	}
+}
+
+type flagValue struct {
+	flags *Flags
+	key   string
+	index []int
+	def   string
+}
+
+func (fv *flagValue) String() string {
+	if fv == nil {
+		return ""
+	}
+	return fv.def
+}
+
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.flags != nil && fv.flags.target.FieldByIndex(fv.index).Kind() == reflect.Bool
+}
+
+func (fv *flagValue) Set(s string) error {
+	field := fv.flags.target.FieldByIndex(fv.index)
+	node := &Node{Kind: KindString, Scalar: s, Lenient: true}
+	value := reflect.New(field.Type()).Elem()
+	var errs Errors
+	decodeValue(node, value, fv.key, Positions{}, &errs)
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", errs[0].Msg)
+	}
+	name := strings.ReplaceAll(fv.key, "_", "-")
+	fv.flags.applied = append(fv.flags.applied, func(target reflect.Value, positions Positions) {
+		target.FieldByIndex(fv.index).Set(value)
+		positions[fv.key] = Pos{File: "flag -" + name}
+	})
+	return nil
+}
+
+// Inherit copies each field of src to dst, unless the corresponding key under
+// prefix was set in the configuration. This allows nested sections to take
+// their defaults from the top level.
+func Inherit(dst, src any, positions Positions, prefix string) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src)
+	for key, index := range structFields(dv.Type()) {
+		if _, ok := positions[joinPath(prefix, key)]; !ok {
+			dv.FieldByIndex(index).Set(sv.FieldByIndex(index))
+		}
+	}
+}
+
+// Changes describes the keys whose values differ between old and new, which
+// point to structs of the same type. Keys are shown under prefix. The values
+// of passphrases are not shown.
+func Changes(old, new any, prefix string) []string {
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	fields := structFields(ov.Type())
+	var changes []string
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		o := ov.FieldByIndex(fields[key]).Interface()
+		n := nv.FieldByIndex(fields[key]).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		if strings.Contains(key, "passphrase") {
+			changes = append(changes, joinPath(prefix, key)+" changed")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", joinPath(prefix, key), o, n))
+		}
+	}
+	return changes
+}
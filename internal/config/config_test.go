@@ -0,0 +1,235 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name    string            `json:"name" usage:"name of the service"`
+	Port    uint16            `json:"port" usage:"listen on port" arg:"port"`
+	Count   int               `json:"count" usage:"number of workers"`
+	Enabled bool              `json:"enabled" usage:"enable the service"`
+	Timeout Duration          `json:"timeout" usage:"idle timeout" arg:"timeout"`
+	Hosts   []string          `json:"hosts"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want testConfig
+	}{
+		{"json", "test.json", `{"name": "web", "port": 80, "count": -1, "enabled": true, "timeout": "1m30s"}`,
+			testConfig{Name: "web", Port: 80, Count: -1, Enabled: true, Timeout: Duration(90 * time.Second)}},
+		{"json list", "test.json", `{"hosts": ["a", "b"]}`, testConfig{Hosts: []string{"a", "b"}}},
+		{"json map", "test.json", `{"labels": {"a": "b"}}`, testConfig{Labels: map[string]string{"a": "b"}}},
+		{"env", "test.env", "NAME=web\nPORT=80\nCOUNT=-1\nENABLED=yes\nTIMEOUT=1m30s\n",
+			testConfig{Name: "web", Port: 80, Count: -1, Enabled: true, Timeout: Duration(90 * time.Second)}},
+		{"env list", "test.env", "HOSTS=a  b\n", testConfig{Hosts: []string{"a", "b"}}},
+		{"env boolean 1", "test.env", "ENABLED=1\n", testConfig{Enabled: true}},
+		{"env boolean on", "test.env", "ENABLED=On\n", testConfig{Enabled: true}},
+		{"env boolean off", "test.env", "ENABLED=off\n", testConfig{}},
+		{"env boolean empty", "test.env", "ENABLED=\n", testConfig{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got testConfig
+			node := parse(t, tt.file, tt.data)
+			if errs := Decode(node, &got, Positions{}); len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want []string
+	}{
+		{"unknown key", "test.json", "{\n  \"nmae\": \"web\"\n}", []string{"test.json:2:3: nmae: unknown key"}},
+		{"string", "test.json", `{"name": 1}`, []string{"test.json:1:10: name: expected a string, got number"}},
+		{"integer", "test.json", `{"count": "1"}`, []string{"test.json:1:11: count: expected an integer, got string"}},
+		{"fraction", "test.json", `{"count": 1.5}`, []string{"test.json:1:11: count: expected an integer, got number"}},
+		{"port", "test.json", `{"port": 65536}`, []string{"test.json:1:10: port: expected an integer between 0 and 65535, got number"}},
+		{"boolean", "test.json", `{"enabled": "yes"}`, []string{"test.json:1:13: enabled: expected a boolean, got string"}},
+		{"duration", "test.json", `{"timeout": 30}`, []string{`test.json:1:13: timeout: expected a duration string such as "30s", got number`}},
+		{"invalid duration", "test.json", `{"timeout": "30"}`, []string{`test.json:1:13: timeout: time: missing unit in duration "30"`}},
+		{"list item", "test.json", "{\"hosts\": [\"a\",\n  2]}", []string{"test.json:2:3: hosts[1]: expected a string, got number"}},
+		{"env integer", "test.env", "COUNT=many\n", []string{`test.env:1:7: count: expected an integer, got "many"`}},
+		{"env boolean", "test.env", "ENABLED=maybe\n", []string{`test.env:1:9: enabled: expected a boolean, got "maybe"`}},
+		{"env port", "test.env", "\nPORT = 70000\n", []string{`test.env:2:7: port: expected an integer between 0 and 65535, got "70000"`}},
+		{"all errors", "test.json", "{\n  \"name\": 1,\n  \"port\": -1,\n  \"other\": 2\n}", []string{
+			"test.json:2:11: name: expected a string, got number",
+			"test.json:3:11: port: expected an integer between 0 and 65535, got number",
+			"test.json:4:3: other: unknown key",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got testConfig
+			errs := Decode(parse(t, tt.file, tt.data), &got, Positions{})
+			if want := strings.Join(tt.want, "\n"); errs.Error() != want {
+				t.Errorf("got %v, want %s", errs, want)
+			}
+		})
+	}
+}
+
+func TestLoadFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		args      []string
+		want      testConfig
+		wantFlags []string
+	}{
+		{"file only", `{"name": "file", "port": 80}`, nil,
+			testConfig{Name: "file", Port: 80, Count: 4}, nil},
+		{"flags only", "", []string{"-name", "flag", "-enabled", "-timeout", "1s"},
+			testConfig{Name: "flag", Count: 4, Enabled: true, Timeout: Duration(time.Second)}, []string{"enabled", "name", "timeout"}},
+		{"flags over file", `{"name": "file", "port": 80, "count": 8}`, []string{"-port", "8080", "-count", "2"},
+			testConfig{Name: "file", Port: 8080, Count: 2}, []string{"count", "port"}},
+		{"last flag wins", `{"port": 80}`, []string{"-port", "81", "-port", "82"},
+			testConfig{Port: 82, Count: 4}, []string{"port"}},
+		{"boolean flag false", `{"enabled": true}`, []string{"-enabled=false"},
+			testConfig{Count: 4}, []string{"enabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testConfig{Count: 4}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := BindFlags(fs, &got)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			path := ""
+			if tt.data != "" {
+				path = filepath.Join(t.TempDir(), "test.json")
+				if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			positions, errs := Load(path, &got, flags)
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			for _, key := range tt.wantFlags {
+				want := Pos{File: "flag -" + key}
+				if positions[key] != want {
+					t.Errorf("position of %s = %v, want %v", key, positions[key], want)
+				}
+			}
+		})
+	}
+}
+
+// TestApplyTo checks that flags are applied again to a configuration loaded
+// on reload.
+func TestApplyTo(t *testing.T) {
+	var cfg testConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := BindFlags(fs, &cfg)
+	if err := fs.Parse([]string{"-port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := testConfig{Name: "file", Port: 80}
+	positions := Positions{}
+	flags.ApplyTo(&reloaded, positions)
+	if want := (testConfig{Name: "file", Port: 8080}); !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("got %+v, want %+v", reloaded, want)
+	}
+	if want := (Pos{File: "flag -port"}); positions["port"] != want {
+		t.Errorf("position = %v, want %v", positions["port"], want)
+	}
+}
+
+func TestFlagErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"integer", []string{"-count", "many"}},
+		{"port", []string{"-port", "65536"}},
+		{"duration", []string{"-timeout", "30"}},
+		{"boolean", []string{"-enabled=maybe"}},
+		{"no usage", []string{"-hosts", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got testConfig
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			BindFlags(fs, &got)
+			if err := fs.Parse(tt.args); err == nil {
+				t.Errorf("got %+v, want an error", got)
+			}
+		})
+	}
+}
+
+// parse parses data as the contents of file, which is JSON or an environment
+// file depending on the extension.
+func parse(t *testing.T, file, data string) *Node {
+	t.Helper()
+	parse := ParseEnv
+	if strings.HasSuffix(file, ".json") {
+		parse = ParseJSON
+	}
+	node, err := parse(file, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestChanges(t *testing.T) {
+	type secrets struct {
+		Name           string   `json:"name"`
+		Hosts          []string `json:"hosts"`
+		Passphrase     string   `json:"passphrase"`
+		PassphraseFrom string   `json:"passphrase_from"`
+	}
+	old := secrets{Name: "a", Hosts: []string{"x"}, Passphrase: "old-secret", PassphraseFrom: "file:/old-secret"}
+	tests := []struct {
+		name string
+		new  secrets
+		want []string
+	}{
+		{"same", old, nil},
+		{"plain", secrets{Name: "b", Hosts: []string{"x", "y"}, Passphrase: "old-secret", PassphraseFrom: "file:/old-secret"},
+			[]string{"tunnels.web.hosts: [x] → [x y]", "tunnels.web.name: a → b"}},
+		{"passphrase", secrets{Name: "a", Hosts: []string{"x"}, Passphrase: "new-secret", PassphraseFrom: "env:NEW_SECRET"},
+			[]string{"tunnels.web.passphrase changed", "tunnels.web.passphrase_from changed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Changes(&old, &tt.new, "tunnels.web")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, change := range got {
+				if strings.Contains(strings.ToLower(change), "secret") {
+					t.Errorf("secret shown: %q", change)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Kind int
+
+const (
+	KindNull Kind = iota
+	KindString
+	KindNumber
+	KindBool
+	KindObject
+	KindArray
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNull:
+		return "null"
+	case KindString:
+		return "string"
+	case KindNumber:
+		return "number"
+	case KindBool:
+		return "boolean"
+	case KindObject:
+		return "object"
+	case KindArray:
+		return "array"
+	default:
+		return "unknown"
+	}
+}
+
+// Node is a parsed configuration value, along with its position in the file.
+type Node struct {
+	Pos  Pos
+	Kind Kind
+
+	// Scalar holds the text of strings and numbers.
+	Scalar string
+	Bool   bool
+
+	Keys   []string
+	KeyPos map[string]Pos
+	Fields map[string]*Node
+
+	Items []*Node
+
+	// Lenient is set for values read from environment files, which are all
+	// strings and may be converted to other scalar types.
+	Lenient bool
+}
+
+// ParseFile reads a configuration file. Files starting with "{" are parsed as
+// JSON; otherwise they are parsed as systemd environment files, with
+// KEY=VALUE on each line.
+func ParseFile(path string) (*Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return ParseJSON(path, data)
+	}
+	return ParseEnv(path, data)
+}
+
+func ParseJSON(file string, data []byte) (*Node, error) {
+	p := &jsonParser{
+		file: file,
+		data: data,
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+	}
+	p.dec.UseNumber()
+
+	node, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind != KindObject {
+		return nil, Errors{{Pos: node.Pos, Msg: "expected an object at top level"}}
+	}
+	pos := p.nextPos()
+	_, err = p.dec.Token()
+	if err != io.EOF {
+		return nil, Errors{{Pos: pos, Msg: "unexpected data after top-level object"}}
+	}
+	return node, nil
+}
+
+type jsonParser struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+}
+
+// nextPos returns the position of the next token, skipping separators.
+func (p *jsonParser) nextPos() Pos {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	return p.posAt(offset)
+}
+
+func (p *jsonParser) posAt(offset int) Pos {
+	offset = min(offset, len(p.data))
+	line := bytes.Count(p.data[:offset], []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(p.data[:offset], '\n')
+	return Pos{File: p.file, Line: line, Col: col}
+}
+
+func (p *jsonParser) token() (json.Token, Pos, error) {
+	pos := p.nextPos()
+	tok, err := p.dec.Token()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, p.posAt(int(syntaxErr.Offset)), Errors{{Pos: p.posAt(int(syntaxErr.Offset)), Msg: syntaxErr.Error()}}
+		}
+		if err == io.EOF {
+			return nil, pos, Errors{{Pos: pos, Msg: "unexpected end of file"}}
+		}
+		return nil, pos, Errors{{Pos: pos, Msg: err.Error()}}
+	}
+	return tok, pos, nil
+}
+
+func (p *jsonParser) parseValue() (*Node, error) {
+	tok, pos, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &Node{Pos: pos}
+	switch v := tok.(type) {
+	case json.Delim:
+		switch v {
+		case '{':
+			node.Kind = KindObject
+			node.KeyPos = make(map[string]Pos)
+			node.Fields = make(map[string]*Node)
+			for p.dec.More() {
+				keyTok, keyPos, err := p.token()
+				if err != nil {
+					return nil, err
+				}
+				key := keyTok.(string)
+				if _, ok := node.Fields[key]; ok {
+					return nil, Errors{{Pos: keyPos, Msg: fmt.Sprintf("duplicate key %q", key)}}
+				}
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				node.Keys = append(node.Keys, key)
+				node.KeyPos[key] = keyPos
+				node.Fields[key] = value
+			}
+		case '[':
+			node.Kind = KindArray
+			for p.dec.More() {
+				item, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				node.Items = append(node.Items, item)
+			}
+		}
+		_, _, err = p.token()
+		if err != nil {
+			return nil, err
+		}
+	case string:
+		node.Kind = KindString
+		node.Scalar = v
+	case json.Number:
+		node.Kind = KindNumber
+		node.Scalar = string(v)
+	case bool:
+		node.Kind = KindBool
+		node.Bool = v
+	case nil:
+		node.Kind = KindNull
+	}
+	return node, nil
+}
+
+// ParseEnv parses a systemd environment file. Keys are converted to lower
+// case, so that LOCAL_ADDR=... sets local_addr.
+func ParseEnv(file string, data []byte) (*Node, error) {
+	node := &Node{
+		Pos:    Pos{File: file, Line: 1, Col: 1},
+		Kind:   KindObject,
+		KeyPos: make(map[string]Pos),
+		Fields: make(map[string]*Node),
+	}
+
+	var errs Errors
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		pos := Pos{File: file, Line: lineNum, Col: 1}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, &Error{Pos: pos, Msg: "expected KEY=VALUE"})
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(key, "export ")))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				unquoted, err := strconv.Unquote(value)
+				if err != nil {
+					errs = append(errs, &Error{Pos: pos, Msg: fmt.Sprintf("invalid quoted value: %s", value)})
+					continue
+				}
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		if _, ok := node.Fields[key]; ok {
+			errs = append(errs, &Error{Pos: pos, Msg: fmt.Sprintf("duplicate key %q", key)})
+			continue
+		}
+
+		node.Keys = append(node.Keys, key)
+		node.KeyPos[key] = pos
+		node.Fields[key] = &Node{
+			Pos:     Pos{File: file, Line: lineNum, Col: strings.Index(scanner.Text(), "=") + 2},
+			Kind:    KindString,
+			Scalar:  value,
+			Lenient: true,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return node, nil
+}
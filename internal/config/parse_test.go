@@ -0,0 +1,115 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"duplicate key", "{\n  \"name\": \"a\",\n  \"name\": \"b\"\n}", `test.json:3:3: duplicate key "name"`},
+		{"trailing comma", "{\n  \"name\": \"a\",\n}", "test.json:2:15: invalid character ',' looking for beginning of value"},
+		{"unterminated", "{\n  \"name\": ", "test.json:2:11: unexpected end of file"},
+		{"not an object", "\n  [1, 2]", "test.json:2:3: expected an object at top level"},
+		{"trailing object", "{}\n{}", "test.json:2:1: unexpected data after top-level object"},
+		{"trailing garbage", "{}\n  x", "test.json:2:3: unexpected data after top-level object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJSON("test.json", []byte(tt.data))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONPositions(t *testing.T) {
+	data := "{\n  \"name\": \"a\",\n  \"hosts\": [\"b\",\n    \"c\"]\n}"
+	node, err := ParseJSON("test.json", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  Pos
+		want Pos
+	}{
+		{"object", node.Pos, Pos{"test.json", 1, 1}},
+		{"key", node.KeyPos["name"], Pos{"test.json", 2, 3}},
+		{"value", node.Fields["name"].Pos, Pos{"test.json", 2, 11}},
+		{"first item", node.Fields["hosts"].Items[0].Pos, Pos{"test.json", 3, 13}},
+		{"second item", node.Fields["hosts"].Items[1].Pos, Pos{"test.json", 4, 5}},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		key  string
+		want string
+		col  int
+	}{
+		{"plain", "LOCAL_ADDR=127.0.0.1:80", "local_addr", "127.0.0.1:80", 12},
+		{"spaces", "  NAME =  web  ", "name", "web", 9},
+		{"export", "export NAME=web", "name", "web", 13},
+		{"double quotes", `NAME="a\tb # c"`, "name", "a\tb # c", 6},
+		{"single quotes", `NAME='a\tb'`, "name", `a\tb`, 6},
+		{"empty", "NAME=", "name", "", 6},
+		{"equals in value", "NAME=a=b", "name", "a=b", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "# comment\n; comment\n\n" + tt.line + "\n"
+			node, err := ParseEnv("test.env", []byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(node.Keys, []string{tt.key}) {
+				t.Fatalf("keys = %q, want %q", node.Keys, tt.key)
+			}
+			value := node.Fields[tt.key]
+			if value.Kind != KindString || !value.Lenient || value.Scalar != tt.want {
+				t.Errorf("got %+v, want lenient string %q", value, tt.want)
+			}
+			if want := (Pos{"test.env", 4, tt.col}); value.Pos != want {
+				t.Errorf("position = %v, want %v", value.Pos, want)
+			}
+		})
+	}
+}
+
+func TestParseEnvErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"no equals sign", "NAME=web\nPORT 80\n", []string{"test.env:2:1: expected KEY=VALUE"}},
+		{"invalid quotes", `NAME="a\q"`, []string{`test.env:1:1: invalid quoted value: "a\q"`}},
+		{"duplicate key", "NAME=a\nname=b\n", []string{`test.env:2:1: duplicate key "name"`}},
+		{"all errors", "A\nB=1\nB=2\n", []string{
+			"test.env:1:1: expected KEY=VALUE",
+			`test.env:3:1: duplicate key "b"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEnv("test.env", []byte(tt.data))
+			if want := strings.Join(tt.want, "\n"); err == nil || err.Error() != want {
+				t.Errorf("got %v, want %s", err, want)
+			}
+		})
+	}
+}
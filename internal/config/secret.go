@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	stdinOnce   sync.Once
+	stdinSecret string
+	stdinErr    error
+)
+
+// ReadSecret reads a secret from one of these sources:
+//
+//   - file:path, a file that other users cannot read
+//   - env:NAME, an environment variable
+//   - credential:NAME, a credential passed by systemd with LoadCredential=
+//   - stdin, the first line of the standard input
+//
+// Trailing line breaks are removed.
+func ReadSecret(source string) (string, error) {
+	kind, arg, _ := strings.Cut(source, ":")
+	switch kind {
+	case "file":
+		return readSecretFile(arg)
+	case "env":
+		secret, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return secret, nil
+	case "credential":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", errors.New("CREDENTIALS_DIRECTORY is not set; is LoadCredential= missing from the service?")
+		}
+		if arg == "" || strings.ContainsAny(arg, `/\`) {
+			return "", fmt.Errorf("invalid credential name: %q", arg)
+		}
+		return readSecretFile(filepath.Join(dir, arg))
+	case "stdin":
+		if arg != "" {
+			break
+		}
+		// The standard input can only be read once, so the secret is kept
+		// for reloads.
+		stdinOnce.Do(func() {
+			stdinSecret, stdinErr = bufio.NewReader(os.Stdin).ReadString('\n')
+			if stdinErr != nil && stdinSecret != "" {
+				stdinErr = nil
+			}
+			stdinSecret = strings.TrimRight(stdinSecret, "\r\n")
+		})
+		if stdinErr != nil {
+			return "", fmt.Errorf("standard input: %w", stdinErr)
+		}
+		return stdinSecret, nil
+	}
+	return "", fmt.Errorf("invalid secret source: %q (expected file:path, env:NAME, credential:NAME, or stdin)", source)
+}
+
+// InheritSecret clears the secret, or its source in the key path+"_from",
+// inherited from the top level, when the other one is set.
+func InheritSecret(secret, from *string, positions Positions, path string) {
+	if _, ok := positions[path]; ok {
+		*from = ""
+	}
+	if _, ok := positions[path+"_from"]; ok {
+		*secret = ""
+	}
+}
+
+// LoadSecret checks that either the secret at path, or its source in the key
+// path+"_from", is set, unless the secret is optional, and reads the secret
+// from its source.
+func LoadSecret(errs *Errors, positions Positions, path string, secret *string, from string, optional bool) {
+	key := path[strings.LastIndex(path, ".")+1:]
+	if from == "" {
+		errs.Check(optional || *secret != "", positions, path, "required unless %s_from is set", key)
+		return
+	}
+	if *secret != "" {
+		errs.Check(false, positions, path+"_from", "cannot be used with %s", key)
+		return
+	}
+	s, err := ReadSecret(from)
+	errs.Check(err == nil, positions, path+"_from", "%v", err)
+	errs.Check(err != nil || s != "", positions, path+"_from", "empty secret")
+	*secret = s
+}
+
+// WarnCommandLine warns that the secret named by flagName, or given as a
+// positional argument, can be seen by other users.
+func WarnCommandLine(fs *flag.FlagSet, flagName string, positional bool) {
+	set := positional
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == flagName
+	})
+	if set {
+		fmt.Fprintf(os.Stderr, "warning: the %s on the command line can be seen by other users, use -%s-from instead\n", flagName, flagName)
+	}
+}
+
+func readSecretFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// Permission bits do not mean the same on Windows.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o004 != 0 {
+		return "", fmt.Errorf("%s is readable by other users, run chmod o-r on it", path)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
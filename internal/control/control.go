@@ -0,0 +1,103 @@
+// Package control accepts commands, such as reload, from other processes
+// through a Unix socket. Each connection carries one line of command, and the
+// reply is "ok", or "error: " followed by the reason.
+package control
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/common"
+)
+
+const maxCommandSize = 256
+
+// Listen opens the control socket at path, which only the owner may connect
+// to.
+func Listen(path string) (net.Listener, error) {
+	listener, err := common.Listen("unix:" + path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(path, "@") {
+		err = os.Chmod(path, 0o600)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// Serve calls handle for each command received on listener, until ctx is
+// done.
+func Serve(ctx context.Context, listener net.Listener, handle func(command string) error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stop()
+
+	d := backoff.NewWithContext(ctx, log.Default())
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if !d.ProcessError(err) {
+			go serveConn(conn, handle)
+		}
+	}
+}
+
+func serveConn(conn net.Conn, handle func(command string) error) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
+	line, err := bufio.NewReader(io.LimitReader(conn, maxCommandSize)).ReadString('\n')
+	if err != nil {
+		log.Println("control:", err)
+		return
+	}
+	err = handle(strings.TrimSpace(line))
+
+	reply := "ok\n"
+	if err != nil {
+		reply = "error: " + err.Error() + "\n"
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	_, _ = io.WriteString(conn, reply)
+}
+
+// Send sends command to the control socket at path, and returns the error
+// reported by the other side.
+func Send(path, command string) error {
+	conn, err := net.DialTimeout("unix", path, common.NetworkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, command+"\n")
+	if err != nil {
+		return err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if string(reply) == "ok\n" {
+		return nil
+	}
+	if msg, ok := strings.CutPrefix(string(reply), "error: "); ok {
+		return errors.New(strings.TrimSuffix(msg, "\n"))
+	}
+	return errors.New("no reply from control socket")
+}
@@ -0,0 +1,82 @@
+// Package drain keeps track of the connections in progress, so that they can
+// be given time to finish on shutdown.
+package drain
+
+import (
+	"context"
+	"sync"
+)
+
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func New() *Group {
+	g := &Group{}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	return g
+}
+
+// Go runs fn in a new goroutine, with a context which is cancelled when the
+// connection has to be closed, because Shutdown gave up waiting.
+func (g *Group) Go(fn func(ctx context.Context)) {
+	g.mu.Lock()
+	g.n++
+	g.mu.Unlock()
+	go func() {
+		defer g.done()
+		fn(g.ctx)
+	}()
+}
+
+func (g *Group) done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.n == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// Context is cancelled once Shutdown returns.
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
+
+// Len returns the number of connections in progress.
+func (g *Group) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n
+}
+
+// Shutdown waits until all connections are finished, or ctx is done. The
+// remaining connections are then cancelled, and their number is returned.
+// Connections started afterwards are cancelled at once.
+func (g *Group) Shutdown(ctx context.Context) int {
+	g.mu.Lock()
+	var idle chan struct{}
+	if g.n != 0 {
+		if g.idle == nil {
+			g.idle = make(chan struct{})
+		}
+		idle = g.idle
+	}
+	g.mu.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+		}
+	}
+	remaining := g.Len()
+	g.cancel()
+	return remaining
+}
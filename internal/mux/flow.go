@@ -0,0 +1,95 @@
+package mux
+
+import (
+	"bytes"
+	"sync"
+)
+
+// flowRecvQueueSize is the number of datagrams buffered for each flow.
+// Further datagrams are dropped, as a congested UDP network would do.
+const flowRecvQueueSize = 64
+
+// Flow is a sequence of datagrams inside a multiplexed session, which
+// preserves datagram boundaries but not reliability.
+type Flow struct {
+	id     uint32
+	sess   *Session
+	header []byte
+
+	recv      chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFlow(sess *Session, id uint32, header []byte) *Flow {
+	return &Flow{
+		id:     id,
+		sess:   sess,
+		header: bytes.Clone(header),
+		recv:   make(chan []byte, flowRecvQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *Flow) ID() uint32 {
+	return f.id
+}
+
+// Header returns the header sent along with the flow when it was opened.
+func (f *Flow) Header() []byte {
+	return f.header
+}
+
+// Send sends one datagram to the peer. Datagrams larger than
+// MaxFrameDataSize are rejected with ErrDatagramTooLarge.
+func (f *Flow) Send(datagram []byte) error {
+	if len(datagram) > MaxFrameDataSize {
+		return ErrDatagramTooLarge
+	}
+	select {
+	case <-f.closed:
+		return ErrStreamClosed
+	default:
+	}
+	return f.sess.writeFrame(frameDatagram, f.id, datagram)
+}
+
+// Recv waits for the next datagram from the peer.
+func (f *Flow) Recv() ([]byte, error) {
+	select {
+	case datagram := <-f.recv:
+		return datagram, nil
+	case <-f.closed:
+		return nil, ErrStreamClosed
+	}
+}
+
+// Done is closed after the flow is closed by either side.
+func (f *Flow) Done() <-chan struct{} {
+	return f.closed
+}
+
+// Close closes the flow and tells the peer to release it.
+func (f *Flow) Close() error {
+	f.sess.removeFlow(f.id)
+	select {
+	case <-f.closed:
+		return nil
+	default:
+	}
+	f.abort()
+	return f.sess.writeFrame(frameFlowClose, f.id, nil)
+}
+
+func (f *Flow) abort() {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+	})
+}
+
+func (f *Flow) push(datagram []byte) {
+	select {
+	case f.recv <- bytes.Clone(datagram):
+	default:
+	}
+}
@@ -0,0 +1,63 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+// Forward copies data between a stream and a connection in both directions,
+// preserving half-close where the connection supports it, and closes both
+// when finished, or when ctx is done.
+func Forward(ctx context.Context, st *Stream, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		st.Reset()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(st, conn)
+		if err != nil {
+			logForwardError(st.sess.log, err)
+			st.Reset()
+			_ = conn.Close()
+			return
+		}
+		_ = st.CloseWrite()
+		_ = common.CloseRead(conn)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(conn, st)
+		if err != nil {
+			logForwardError(st.sess.log, err)
+			_ = conn.Close()
+			st.Reset()
+			return
+		}
+		_ = common.CloseWrite(conn)
+		_ = st.CloseRead()
+	}()
+
+	wg.Wait()
+	_ = conn.Close()
+	_ = st.Close()
+}
+
+func logForwardError(logger *log.Logger, err error) {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, ErrStreamReset) || errors.Is(err, ErrStreamClosed) || errors.Is(err, ErrSessionClosed) {
+		return
+	}
+	logger.Println(err)
+}
@@ -0,0 +1,417 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+const (
+	// PacketHello is sent by L instead of the first ping to request
+	// multiplexed mode.
+	PacketHello = 0x6d
+
+	framePing   = 0x00
+	frameOpen   = 0x10
+	frameData   = 0x11
+	frameClose  = 0x12
+	frameReset  = 0x13
+	frameWindow = 0x14
+
+	frameFlowOpen  = 0x20
+	frameDatagram  = 0x21
+	frameFlowClose = 0x22
+
+	frameHeaderSize  = 5
+	MaxFrameDataSize = common.MaxBodySize - frameHeaderSize
+
+	// InitialWindow is the number of bytes each side may send on a stream
+	// before receiving a window update.
+	InitialWindow = 256 * 1024
+
+	// acceptBacklog is the number of streams, and of flows, opened by the
+	// peer and not accepted yet. Further ones are refused, so that a slow
+	// Accept does not block the session.
+	acceptBacklog = 128
+)
+
+var (
+	ErrSessionClosed = errors.New("multiplexed session closed")
+	ErrStreamReset   = errors.New("stream reset by peer")
+	ErrStreamClosed  = errors.New("stream closed")
+
+	ErrDatagramTooLarge = errors.New("datagram too large")
+
+	errWindowExceeded = errors.New("flow control window exceeded")
+)
+
+type Session struct {
+	conn    net.Conn
+	send    *common.CipherState
+	recv    *common.CipherState
+	isRelay bool
+	log     *log.Logger
+
+	writeMu  sync.Mutex
+	writeBuf [common.MaxPacketSize]byte
+
+	mu            sync.Mutex
+	streams       map[uint32]*Stream
+	flows         map[uint32]*Flow
+	nextID        uint32
+	closeIdle     bool
+	err           error
+	accepted      chan *Stream
+	acceptedFlows chan *Flow
+	done          chan struct{}
+}
+
+// NewSession starts a multiplexed session on an authorized connection.
+// On the relay side, streams are created with Open; on the local side, they
+// are received with Accept. Errors are logged to logger.
+func NewSession(conn net.Conn, send, recv *common.CipherState, isRelay bool, logger *log.Logger) *Session {
+	s := &Session{
+		conn:          conn,
+		send:          send,
+		recv:          recv,
+		isRelay:       isRelay,
+		log:           logger,
+		streams:       make(map[uint32]*Stream),
+		flows:         make(map[uint32]*Flow),
+		nextID:        1,
+		accepted:      make(chan *Stream, acceptBacklog),
+		acceptedFlows: make(chan *Flow, acceptBacklog),
+		done:          make(chan struct{}),
+	}
+	go s.loopRecv()
+	if isRelay {
+		go s.loopPing()
+	}
+	return s
+}
+
+// Open creates a new stream. The header is delivered to the peer along with
+// the stream, which is usually a PROXY v2 header.
+func (s *Session) Open(header []byte) (*Stream, error) {
+	if len(header) > MaxFrameDataSize {
+		return nil, fmt.Errorf("stream header too big: %d", len(header))
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID++
+	st := newStream(s, id, header)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	err := s.writeFrame(frameOpen, id, header)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepted:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// OpenFlow creates a new datagram flow. The header is delivered to the peer
+// along with the flow, which is usually a PROXY v2 header.
+func (s *Session) OpenFlow(header []byte) (*Flow, error) {
+	if len(header) > MaxFrameDataSize {
+		return nil, fmt.Errorf("flow header too big: %d", len(header))
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID++
+	f := newFlow(s, id, header)
+	s.flows[id] = f
+	s.mu.Unlock()
+
+	err := s.writeFrame(frameFlowOpen, id, header)
+	if err != nil {
+		s.removeFlow(id)
+		return nil, err
+	}
+	return f, nil
+}
+
+// AcceptFlow waits for the next datagram flow opened by the peer.
+func (s *Session) AcceptFlow() (*Flow, error) {
+	select {
+	case f := <-s.acceptedFlows:
+		return f, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	flows := s.flows
+	s.streams = make(map[uint32]*Stream)
+	s.flows = make(map[uint32]*Flow)
+	s.mu.Unlock()
+
+	close(s.done)
+	_ = s.conn.Close()
+	for _, st := range streams {
+		st.abort(err)
+	}
+	for _, f := range flows {
+		f.abort()
+	}
+}
+
+// CloseWhenIdle closes the session once it carries no more streams. New
+// streams should not be opened or accepted afterwards.
+func (s *Session) CloseWhenIdle() {
+	s.mu.Lock()
+	s.closeIdle = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		_ = s.Close()
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := s.closeIdle && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		_ = s.Close()
+	}
+}
+
+func (s *Session) removeFlow(id uint32) {
+	s.mu.Lock()
+	delete(s.flows, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(frameType byte, id uint32, data []byte) error {
+	var packet [common.MaxBodySize]byte
+	packet[0] = frameType
+	binary.BigEndian.PutUint32(packet[1:frameHeaderSize], id)
+	n := copy(packet[frameHeaderSize:], data)
+	return s.writePacket(packet[:frameHeaderSize+n])
+}
+
+func (s *Session) writePacket(packet []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	err := common.WritePacket(s.conn, packet, s.send, s.writeBuf[:])
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *Session) loopPing() {
+	pingTicker := time.NewTicker(common.PingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-pingTicker.C:
+			err := s.writePacket((&[256 - common.PacketOverhead]byte{})[:])
+			if err != nil {
+				s.log.Println(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) handleFlowFrame(frameType byte, id uint32, data []byte) {
+	if frameType == frameFlowOpen {
+		if s.isRelay {
+			return
+		}
+		f := newFlow(s, id, data)
+		s.mu.Lock()
+		_, exists := s.flows[id]
+		if !exists {
+			s.flows[id] = f
+		}
+		s.mu.Unlock()
+		if exists {
+			return
+		}
+		select {
+		case s.acceptedFlows <- f:
+		default:
+			s.log.Printf("flow %d: accept backlog full, closing", id)
+			_ = f.Close()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	f := s.flows[id]
+	s.mu.Unlock()
+	if f == nil {
+		return
+	}
+
+	switch frameType {
+	case frameDatagram:
+		f.push(data)
+	case frameFlowClose:
+		s.removeFlow(id)
+		f.abort()
+	}
+}
+
+func (s *Session) loopRecv() {
+	var buf [common.MaxRecvBufferSize]byte
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(common.ExtendedNetworkTimeout))
+		packet, err := common.ReadPacket(s.conn, s.recv, buf[:])
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.log.Println(err)
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		if len(packet) == 0 {
+			continue
+		}
+		if packet[0] == framePing {
+			if !s.isRelay {
+				err = s.writePacket((&[256 - common.PacketOverhead]byte{})[:])
+				if err != nil {
+					s.log.Println(err)
+					return
+				}
+			}
+			continue
+		}
+		if len(packet) < frameHeaderSize {
+			continue
+		}
+
+		frameType := packet[0]
+		id := binary.BigEndian.Uint32(packet[1:frameHeaderSize])
+		data := packet[frameHeaderSize:]
+
+		if frameType == frameOpen {
+			if s.isRelay {
+				continue
+			}
+			st := newStream(s, id, data)
+			s.mu.Lock()
+			_, exists := s.streams[id]
+			if !exists {
+				s.streams[id] = st
+			}
+			s.mu.Unlock()
+			if exists {
+				continue
+			}
+			select {
+			case s.accepted <- st:
+			default:
+				s.log.Printf("stream %d: accept backlog full, resetting", id)
+				st.Reset()
+			}
+			continue
+		}
+
+		if frameType == frameFlowOpen || frameType == frameDatagram || frameType == frameFlowClose {
+			s.handleFlowFrame(frameType, id, data)
+			continue
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		if st == nil {
+			// The stream is already gone, which is normal after a reset.
+			continue
+		}
+
+		switch frameType {
+		case frameData:
+			err = st.pushData(data)
+			if err != nil {
+				if err == errWindowExceeded {
+					s.log.Printf("stream %d: %v", id, err)
+				}
+				st.Reset()
+			}
+		case frameClose:
+			st.pushEOF()
+		case frameReset:
+			s.removeStream(id)
+			st.abort(ErrStreamReset)
+		case frameWindow:
+			if len(data) >= 4 {
+				st.pushWindow(binary.BigEndian.Uint32(data[:4]))
+			}
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+// discard is the logger of the sessions in tests.
+var discard = log.New(io.Discard, "", 0)
+
+// newSessions returns the relay and local ends of a multiplexed session.
+func newSessions(t *testing.T) (relay, local *Session) {
+	relayConn, localConn := net.Pipe()
+	send, recv := newCipherStates(t, true)
+	relay = NewSession(relayConn, send, recv, true, discard)
+	send, recv = newCipherStates(t, false)
+	local = NewSession(localConn, send, recv, false, discard)
+	t.Cleanup(func() {
+		relay.Close()
+		local.Close()
+	})
+	return
+}
+
+func newCipherStates(t *testing.T, isRelay bool) (send, recv *common.CipherState) {
+	send, recv, err := common.NewCipherStates(make([]byte, 32), isRelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send, recv
+}
+
+// rawPeer is the relay end of a session, which sends and receives frames
+// without a Session.
+type rawPeer struct {
+	t    *testing.T
+	conn net.Conn
+	send *common.CipherState
+	recv *common.CipherState
+	buf  [common.MaxPacketSize]byte
+}
+
+func newRawPeer(t *testing.T) (*rawPeer, *Session) {
+	relayConn, localConn := net.Pipe()
+	send, recv := newCipherStates(t, false)
+	local := NewSession(localConn, send, recv, false, discard)
+	p := &rawPeer{t: t, conn: relayConn}
+	p.send, p.recv = newCipherStates(t, true)
+	t.Cleanup(func() {
+		local.Close()
+		relayConn.Close()
+	})
+	return p, local
+}
+
+func (p *rawPeer) writePacket(packet []byte) {
+	_ = p.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err := common.WritePacket(p.conn, packet, p.send, p.buf[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *rawPeer) writeFrame(frameType byte, id uint32, data []byte) {
+	packet := []byte{frameType}
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	p.writePacket(append(packet, data...))
+}
+
+// readFrame returns the next frame other than a ping.
+func (p *rawPeer) readFrame() (frameType byte, id uint32, data []byte) {
+	for {
+		_ = p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		packet, err := common.ReadPacket(p.conn, p.recv, p.buf[:])
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if len(packet) >= frameHeaderSize && packet[0] != framePing {
+			return packet[0], binary.BigEndian.Uint32(packet[1:frameHeaderSize]), bytes.Clone(packet[frameHeaderSize:])
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one frame", MaxFrameDataSize},
+		{"two frames", MaxFrameDataSize + 1},
+		{"window", InitialWindow},
+		{"beyond window", 3*InitialWindow + 12345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, local := newSessions(t)
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+
+			st, err := relay.Open([]byte("header"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeErr := make(chan error, 1)
+			go func() {
+				_, err := st.Write(data)
+				if err == nil {
+					err = st.CloseWrite()
+				}
+				writeErr <- err
+			}()
+
+			accepted, err := local.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted.ID() != st.ID() || string(accepted.Header()) != "header" {
+				t.Errorf("accepted stream %d with header %q, want %d with %q", accepted.ID(), accepted.Header(), st.ID(), "header")
+			}
+			got, err := io.ReadAll(accepted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("received %d bytes, want %d", len(got), len(data))
+			}
+			if err := <-writeErr; err != nil {
+				t.Fatal(err)
+			}
+
+			// The other direction, after which the stream is gone.
+			go func() {
+				_, err := accepted.Write(data)
+				if err == nil {
+					err = accepted.CloseWrite()
+				}
+				writeErr <- err
+			}()
+			got, err = io.ReadAll(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("sent back %d bytes, want %d", len(got), len(data))
+			}
+			if err := <-writeErr; err != nil {
+				t.Fatal(err)
+			}
+			if n := relay.NumStreams(); n != 0 {
+				t.Errorf("relay has %d streams after both sides closed", n)
+			}
+		})
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	relay, local := newSessions(t)
+	st, err := relay.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Reset()
+	if _, err := io.ReadAll(st); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("read after reset: %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := accepted.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("write after reset: %v, want %v", err, ErrStreamClosed)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	relay, local := newSessions(t)
+	st, err := relay.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.Close()
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("read on the closed side: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); err == nil {
+		t.Error("read on the other side: no error")
+	}
+	select {
+	case <-local.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("local session still open")
+	}
+	if _, err := relay.Open(nil); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("open after close: %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestOversized(t *testing.T) {
+	relay, _ := newSessions(t)
+	if _, err := relay.Open(make([]byte, MaxFrameDataSize+1)); err == nil {
+		t.Error("Open with an oversized header: no error")
+	}
+	if _, err := relay.OpenFlow(make([]byte, MaxFrameDataSize+1)); err == nil {
+		t.Error("OpenFlow with an oversized header: no error")
+	}
+}
+
+func TestWindowExceeded(t *testing.T) {
+	p, local := newRawPeer(t)
+	p.writeFrame(frameOpen, 1, nil)
+	accepted, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer ignores the window, while nothing is read from the stream.
+	for sent := 0; sent <= InitialWindow; sent += MaxFrameDataSize {
+		p.writeFrame(frameData, 1, make([]byte, MaxFrameDataSize))
+	}
+	frameType, id, _ := p.readFrame()
+	if frameType != frameReset || id != 1 {
+		t.Errorf("got frame %#x for stream %d, want a reset of stream 1", frameType, id)
+	}
+	if _, err := accepted.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("write after reset: %v, want %v", err, ErrStreamClosed)
+	}
+}
+
+func TestWindowUpdate(t *testing.T) {
+	p, local := newRawPeer(t)
+	p.writeFrame(frameOpen, 1, nil)
+	accepted, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The local side sends up to the window, then waits for an update.
+	written := make(chan int, 1)
+	go func() {
+		n, _ := accepted.Write(make([]byte, InitialWindow+1))
+		written <- n
+	}()
+	received := 0
+	for received < InitialWindow {
+		frameType, _, data := p.readFrame()
+		if frameType != frameData {
+			t.Fatalf("got frame %#x, want data", frameType)
+		}
+		received += len(data)
+	}
+	if received != InitialWindow {
+		t.Fatalf("received %d bytes before an update, want %d", received, InitialWindow)
+	}
+	select {
+	case n := <-written:
+		t.Fatalf("write of %d bytes returned before a window update", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A truncated update is ignored.
+	p.writeFrame(frameWindow, 1, []byte{0, 0, 1})
+	p.writeFrame(frameWindow, 1, []byte{0, 0, 0, 1})
+	frameType, _, data := p.readFrame()
+	if frameType != frameData || len(data) != 1 {
+		t.Errorf("got frame %#x with %d bytes, want 1 byte of data", frameType, len(data))
+	}
+	if n := <-written; n != InitialWindow+1 {
+		t.Errorf("wrote %d bytes, want %d", n, InitialWindow+1)
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	p, local := newRawPeer(t)
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", []byte{}},
+		{"type only", []byte{frameData}},
+		{"truncated ID", []byte{frameData, 0, 0, 0}},
+		{"unknown type", []byte{0x7f, 0, 0, 0, 1}},
+		{"data of unknown stream", []byte{frameData, 0, 0, 0, 9, 'x'}},
+		{"window of unknown stream", []byte{frameWindow, 0, 0, 0, 9, 0, 0, 0, 1}},
+		{"reset of unknown stream", []byte{frameReset, 0, 0, 0, 9}},
+		{"datagram of unknown flow", []byte{frameDatagram, 0, 0, 0, 9, 'x'}},
+		{"largest frame", append([]byte{frameData, 0, 0, 0, 9}, make([]byte, MaxFrameDataSize)...)},
+	}
+	for _, tt := range tests {
+		p.writePacket(tt.packet)
+	}
+
+	// The session still works.
+	p.writeFrame(frameOpen, 1, []byte("header"))
+	accepted, err := local.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.writeFrame(frameData, 1, []byte("data"))
+	p.writeFrame(frameClose, 1, nil)
+	got, err := io.ReadAll(accepted)
+	if err != nil || string(got) != "data" {
+		t.Errorf("got %q, %v, want %q", got, err, "data")
+	}
+	if local.Err() != nil {
+		t.Errorf("session closed: %v", local.Err())
+	}
+}
+
+func TestFlow(t *testing.T) {
+	relay, local := newSessions(t)
+	f, err := relay.OpenFlow([]byte("header"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := local.AcceptFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(accepted.Header()) != "header" {
+		t.Errorf("header = %q, want %q", accepted.Header(), "header")
+	}
+
+	datagrams := [][]byte{{}, []byte("x"), make([]byte, MaxFrameDataSize)}
+	for _, d := range datagrams {
+		if err := f.Send(d); err != nil {
+			t.Fatal(err)
+		}
+		got, err := accepted.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, d) {
+			t.Errorf("received %d bytes, want %d", len(got), len(d))
+		}
+		if err := accepted.Send(d); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := f.Recv(); err != nil || !bytes.Equal(got, d) {
+			t.Errorf("sent back %d bytes, %v, want %d", len(got), err, len(d))
+		}
+	}
+	if err := f.Send(make([]byte, MaxFrameDataSize+1)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("oversized datagram: %v, want %v", err, ErrDatagramTooLarge)
+	}
+
+	if err := accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow still open after the peer closed it")
+	}
+	if err := f.Send([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("send after close: %v, want %v", err, ErrStreamClosed)
+	}
+}
+
+func TestFlowQueueFull(t *testing.T) {
+	p, local := newRawPeer(t)
+	p.writeFrame(frameFlowOpen, 1, nil)
+	f, err := local.AcceptFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Datagrams beyond the queue are dropped, without blocking the session.
+	for i := range flowRecvQueueSize + 10 {
+		p.writeFrame(frameDatagram, 1, []byte{byte(i)})
+	}
+	p.writeFrame(frameOpen, 2, nil)
+	if _, err := local.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range flowRecvQueueSize {
+		got, err := f.Recv()
+		if err != nil || !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("datagram %d: got %v, %v", i, got, err)
+		}
+	}
+	select {
+	case got := <-f.recv:
+		t.Errorf("got datagram %v beyond the queue", got)
+	default:
+	}
+}
+
+func TestAcceptBacklogFull(t *testing.T) {
+	p, local := newRawPeer(t)
+	// Streams and flows beyond the backlog are refused, without blocking the
+	// session.
+	for id := uint32(1); id <= acceptBacklog+1; id++ {
+		p.writeFrame(frameOpen, id, nil)
+	}
+	if frameType, id, _ := p.readFrame(); frameType != frameReset || id != acceptBacklog+1 {
+		t.Errorf("got frame %#x on stream %d, want reset of stream %d", frameType, id, acceptBacklog+1)
+	}
+	for id := uint32(acceptBacklog + 2); id <= 2*acceptBacklog+2; id++ {
+		p.writeFrame(frameFlowOpen, id, nil)
+	}
+	if frameType, id, _ := p.readFrame(); frameType != frameFlowClose || id != 2*acceptBacklog+2 {
+		t.Errorf("got frame %#x on flow %d, want close of flow %d", frameType, id, 2*acceptBacklog+2)
+	}
+
+	for id := uint32(1); id <= acceptBacklog; id++ {
+		st, err := local.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.ID() != id {
+			t.Fatalf("accepted stream %d, want %d", st.ID(), id)
+		}
+	}
+	for id := uint32(acceptBacklog + 2); id < 2*acceptBacklog+2; id++ {
+		f, err := local.AcceptFlow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ID() != id {
+			t.Fatalf("accepted flow %d, want %d", f.ID(), id)
+		}
+	}
+	if n := local.NumStreams(); n != acceptBacklog {
+		t.Errorf("%d streams, want %d", n, acceptBacklog)
+	}
+}
@@ -0,0 +1,204 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Stream is a logical connection inside a multiplexed session.
+type Stream struct {
+	id     uint32
+	sess   *Session
+	header []byte
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	recvBuf    []byte
+	recvEOF    bool
+	consumed   int
+	sendWindow int
+	sendClosed bool
+	readClosed bool
+	err        error
+}
+
+func newStream(sess *Session, id uint32, header []byte) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       sess,
+		header:     append([]byte(nil), header...),
+		sendWindow: InitialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Header returns the header sent along with the stream when it was opened.
+func (st *Stream) Header() []byte {
+	return st.header
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.recvBuf) == 0 && !st.recvEOF && st.err == nil && !st.readClosed {
+		st.cond.Wait()
+	}
+	if len(st.recvBuf) == 0 {
+		err := st.err
+		if err == nil {
+			err = io.EOF
+		}
+		st.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, st.recvBuf)
+	st.recvBuf = st.recvBuf[n:]
+	if len(st.recvBuf) == 0 {
+		st.recvBuf = nil
+	}
+	st.consumed += n
+	increment := 0
+	if st.consumed >= InitialWindow/2 {
+		increment = st.consumed
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+
+	if increment != 0 {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(increment))
+		_ = st.sess.writeFrame(frameWindow, st.id, buf[:])
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.sendClosed {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := min(len(p), st.sendWindow, MaxFrameDataSize)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		err := st.sess.writeFrame(frameData, st.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be sent on the stream.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.sendClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sendClosed = true
+	finished := st.recvEOF
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	err := st.sess.writeFrame(frameClose, st.id, nil)
+	if finished {
+		st.sess.removeStream(st.id)
+	}
+	return err
+}
+
+// CloseRead discards any data received on the stream from now on.
+func (st *Stream) CloseRead() error {
+	st.mu.Lock()
+	st.readClosed = true
+	st.recvBuf = nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *Stream) Close() error {
+	_ = st.CloseRead()
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+	st.mu.Unlock()
+
+	st.sess.removeStream(st.id)
+	_ = st.sess.writeFrame(frameReset, st.id, nil)
+	st.abort(ErrStreamClosed)
+}
+
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.recvBuf = nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) pushData(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.recvEOF || st.err != nil {
+		return nil
+	}
+	if st.readClosed {
+		return ErrStreamClosed
+	}
+	if len(st.recvBuf)+len(data) > InitialWindow {
+		return errWindowExceeded
+	}
+	st.recvBuf = append(st.recvBuf, data...)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) pushEOF() {
+	st.mu.Lock()
+	st.recvEOF = true
+	finished := st.sendClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if finished {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *Stream) pushWindow(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(increment)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
@@ -0,0 +1,343 @@
+package proxy_v2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+)
+
+const (
+	CommandLocal = 0x0
+	CommandProxy = 0x1
+
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+
+	// Sub-TLVs of TypeSSL
+	TypeSSLVersion = 0x21
+	TypeSSLCN      = 0x22
+	TypeSSLCipher  = 0x23
+	TypeSSLSigAlg  = 0x24
+	TypeSSLKeyAlg  = 0x25
+
+	// Types in the range reserved for custom use
+	TypePopubTenant = 0xe0
+
+	// Bits of SSLInfo.Client
+	ClientSSL      = 0x01
+	ClientCertConn = 0x02
+	ClientCertSess = 0x04
+
+	MaxUniqueIDSize = 128
+
+	signature    = "\r\n\r\n\x00\r\nQUIT\n"
+	unixAddrSize = 108
+)
+
+var ErrCRC32CMismatch = errors.New("PROXY v2 header checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY v2 header. Src and Dst are *net.TCPAddr, *net.UDPAddr, or
+// *net.UnixAddr of the same family, or both nil for AF_UNSPEC.
+type Header struct {
+	Command byte
+	Src     net.Addr
+	Dst     net.Addr
+	TLVs    []TLV
+}
+
+// TLV returns the value of the first TLV of the given type.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetTLV replaces the value of the first TLV of the given type, or adds one.
+func (h *Header) SetTLV(typ byte, value []byte) {
+	for i := range h.TLVs {
+		if h.TLVs[i].Type == typ {
+			h.TLVs[i].Value = value
+			return
+		}
+	}
+	h.TLVs = append(h.TLVs, TLV{Type: typ, Value: value})
+}
+
+// Marshal encodes the header. If a TypeCRC32C TLV is present, its value is
+// filled with the checksum of the header.
+func (h *Header) Marshal() ([]byte, error) {
+	if h.Command != CommandLocal && h.Command != CommandProxy {
+		return nil, fmt.Errorf("invalid PROXY v2 command: %#x", h.Command)
+	}
+	buf := append([]byte(signature), 0x20|h.Command, 0, 0, 0)
+	buf, family, err := appendAddrs(buf, h.Src, h.Dst)
+	if err != nil {
+		return nil, err
+	}
+	buf[13] = family
+
+	crcOffset := -1
+	for _, tlv := range h.TLVs {
+		value := tlv.Value
+		switch tlv.Type {
+		case TypeCRC32C:
+			crcOffset = len(buf) + 3
+			value = make([]byte, 4)
+		case TypeUniqueID:
+			if len(value) > MaxUniqueIDSize {
+				return nil, fmt.Errorf("PROXY v2 unique ID too long: %d bytes", len(value))
+			}
+		}
+		if len(value) > 0xffff {
+			return nil, fmt.Errorf("PROXY v2 TLV %#x too long: %d bytes", tlv.Type, len(value))
+		}
+		buf = append(buf, tlv.Type)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+		buf = append(buf, value...)
+	}
+
+	if len(buf)-16 > 0xffff {
+		return nil, fmt.Errorf("PROXY v2 header too long: %d bytes", len(buf))
+	}
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(buf)-16))
+	if crcOffset >= 0 {
+		binary.BigEndian.PutUint32(buf[crcOffset:], crc32.Checksum(buf, castagnoli))
+	}
+	return buf, nil
+}
+
+func appendAddrs(buf []byte, src, dst net.Addr) ([]byte, byte, error) {
+	switch src := src.(type) {
+	case nil:
+		if dst != nil {
+			return nil, 0, ErrInvalidProxyV2Address
+		}
+		return buf, 0x00, nil
+
+	case *net.TCPAddr:
+		dst, ok := dst.(*net.TCPAddr)
+		if !ok {
+			return nil, 0, ErrInvalidProxyV2Address
+		}
+		return appendIPAddrs(buf, 0x1, src.IP, src.Port, dst.IP, dst.Port)
+
+	case *net.UDPAddr:
+		dst, ok := dst.(*net.UDPAddr)
+		if !ok {
+			return nil, 0, ErrInvalidProxyV2Address
+		}
+		return appendIPAddrs(buf, 0x2, src.IP, src.Port, dst.IP, dst.Port)
+
+	case *net.UnixAddr:
+		dst, ok := dst.(*net.UnixAddr)
+		if !ok || src.Net != dst.Net {
+			return nil, 0, ErrInvalidProxyV2Address
+		}
+		transport := byte(0x1)
+		if src.Net == "unixgram" {
+			transport = 0x2
+		}
+		for _, addr := range []*net.UnixAddr{src, dst} {
+			name := addr.Name
+			if strings.HasPrefix(name, "@") {
+				// Abstract socket
+				name = "\x00" + name[1:]
+			}
+			if len(name) > unixAddrSize {
+				return nil, 0, fmt.Errorf("Unix socket path too long for PROXY v2 header: %q", addr.Name)
+			}
+			var path [unixAddrSize]byte
+			copy(path[:], name)
+			buf = append(buf, path[:]...)
+		}
+		return buf, 0x30 | transport, nil
+
+	default:
+		return nil, 0, ErrInvalidProxyV2Address
+	}
+}
+
+func appendIPAddrs(buf []byte, transport byte, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) ([]byte, byte, error) {
+	var family byte
+	if srcIPv4, dstIPv4 := srcIP.To4(), dstIP.To4(); srcIPv4 != nil && dstIPv4 != nil {
+		family = 0x10
+		buf = append(buf, srcIPv4...)
+		buf = append(buf, dstIPv4...)
+	} else if srcIPv6, dstIPv6 := srcIP.To16(), dstIP.To16(); srcIPv6 != nil && dstIPv6 != nil {
+		family = 0x20
+		buf = append(buf, srcIPv6...)
+		buf = append(buf, dstIPv6...)
+	} else {
+		return nil, 0, fmt.Errorf("%w: [%s, %s]", ErrInvalidProxyV2Address, srcIP, dstIP)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(srcPort))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(dstPort))
+	return buf, family | transport, nil
+}
+
+// HeaderSize returns the size of the PROXY v2 header at the start of buf, or
+// 0 if buf does not start with a complete one.
+func HeaderSize(buf []byte) int {
+	if len(buf) < 16 || !bytes.Equal(buf[:12], []byte(signature)) {
+		return 0
+	}
+	size := int(binary.BigEndian.Uint16(buf[14:16])) + 16
+	if len(buf) < size {
+		return 0
+	}
+	return size
+}
+
+// ParseHeader decodes the PROXY v2 header at the start of buf, and returns it
+// along with its size. Data after the header is ignored.
+func ParseHeader(buf []byte) (*Header, int, error) {
+	size := HeaderSize(buf)
+	if size == 0 || buf[12]>>4 != 2 {
+		return nil, 0, ErrInvalidProxyV2Header
+	}
+	h := &Header{Command: buf[12] & 0xf}
+	if h.Command != CommandLocal && h.Command != CommandProxy {
+		return nil, 0, ErrInvalidProxyV2Header
+	}
+
+	family := buf[13]
+	body := buf[16:size]
+	var addrLen int
+	switch family >> 4 {
+	case 0x0:
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 2 * unixAddrSize
+	default:
+		return nil, 0, ErrInvalidProxyV2Address
+	}
+	if len(body) < addrLen {
+		return nil, 0, ErrInvalidProxyV2Address
+	}
+	transport := family & 0xf
+	if family>>4 != 0x0 && transport != 0x1 && transport != 0x2 {
+		return nil, 0, ErrInvalidProxyV2Address
+	}
+
+	switch family >> 4 {
+	case 0x1, 0x2:
+		ipLen := (addrLen - 4) / 2
+		srcIP := net.IP(bytes.Clone(body[:ipLen]))
+		dstIP := net.IP(bytes.Clone(body[ipLen : 2*ipLen]))
+		srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+		if transport == 0x2 {
+			h.Src = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			h.Dst = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		} else {
+			h.Src = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			h.Dst = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		}
+	case 0x3:
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+		h.Src = &net.UnixAddr{Name: decodeUnixPath(body[:unixAddrSize]), Net: network}
+		h.Dst = &net.UnixAddr{Name: decodeUnixPath(body[unixAddrSize : 2*unixAddrSize]), Net: network}
+	}
+
+	crcOffset := -1
+	for rest := body[addrLen:]; len(rest) != 0; {
+		if len(rest) < 3 {
+			return nil, 0, ErrInvalidProxyV2Header
+		}
+		length := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+length {
+			return nil, 0, ErrInvalidProxyV2Header
+		}
+		if rest[0] == TypeCRC32C {
+			if length != 4 {
+				return nil, 0, ErrInvalidProxyV2Header
+			}
+			crcOffset = size - len(rest) + 3
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: rest[0], Value: bytes.Clone(rest[3 : 3+length])})
+		rest = rest[3+length:]
+	}
+
+	if crcOffset >= 0 {
+		header := bytes.Clone(buf[:size])
+		expected := binary.BigEndian.Uint32(header[crcOffset:])
+		clear(header[crcOffset : crcOffset+4])
+		if crc32.Checksum(header, castagnoli) != expected {
+			return nil, 0, ErrCRC32CMismatch
+		}
+	}
+	return h, size, nil
+}
+
+func decodeUnixPath(path []byte) string {
+	name := string(bytes.TrimRight(path, "\x00"))
+	if strings.HasPrefix(name, "\x00") {
+		name = "@" + name[1:]
+	}
+	return name
+}
+
+// SSLInfo is the value of a TypeSSL TLV.
+type SSLInfo struct {
+	Client byte
+	Verify uint32
+	TLVs   []TLV
+}
+
+func ParseSSL(value []byte) (*SSLInfo, error) {
+	if len(value) < 5 {
+		return nil, ErrInvalidProxyV2Header
+	}
+	info := &SSLInfo{
+		Client: value[0],
+		Verify: binary.BigEndian.Uint32(value[1:5]),
+	}
+	for rest := value[5:]; len(rest) != 0; {
+		if len(rest) < 3 {
+			return nil, ErrInvalidProxyV2Header
+		}
+		length := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+length {
+			return nil, ErrInvalidProxyV2Header
+		}
+		info.TLVs = append(info.TLVs, TLV{Type: rest[0], Value: bytes.Clone(rest[3 : 3+length])})
+		rest = rest[3+length:]
+	}
+	return info, nil
+}
+
+func (s *SSLInfo) Marshal() []byte {
+	buf := []byte{s.Client}
+	buf = binary.BigEndian.AppendUint32(buf, s.Verify)
+	for _, tlv := range s.TLVs {
+		buf = append(buf, tlv.Type)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(tlv.Value)))
+		buf = append(buf, tlv.Value...)
+	}
+	return buf
+}
@@ -0,0 +1,225 @@
+package proxy_v2
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *Header
+	}{
+		{"local", &Header{Command: CommandLocal}},
+		{"tcp4", &Header{
+			Command: CommandProxy,
+			Src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 443},
+			Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 50000},
+		}},
+		{"tcp6", &Header{
+			Command: CommandProxy,
+			Src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			Dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50000},
+		}},
+		{"udp4", &Header{
+			Command: CommandProxy,
+			Src:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53},
+			Dst:     &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 50000},
+		}},
+		{"unix", &Header{
+			Command: CommandProxy,
+			Src:     &net.UnixAddr{Name: "/run/popub/web.sock", Net: "unix"},
+			Dst:     &net.UnixAddr{Name: "@abstract", Net: "unix"},
+		}},
+		{"unixgram", &Header{
+			Command: CommandProxy,
+			Src:     &net.UnixAddr{Name: "/run/a", Net: "unixgram"},
+			Dst:     &net.UnixAddr{Name: "/run/b", Net: "unixgram"},
+		}},
+		{"tlvs", &Header{
+			Command: CommandProxy,
+			Src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 443},
+			Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 50000},
+			TLVs: []TLV{
+				{Type: TypeAuthority, Value: []byte("example.com")},
+				{Type: TypeUniqueID, Value: bytes.Repeat([]byte{1}, MaxUniqueIDSize)},
+				{Type: TypeNoop, Value: []byte{}},
+				{Type: TypePopubTenant, Value: []byte("web")},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.h.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if HeaderSize(buf) != len(buf) {
+				t.Fatalf("HeaderSize = %d, want %d", HeaderSize(buf), len(buf))
+			}
+			got, size, err := ParseHeader(append(buf, "trailing data"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != len(buf) {
+				t.Errorf("size = %d, want %d", size, len(buf))
+			}
+			if !reflect.DeepEqual(got, tt.h) {
+				t.Errorf("got %+v, want %+v", got, tt.h)
+			}
+		})
+	}
+}
+
+func TestHeaderCRC32C(t *testing.T) {
+	h := &Header{
+		Command: CommandProxy,
+		Src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 443},
+		Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 50000},
+		TLVs:    []TLV{{Type: TypeCRC32C}, {Type: TypeAuthority, Value: []byte("example.com")}},
+	}
+	buf, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := ParseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc, _ := got.TLV(TypeCRC32C); bytes.Equal(crc, make([]byte, 4)) {
+		t.Error("checksum not filled in")
+	}
+
+	// Any change of the header is caught, including in the checksum itself.
+	for _, i := range []int{13, 17, 30, len(buf) - 1} {
+		corrupted := bytes.Clone(buf)
+		corrupted[i] ^= 1
+		_, _, err := ParseHeader(corrupted)
+		if err == nil {
+			t.Errorf("byte %d corrupted: no error", i)
+		}
+	}
+	corrupted := bytes.Clone(buf)
+	corrupted[len(buf)-2] ^= 1
+	if _, _, err := ParseHeader(corrupted); !errors.Is(err, ErrCRC32CMismatch) {
+		t.Errorf("TLV corrupted: got %v, want %v", err, ErrCRC32CMismatch)
+	}
+}
+
+func TestParseHeaderInvalid(t *testing.T) {
+	valid, err := (&Header{
+		Command: CommandProxy,
+		Src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 443},
+		Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 50000},
+		TLVs:    []TLV{{Type: TypeAuthority, Value: []byte("example.com")}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// withLength changes the length of the header, without adding data.
+	withLength := func(n int) []byte {
+		buf := bytes.Clone(valid)
+		buf[14], buf[15] = byte(n>>8), byte(n)
+		return buf
+	}
+	modified := func(i int, b byte) []byte {
+		buf := bytes.Clone(valid)
+		buf[i] = b
+		return buf
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"signature only", valid[:12]},
+		{"truncated fixed part", valid[:15]},
+		{"truncated addresses", valid[:20]},
+		{"truncated TLV", valid[:len(valid)-1]},
+		{"length beyond data", withLength(len(valid) - 16 + 1)},
+		{"length up to 64 KiB", withLength(0xffff)},
+		{"length within addresses", withLength(8)},
+		{"length within TLV header", withLength(12 + 2)},
+		{"wrong signature", modified(0, 'x')},
+		{"version 1", modified(12, 0x11)},
+		{"unknown command", modified(12, 0x22)},
+		{"unknown family", modified(13, 0x41)},
+		{"unknown transport", modified(13, 0x13)},
+		{"TLV longer than header", modified(16+12+2, 0xff)},
+		{"CRC32C of wrong size", modified(16+12, TypeCRC32C)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, err := ParseHeader(tt.buf)
+			if err == nil {
+				t.Errorf("got %+v, want an error", h)
+			}
+		})
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 443}
+	tests := []struct {
+		name string
+		h    *Header
+	}{
+		{"unknown command", &Header{Command: 2}},
+		{"source only", &Header{Command: CommandProxy, Src: tcp}},
+		{"mixed families", &Header{Command: CommandProxy, Src: tcp, Dst: &net.UDPAddr{IP: tcp.IP, Port: 53}}},
+		{"mixed Unix sockets", &Header{
+			Command: CommandProxy,
+			Src:     &net.UnixAddr{Name: "/run/a", Net: "unix"},
+			Dst:     &net.UnixAddr{Name: "/run/b", Net: "unixgram"},
+		}},
+		{"Unix path too long", &Header{
+			Command: CommandProxy,
+			Src:     &net.UnixAddr{Name: "/" + string(bytes.Repeat([]byte("a"), unixAddrSize)), Net: "unix"},
+			Dst:     &net.UnixAddr{Name: "/run/b", Net: "unix"},
+		}},
+		{"invalid IP", &Header{Command: CommandProxy, Src: &net.TCPAddr{Port: 443}, Dst: tcp}},
+		{"unique ID too long", &Header{Command: CommandLocal, TLVs: []TLV{{Type: TypeUniqueID, Value: make([]byte, MaxUniqueIDSize+1)}}}},
+		{"TLV too long", &Header{Command: CommandLocal, TLVs: []TLV{{Type: TypeNoop, Value: make([]byte, 0x10000)}}}},
+		{"header too long", &Header{Command: CommandLocal, TLVs: []TLV{
+			{Type: TypeNoop, Value: make([]byte, 0x8000)},
+			{Type: TypeNoop, Value: make([]byte, 0x8000)},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.h.Marshal()
+			if err == nil {
+				t.Errorf("got %x, want an error", buf)
+			}
+		})
+	}
+}
+
+func TestSSLInfo(t *testing.T) {
+	info := &SSLInfo{
+		Client: ClientSSL | ClientCertConn,
+		Verify: 0,
+		TLVs: []TLV{
+			{Type: TypeSSLVersion, Value: []byte("TLSv1.3")},
+			{Type: TypeSSLCN, Value: []byte("client")},
+		},
+	}
+	got, err := ParseSSL(info.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("got %+v, want %+v", got, info)
+	}
+
+	buf := info.Marshal()
+	for _, n := range []int{0, 4, 6, len(buf) - 1} {
+		if _, err := ParseSSL(buf[:n]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", n)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxy_v2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxProxyV1HeaderSize is defined by the PROXY protocol specification.
+const maxProxyV1HeaderSize = 107
+
+var ErrInvalidProxyV1Header = errors.New("invalid PROXY v1 protocol header")
+
+// ReadProxyHeader reads a PROXY v1 or v2 header sent by a load balancer in
+// front of R, without reading anything after it. The client is the source
+// address in the header. A v1 header with UNKNOWN protocol is returned as the
+// LOCAL command.
+func ReadProxyHeader(r io.Reader) (*Header, error) {
+	var buf [maxProxyV1HeaderSize]byte
+	_, err := io.ReadFull(r, buf[:8])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(buf[:8], []byte(signature[:8])):
+		return readProxyV2Header(r, &buf)
+	case bytes.Equal(buf[:6], []byte("PROXY ")):
+		return readProxyV1Header(r, &buf)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+}
+
+func readProxyV1Header(r io.Reader, buf *[maxProxyV1HeaderSize]byte) (*Header, error) {
+	n := 8
+	for !bytes.HasSuffix(buf[:n], []byte("\r\n")) {
+		if n == len(buf) {
+			return nil, ErrInvalidProxyV1Header
+		}
+		_, err := io.ReadFull(r, buf[n:n+1])
+		if err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	fields := strings.Split(string(buf[6:n-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return &Header{Command: CommandLocal}, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrInvalidProxyV1Header
+	}
+	tcp6 := fields[0] == "TCP6"
+	remoteIP, publicIP := parseProxyV1IP(fields[1], tcp6), parseProxyV1IP(fields[2], tcp6)
+	remotePort, err1 := strconv.ParseUint(fields[3], 10, 16)
+	publicPort, err2 := strconv.ParseUint(fields[4], 10, 16)
+	if remoteIP == nil || publicIP == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalidProxyV1Header
+	}
+	return &Header{
+		Command: CommandProxy,
+		Src:     &net.TCPAddr{IP: remoteIP, Port: int(remotePort)},
+		Dst:     &net.TCPAddr{IP: publicIP, Port: int(publicPort)},
+	}, nil
+}
+
+// parseProxyV1IP parses an address in dotted form for TCP4, or in colon
+// form for TCP6, which may be an IPv4-mapped address.
+func parseProxyV1IP(s string, tcp6 bool) net.IP {
+	if strings.Contains(s, ":") != tcp6 {
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+func readProxyV2Header(r io.Reader, buf *[maxProxyV1HeaderSize]byte) (*Header, error) {
+	_, err := io.ReadFull(r, buf[8:16])
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 16+int(binary.BigEndian.Uint16(buf[14:16])))
+	copy(header, buf[:16])
+	_, err = io.ReadFull(r, header[16:])
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := ParseHeader(header)
+	return h, err
+}
@@ -0,0 +1,147 @@
+package proxy_v2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2, err := (&Header{
+		Command: CommandProxy,
+		Src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+		Dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		TLVs:    []TLV{{Type: TypeCRC32C}, {Type: TypeAuthority, Value: []byte("example.com")}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Local, err := (&Header{Command: CommandLocal}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		src   net.Addr
+		dst   net.Addr
+		local bool
+	}{
+		{
+			name:  "v1 TCP4",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.2 50000 443\r\n",
+			src:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			dst:   &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+		},
+		{
+			name:  "v1 TCP6",
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 50000 443\r\n",
+			src:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			dst:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:  "v1 TCP6 IPv4-mapped",
+			input: "PROXY TCP6 ::ffff:192.0.2.1 ::ffff:198.51.100.2 50000 443\r\n",
+			src:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			dst:   &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+		},
+		{
+			name:  "v1 TCP6 mixed",
+			input: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 50000 443\r\n",
+			src:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			dst:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:  "v1 UNKNOWN",
+			input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			local: true,
+		},
+		{
+			name:  "v1 longest",
+			input: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			src:   &net.TCPAddr{IP: net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), Port: 65535},
+			dst:   &net.TCPAddr{IP: net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), Port: 65535},
+		},
+		{
+			name:  "v2",
+			input: string(v2),
+			src:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			dst:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:  "v2 LOCAL",
+			input: string(v2Local),
+			local: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const data = "GET / HTTP/1.1\r\n"
+			r := strings.NewReader(tt.input + data)
+			h, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != data {
+				t.Errorf("data after the header = %q, want %q", rest, data)
+			}
+			if tt.local {
+				if h.Command != CommandLocal {
+					t.Errorf("command = %d, want LOCAL", h.Command)
+				}
+				return
+			}
+			if h.Command != CommandProxy || !reflect.DeepEqual(h.Src, tt.src) || !reflect.DeepEqual(h.Dst, tt.dst) {
+				t.Errorf("got %v %v → %v, want %v → %v", h.Command, h.Src, h.Dst, tt.src, tt.dst)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	v2, err := (&Header{
+		Command: CommandProxy,
+		Src:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 50000},
+		Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 443},
+		TLVs:    []TLV{{Type: TypeCRC32C}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Corrupted := bytes.Clone(v2)
+	v2Corrupted[20] ^= 1
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"no header", "GET / HTTP/1.1\r\n"},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51.100.2 50000"},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.2 50000 443\n"},
+		{"v1 too long", "PROXY TCP6 " + strings.Repeat("0", 100) + " ::1 1 2\r\n"},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 198.51.100.2 50000\r\n"},
+		{"v1 extra field", "PROXY TCP4 192.0.2.1 198.51.100.2 50000 443 1\r\n"},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.2 50000 443\r\n"},
+		{"v1 invalid address", "PROXY TCP4 192.0.2.256 198.51.100.2 50000 443\r\n"},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n"},
+		{"v1 IPv6 in TCP4", "PROXY TCP4 2001:db8::1 198.51.100.2 50000 443\r\n"},
+		{"v1 IPv4 in TCP6", "PROXY TCP6 192.0.2.1 198.51.100.2 50000 443\r\n"},
+		{"v1 IPv4-mapped in TCP4", "PROXY TCP4 ::ffff:192.0.2.1 198.51.100.2 50000 443\r\n"},
+		{"v2 truncated fixed part", string(v2[:12])},
+		{"v2 truncated", string(v2[:len(v2)-1])},
+		{"v2 checksum mismatch", string(v2Corrupted)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ReadProxyHeader(strings.NewReader(tt.input))
+			if err == nil {
+				t.Errorf("got %+v, want an error", h)
+			}
+		})
+	}
+}
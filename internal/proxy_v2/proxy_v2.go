@@ -2,10 +2,11 @@ package proxy_v2
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"time"
 
 	"github.com/m13253/popub/internal/common"
 )
@@ -15,82 +16,156 @@ var (
 	ErrInvalidProxyV2Header  = errors.New("invalid PROXY v2 protocol header")
 )
 
-func EncodeProxyV2Header(conn *net.TCPConn) (buf [256 - common.PacketOverhead]byte) {
-	copy(buf[:13], "\r\n\r\n\x00\r\nQUIT\n!")
-
-	publicAddr := conn.LocalAddr().(*net.TCPAddr)
-	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
-
-	if publicIPv4, remoteIPv4 := publicAddr.IP.To4(), remoteAddr.IP.To4(); len(publicIPv4) == 4 && len(remoteIPv4) == 4 {
-		copy(buf[13:16], []byte{0x11, 0, 12})
-		copy(buf[16:20], publicIPv4)
-		copy(buf[20:24], remoteIPv4)
-		binary.BigEndian.PutUint16(buf[24:26], uint16(publicAddr.Port))
-		binary.BigEndian.PutUint16(buf[26:28], uint16(remoteAddr.Port))
-	} else if publicIPv6, remoteIPv6 := publicAddr.IP.To16(), remoteAddr.IP.To16(); len(publicIPv6) == 16 && len(remoteIPv6) == 16 {
-		copy(buf[13:16], []byte{0x21, 0, 36})
-		copy(buf[16:32], publicIPv6)
-		copy(buf[32:48], remoteIPv6)
-		binary.BigEndian.PutUint16(buf[48:50], uint16(publicAddr.Port))
-		binary.BigEndian.PutUint16(buf[50:52], uint16(remoteAddr.Port))
-	} else {
-		panic(fmt.Sprintf("invalid IP address: [%s, %s]", publicAddr, remoteAddr))
+const (
+	// AcceptPayloadSize is the size of the accept payload sent from R to L.
+	// Headers that do not fit are sent in a larger payload instead.
+	AcceptPayloadSize = 256 - common.PacketOverhead
+
+	// MaxAcceptPayloadSize leaves room for the header of a multiplexed
+	// frame.
+	MaxAcceptPayloadSize = common.MaxBodySize - 5
+)
+
+// NewAcceptHeader returns the header sent from R to L for a connection. Note
+// that R's public endpoint is the source address, and the client is the
+// destination address.
+func NewAcceptHeader(publicAddr, remoteAddr net.Addr, tlvs []TLV) *Header {
+	return &Header{
+		Command: CommandProxy,
+		Src:     publicAddr,
+		Dst:     remoteAddr,
+		TLVs:    tlvs,
 	}
-	return
 }
 
-func ExtractProxyV2Header(buf []byte) []byte {
-	// We ignore all errors. They will be checked later in DecodeProxyV2Header
-	if len(buf) < 16 {
-		return bytes.Clone(buf)
+// AcceptAddrs returns the addresses in a header created by NewAcceptHeader.
+func (h *Header) AcceptAddrs() (publicAddr, remoteAddr net.Addr) {
+	return h.Src, h.Dst
+}
+
+// EncodeAcceptPayload encodes the header, padded with zeros to
+// AcceptPayloadSize.
+func EncodeAcceptPayload(h *Header) ([]byte, error) {
+	header, err := h.Marshal()
+	if err != nil {
+		return nil, err
 	}
-	headerLen := int(binary.BigEndian.Uint16(buf[14:16])) + 16
-	if len(buf) < headerLen {
-		return bytes.Clone(buf)
+	if len(header) > MaxAcceptPayloadSize {
+		return nil, fmt.Errorf("PROXY v2 header too long: %d bytes", len(header))
 	}
-	return bytes.Clone(buf[:headerLen])
+	payload := make([]byte, max(len(header), AcceptPayloadSize))
+	copy(payload, header)
+	return payload, nil
 }
 
-func DecodeProxyV2Header(header []byte) (publicAddr, remoteAddr *net.TCPAddr, err error) {
-	if len(header) < 16 || !bytes.Equal(header[:13], []byte("\r\n\r\n\x00\r\nQUIT\n!")) {
-		return nil, nil, ErrInvalidProxyV2Header
+func ExtractProxyV2Header(buf []byte) []byte {
+	// We ignore all errors. They will be checked later in DecodeProxyV2Header
+	if size := HeaderSize(buf); size != 0 {
+		return bytes.Clone(buf[:size])
 	}
-	addrFamily := header[13]
-	bodyLen := binary.BigEndian.Uint16(header[14:16])
-	switch addrFamily {
-	case 0x11:
-		if len(header) < 28 {
-			return nil, nil, ErrInvalidProxyV2Header
-		}
-		if bodyLen < 12 {
-			return nil, nil, ErrInvalidProxyV2Address
-		}
-		publicAddr = &net.TCPAddr{
-			IP:   net.IPv4(header[16], header[17], header[18], header[19]),
-			Port: int(binary.BigEndian.Uint16(header[24:26])),
-		}
-		remoteAddr = &net.TCPAddr{
-			IP:   net.IPv4(header[20], header[21], header[22], header[23]),
-			Port: int(binary.BigEndian.Uint16(header[26:28])),
-		}
-		return
-	case 0x21:
-		if len(header) < 52 {
-			return nil, nil, ErrInvalidProxyV2Header
-		}
-		if bodyLen < 36 {
-			return nil, nil, ErrInvalidProxyV2Address
-		}
-		publicAddr = &net.TCPAddr{
-			IP:   bytes.Clone(header[16:32]),
-			Port: int(binary.BigEndian.Uint16(header[48:50])),
+	return bytes.Clone(buf)
+}
+
+// ReadAccept waits on an idle relay link in classic mode, answering pings,
+// until R hands off a connection. The handoff is acknowledged, and the header
+// sent along with it is returned.
+func ReadAccept(conn net.Conn, send, recv *common.CipherState) (*Header, error) {
+	var buf [common.MaxPacketSize]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(common.ExtendedNetworkTimeout))
+		packet, err := common.ReadPacket(conn, recv, buf[:])
+		if err != nil {
+			return nil, err
 		}
-		remoteAddr = &net.TCPAddr{
-			IP:   bytes.Clone(header[32:48]),
-			Port: int(binary.BigEndian.Uint16(header[50:52])),
+
+		if bytes.HasPrefix(packet, []byte{0}) {
+			_ = conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			err = common.WritePacket(conn, (&[256 - common.PacketOverhead]byte{})[:], send, buf[:])
+			if err != nil {
+				return nil, err
+			}
+
+		} else if bytes.HasPrefix(packet, []byte{0xd}) {
+			proxyHeader := ExtractProxyV2Header(packet)
+
+			_ = conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			err = common.WritePacket(conn, (&[256 - common.PacketOverhead]byte{0xd})[:], send, buf[:])
+			if err != nil {
+				return nil, err
+			}
+			_ = conn.SetDeadline(time.Time{})
+
+			return DecodeAcceptPayload(proxyHeader)
 		}
-		return
+	}
+}
+
+// DecodeAcceptPayload decodes the header sent from R to L.
+func DecodeAcceptPayload(payload []byte) (*Header, error) {
+	h, _, err := ParseHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	if h.Src == nil {
+		return nil, ErrInvalidProxyV2Address
+	}
+	return h, nil
+}
+
+// DecodeProxyV2Header decodes the addresses in the header sent from R to L.
+// It returns *net.TCPAddr or *net.UDPAddr depending on the transport protocol
+// in the header.
+func DecodeProxyV2Header(header []byte) (publicAddr, remoteAddr net.Addr, err error) {
+	h, err := DecodeAcceptPayload(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicAddr, remoteAddr = h.AcceptAddrs()
+	return
+}
+
+// EncodeProxyV1 encodes a PROXY v1 header to be sent to an application. Unlike
+// the header exchanged between L and R, the client is the source address.
+func EncodeProxyV1(publicAddr, remoteAddr net.Addr) []byte {
+	publicIP, publicPort, ok1 := splitAddr(publicAddr)
+	remoteIP, remotePort, ok2 := splitAddr(remoteAddr)
+	if !ok1 || !ok2 {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if publicIP.To4() != nil && remoteIP.To4() != nil {
+		return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", remoteIP.To4(), publicIP.To4(), remotePort, publicPort)
+	}
+	// An IPv4 address is written as IPv4-mapped in a TCP6 header.
+	publicIP6, remoteIP6 := netip.AddrFrom16([16]byte(publicIP.To16())), netip.AddrFrom16([16]byte(remoteIP.To16()))
+	return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", remoteIP6, publicIP6, remotePort, publicPort)
+}
+
+// EncodeProxyV2 encodes a PROXY v2 header to be sent to an application. Unlike
+// the header exchanged between L and R, the client is the source address.
+// The TLVs are passed along, and addresses that cannot be represented are
+// sent as AF_UNSPEC.
+func EncodeProxyV2(publicAddr, remoteAddr net.Addr, tlvs []TLV) ([]byte, error) {
+	h := &Header{
+		Command: CommandProxy,
+		Src:     remoteAddr,
+		Dst:     publicAddr,
+		TLVs:    tlvs,
+	}
+	header, err := h.Marshal()
+	if errors.Is(err, ErrInvalidProxyV2Address) {
+		h.Src, h.Dst = nil, nil
+		header, err = h.Marshal()
+	}
+	return header, err
+}
+
+func splitAddr(addr net.Addr) (ip net.IP, port int, ok bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, addr.IP.To16() != nil
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, addr.IP.To16() != nil
 	default:
-		return nil, nil, ErrInvalidProxyV2Address
+		return nil, 0, false
 	}
 }
@@ -0,0 +1,132 @@
+package proxy_v2
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAcceptPayload(t *testing.T) {
+	publicAddr := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 443}
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 50000}
+	tests := []struct {
+		name string
+		tlvs []TLV
+		size int
+	}{
+		{"small", []TLV{{Type: TypeUniqueID, Value: make([]byte, 16)}}, AcceptPayloadSize},
+		{"large", []TLV{{Type: TypeAuthority, Value: bytes.Repeat([]byte("a"), 1000)}}, 16 + 12 + 3 + 1000},
+		{"largest", []TLV{{Type: TypeNoop, Value: make([]byte, MaxAcceptPayloadSize-16-12-3)}}, MaxAcceptPayloadSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := EncodeAcceptPayload(NewAcceptHeader(publicAddr, remoteAddr, tt.tlvs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(payload) != tt.size {
+				t.Errorf("payload size = %d, want %d", len(payload), tt.size)
+			}
+			h, err := DecodeAcceptPayload(ExtractProxyV2Header(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotPublic, gotRemote := h.AcceptAddrs()
+			if !reflect.DeepEqual(gotPublic, publicAddr) || !reflect.DeepEqual(gotRemote, remoteAddr) {
+				t.Errorf("got %v ← %v, want %v ← %v", gotPublic, gotRemote, publicAddr, remoteAddr)
+			}
+			if !reflect.DeepEqual(h.TLVs, tt.tlvs) {
+				t.Errorf("TLVs = %v, want %v", h.TLVs, tt.tlvs)
+			}
+		})
+	}
+
+	_, err := EncodeAcceptPayload(NewAcceptHeader(publicAddr, remoteAddr, []TLV{{Type: TypeNoop, Value: make([]byte, MaxAcceptPayloadSize-16-12-2)}}))
+	if err == nil {
+		t.Error("oversized payload: no error")
+	}
+	local, err := (&Header{Command: CommandLocal}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeAcceptPayload(local); err == nil {
+		t.Error("payload without addresses: no error")
+	}
+}
+
+func TestEncodeProxyV1(t *testing.T) {
+	tests := []struct {
+		name       string
+		publicAddr net.Addr
+		remoteAddr net.Addr
+		want       string
+	}{
+		{
+			"TCP4",
+			&net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			"PROXY TCP4 192.0.2.1 198.51.100.2 50000 443\r\n",
+		},
+		{
+			"TCP6",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 50000 443\r\n",
+		},
+		{
+			"mixed",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000},
+			"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 50000 443\r\n",
+		},
+		{
+			"Unix socket",
+			&net.UnixAddr{Name: "/run/popub/web.sock", Net: "unix"},
+			&net.UnixAddr{Name: "@", Net: "unix"},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(EncodeProxyV1(tt.publicAddr, tt.remoteAddr)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeProxyV2(t *testing.T) {
+	publicAddr := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2).To4(), Port: 443}
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 50000}
+	tlvs := []TLV{{Type: TypeCRC32C, Value: make([]byte, 4)}, {Type: TypePopubTenant, Value: []byte("web")}}
+	header, err := EncodeProxyV2(publicAddr, remoteAddr, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := ParseHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client is the source address for applications.
+	if !reflect.DeepEqual(h.Src, remoteAddr) || !reflect.DeepEqual(h.Dst, publicAddr) {
+		t.Errorf("got %v → %v, want %v → %v", h.Src, h.Dst, remoteAddr, publicAddr)
+	}
+	if value, _ := h.TLV(TypePopubTenant); string(value) != "web" {
+		t.Errorf("tenant TLV = %q, want %q", value, "web")
+	}
+
+	// Addresses which cannot be represented are sent as AF_UNSPEC.
+	unix := &net.UnixAddr{Name: "/run/popub/web.sock", Net: "unix"}
+	header, err = EncodeProxyV2(unix, remoteAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err = ParseHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Command != CommandProxy || h.Src != nil || h.Dst != nil {
+		t.Errorf("got %v %v → %v, want AF_UNSPEC", h.Command, h.Src, h.Dst)
+	}
+}
@@ -0,0 +1,17 @@
+package systemd
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reloading returns the states telling the service manager that the
+// configuration is being reloaded.
+func Reloading() []string {
+	var ts unix.Timespec
+	if unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts) != nil {
+		return []string{"RELOADING=1"}
+	}
+	return []string{"RELOADING=1", "MONOTONIC_USEC=" + strconv.FormatInt(ts.Nano()/1000, 10)}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package systemd
+
+// Reloading returns the states telling the service manager that the
+// configuration is being reloaded.
+func Reloading() []string {
+	return []string{"RELOADING=1"}
+}
@@ -0,0 +1,167 @@
+// Package systemd implements the parts of the systemd service protocol used by
+// popub: readiness and status notification, the watchdog, and socket
+// activation. Without systemd, they do nothing.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusInterval is how often Run updates the status, when the watchdog does
+// not ask for more.
+const statusInterval = 5 * time.Second
+
+// Notify sends state lines, such as "READY=1", to the service manager.
+func Notify(states ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "@") {
+		return fmt.Errorf("unsupported NOTIFY_SOCKET: %q", path)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+// watchdogInterval returns the watchdog timeout requested by the service
+// manager, or 0 if it is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Run sends watchdog heartbeats, and the status returned by status whenever it
+// changes, until ctx is done.
+func Run(ctx context.Context, status func() string) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	interval := statusInterval
+	watchdog := watchdogInterval()
+	if watchdog != 0 {
+		interval = min(interval, watchdog/2)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		var states []string
+		if watchdog != 0 {
+			states = append(states, "WATCHDOG=1")
+		}
+		if s := status(); s != last {
+			states = append(states, "STATUS="+s)
+			last = s
+		}
+		if len(states) != 0 {
+			_ = Notify(states...)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var (
+	activationOnce sync.Once
+	activated      map[string][]*os.File
+)
+
+// activatedFiles returns the sockets passed by socket activation, keyed by
+// their FileDescriptorName, and clears the environment variables so that
+// they are not passed on. The sockets are kept open, so that a listener
+// closed on reload can be opened again.
+func activatedFiles() map[string][]*os.File {
+	activationOnce.Do(func() {
+		activated = make(map[string][]*os.File)
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := range n {
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			// The first passed file descriptor is always 3.
+			activated[name] = append(activated[name], os.NewFile(uintptr(3+i), name))
+		}
+	})
+	return activated
+}
+
+func activatedFile(name string) (*os.File, error) {
+	files := activatedFiles()[name]
+	switch len(files) {
+	case 0:
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	case 1:
+		return files[0], nil
+	default:
+		return nil, fmt.Errorf("%d sockets named %q passed by systemd, expected one", len(files), name)
+	}
+}
+
+// Listener returns the stream socket named name, passed by socket
+// activation. Each call returns a new listener on the same socket.
+func Listener(name string) (net.Listener, error) {
+	f, err := activatedFile(name)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q passed by systemd: %w", name, err)
+	}
+	return l, nil
+}
+
+// UDPConn returns the UDP socket named name, passed by socket activation.
+// Each call returns a new connection on the same socket.
+func UDPConn(name string) (*net.UDPConn, error) {
+	f, err := activatedFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket %q passed by systemd: %w", name, err)
+	}
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("socket %q passed by systemd: not a UDP socket", name)
+	}
+	return conn, nil
+}
@@ -0,0 +1,412 @@
+// Package popub publishes a service through a popub relay from within a Go
+// program, without running popub-local and connecting to it over localhost.
+package popub
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/mux"
+	"github.com/m13253/popub/internal/proxy_v2"
+)
+
+// Credentials authorize the listener to the relay.
+type Credentials struct {
+	// Passphrase is the passphrase of the relay, or of one of its tenants,
+	// or a key generated by popub keygen. It may be empty if the tenant
+	// authorizes by Identity or SSHKey alone.
+	Passphrase string
+	// PassphraseParams are the salt and Argon2 parameters generated by
+	// popub keygen -params. The default is the fixed ones of earlier versions.
+	PassphraseParams string
+	// Identity is the private identity key generated by popub keygen
+	// -identity, which is sent to the relay if not empty.
+	Identity string
+	// SSHKey is the file of an OpenSSH private key, sent to the relay instead
+	// of Identity. With SSHAgent, it is the public key of the key to use
+	// from the agent, or the first key of the agent if empty.
+	SSHKey string
+	// SSHAgent is the socket of an SSH agent, such as $SSH_AUTH_SOCK.
+	SSHAgent string
+	// RelayKey is the public relay key printed by popub-relay. If it is set,
+	// a relay without that key is refused.
+	RelayKey string
+	// KnownRelays is a file of relay keys, used when RelayKey is empty. The
+	// key of a relay not in the file yet is added to it, and a relay with
+	// another key is refused.
+	KnownRelays string
+}
+
+// Options configure a listener. The zero value is the same as popub-local
+// with default settings.
+type Options struct {
+	// Mux carries all connections over a single multiplexed relay link.
+	Mux bool
+
+	// Idle is the number of idle relay links waiting at the relay when Mux
+	// is not set. The default is 1.
+	Idle int
+
+	// PublicPort asks the relay to open a public port, which is a port
+	// number, a range such as "20000-20999", or "any".
+	PublicPort string
+
+	// Dial connects to the relay. The default dials a TCP address, or a Unix
+	// socket with the "unix:" prefix.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Logger receives the same messages as popub-local prints. The default
+	// discards them.
+	Logger *log.Logger
+}
+
+// Listen connects to the relay at relayAddr and returns a listener whose
+// Accept yields the connections handed off by the relay. The first relay
+// link is authorized before Listen returns, so that a wrong address or
+// passphrase is reported immediately. Later failures are retried in the
+// background. The listener is closed when ctx is done.
+func Listen(ctx context.Context, relayAddr string, credentials Credentials, opts *Options) (net.Listener, error) {
+	l := &listener{
+		relayAddr: relayAddr,
+		conns:     make(chan net.Conn),
+		links:     make(map[io.Closer]struct{}),
+	}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.Idle <= 0 {
+		l.opts.Idle = 1
+	}
+	if l.opts.Dial == nil {
+		l.opts.Dial = dialRelay
+	}
+	l.log = l.opts.Logger
+	if l.log == nil {
+		l.log = log.New(io.Discard, "", 0)
+	}
+	if l.opts.PublicPort != "" {
+		r, err := bind.ParseRange(l.opts.PublicPort)
+		if err != nil {
+			return nil, err
+		}
+		l.publicPort = r
+		_, _ = rand.Read(l.token[:])
+	}
+	authKey, err := common.PassphraseToPSK(credentials.Passphrase, credentials.PassphraseParams)
+	if err != nil {
+		return nil, err
+	}
+	l.authKey = authKey
+	if credentials.Identity != "" {
+		l.keys.Identity, err = common.ParseIdentity(credentials.Identity)
+		if err != nil {
+			return nil, err
+		}
+	} else if credentials.SSHKey != "" || credentials.SSHAgent != "" {
+		l.keys.SignSSH, err = common.SSHSigner(credentials.SSHKey, credentials.SSHAgent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.keys.CheckRelay, err = common.RelayKeyChecker(credentials.RelayKey, credentials.KnownRelays, relayAddr, l.log)
+	if err != nil {
+		return nil, err
+	}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+
+	hello := byte(0)
+	if l.opts.Mux {
+		hello = mux.PacketHello
+	}
+	first, err := l.handshake(hello)
+	if err != nil {
+		l.cancel()
+		return nil, err
+	}
+
+	go func() {
+		<-l.ctx.Done()
+		l.closeLinks()
+	}()
+	if l.opts.Mux {
+		go l.runMux(first)
+	} else {
+		go l.runWorker(first)
+		for range l.opts.Idle - 1 {
+			go l.runWorker(nil)
+		}
+	}
+	return l, nil
+}
+
+func dialRelay(ctx context.Context, addr string) (net.Conn, error) {
+	network, address := common.SplitNetwork(addr)
+	d := net.Dialer{Timeout: common.NetworkTimeout}
+	return d.DialContext(ctx, network, address)
+}
+
+type listener struct {
+	relayAddr  string
+	authKey    []byte
+	keys       common.ClientKeys
+	opts       Options
+	publicPort bind.Range
+	token      bind.Token
+	log        *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  chan net.Conn
+
+	mu         sync.Mutex
+	publicAddr string
+	links      map[io.Closer]struct{}
+}
+
+// relayLink is an authorized connection to the relay.
+type relayLink struct {
+	conn net.Conn
+	send *common.CipherState
+	recv *common.CipherState
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, &net.OpError{Op: "accept", Net: "popub", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting connections and closes the idle relay links. In
+// multiplexed mode, connections already accepted are closed as well, since
+// they share the relay link.
+func (l *listener) Close() error {
+	l.cancel()
+	l.closeLinks()
+	return nil
+}
+
+// Addr returns the public address assigned by the relay, or the public
+// address of the last accepted connection. Before either is known, it returns
+// the relay address.
+func (l *listener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.publicAddr != "" {
+		return addr(l.publicAddr)
+	}
+	return addr(l.relayAddr)
+}
+
+// addr is the address of a listener, which is not necessarily an IP address.
+type addr string
+
+func (a addr) Network() string {
+	return "popub"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+func (l *listener) setPublicAddr(publicAddr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if publicAddr != l.publicAddr {
+		l.publicAddr = publicAddr
+		l.log.Println("public address:", publicAddr)
+	}
+}
+
+// track registers an idle link or a session to be closed along with the
+// listener. It returns false if the listener is already closed.
+func (l *listener) track(c io.Closer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ctx.Err() != nil {
+		return false
+	}
+	l.links[c] = struct{}{}
+	return true
+}
+
+func (l *listener) untrack(c io.Closer) {
+	l.mu.Lock()
+	delete(l.links, c)
+	l.mu.Unlock()
+}
+
+func (l *listener) closeLinks() {
+	l.mu.Lock()
+	links := l.links
+	l.links = make(map[io.Closer]struct{})
+	l.mu.Unlock()
+	for c := range links {
+		_ = c.Close()
+	}
+}
+
+func (l *listener) handshake(hello byte) (*relayLink, error) {
+	conn, err := l.opts.Dial(l.ctx, l.relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(l.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	link := &relayLink{conn: conn}
+	link.send, link.recv, err = common.ClientHandshake(conn, l.authKey, l.keys)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.log.Println("authorized:", conn.LocalAddr(), "→", conn.RemoteAddr())
+
+	if l.opts.PublicPort != "" {
+		publicAddr, err := bind.Request(conn, l.token, l.publicPort, link.send, link.recv)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		l.setPublicAddr(publicAddr)
+	}
+
+	var buf [common.MaxPacketSize]byte
+	_ = conn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	err = common.WritePacket(conn, (&[256 - common.PacketOverhead]byte{hello, common.FeatureRekey})[:], link.send, buf[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return link, nil
+}
+
+// hand passes an accepted connection to Accept, or closes it if the listener
+// is closed first.
+func (l *listener) hand(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+// runWorker keeps one idle relay link waiting at the relay in classic mode,
+// starting with link if it is not nil.
+func (l *listener) runWorker(link *relayLink) {
+	d := backoff.NewWithContext(l.ctx, l.log)
+	for l.ctx.Err() == nil {
+		var err error
+		if link == nil {
+			link, err = l.handshake(0)
+		}
+		if err == nil {
+			// Starting here, network error no longer increases the backoff
+			// counter.
+			l.waitAccept(link)
+			link = nil
+		}
+		if l.ctx.Err() != nil {
+			return
+		}
+		d.ProcessError(err)
+	}
+}
+
+func (l *listener) waitAccept(link *relayLink) {
+	if !l.track(link.conn) {
+		link.conn.Close()
+		return
+	}
+	h, err := proxy_v2.ReadAccept(link.conn, link.send, link.recv)
+	l.untrack(link.conn)
+	if err != nil {
+		link.conn.Close()
+		if l.ctx.Err() == nil {
+			l.log.Println(err)
+		}
+		return
+	}
+	publicAddr, remoteAddr := h.AcceptAddrs()
+	l.log.Println("accept:", publicAddr, "←", remoteAddr)
+	if publicAddr != nil {
+		l.setPublicAddr(publicAddr.String())
+	}
+	go l.hand(newTunnelConn(link, publicAddr, remoteAddr))
+}
+
+// runMux keeps a multiplexed session with the relay, starting with link.
+func (l *listener) runMux(link *relayLink) {
+	d := backoff.NewWithContext(l.ctx, l.log)
+	for l.ctx.Err() == nil {
+		var err error
+		if link == nil {
+			link, err = l.handshake(mux.PacketHello)
+		}
+		if err == nil {
+			// Starting here, network error no longer increases the backoff
+			// counter.
+			l.serveMux(link)
+			link = nil
+		}
+		if l.ctx.Err() != nil {
+			return
+		}
+		d.ProcessError(err)
+	}
+}
+
+func (l *listener) serveMux(link *relayLink) {
+	sess := mux.NewSession(link.conn, link.send, link.recv, false, l.log)
+	if !l.track(sess) {
+		_ = sess.Close()
+		return
+	}
+	defer l.untrack(sess)
+
+	go func() {
+		// UDP flows are not supported by the listener.
+		for {
+			f, err := sess.AcceptFlow()
+			if err != nil {
+				return
+			}
+			l.log.Printf("rejecting UDP flow %d: not supported", f.ID())
+			_ = f.Close()
+		}
+	}()
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			if !errors.Is(err, mux.ErrSessionClosed) {
+				l.log.Println("multiplexed session closed:", err)
+			}
+			return
+		}
+		h, err := proxy_v2.DecodeAcceptPayload(st.Header())
+		if err != nil {
+			st.Reset()
+			l.log.Println(err)
+			continue
+		}
+		publicAddr, remoteAddr := h.AcceptAddrs()
+		l.log.Printf("accept: %s ← %s (stream %d)", publicAddr, remoteAddr, st.ID())
+		if publicAddr != nil {
+			l.setPublicAddr(publicAddr.String())
+		}
+		go l.hand(&streamConn{Stream: st, localAddr: publicAddr, remoteAddr: remoteAddr})
+	}
+}
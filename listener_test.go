@@ -0,0 +1,270 @@
+package popub
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/mux"
+	"github.com/m13253/popub/internal/proxy_v2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// fakeRelay authorizes relay links like popub-relay, and passes them to the
+// test along with the mode requested by the listener.
+type fakeRelay struct {
+	ln      net.Listener
+	authKey []byte
+	links   chan *fakeLink
+}
+
+type fakeLink struct {
+	relayLink
+	hello byte
+}
+
+func newFakeRelay(t *testing.T, passphrase string) *fakeRelay {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey, err := common.PassphraseToPSK(passphrase, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRelay{
+		ln:      ln,
+		authKey: authKey,
+		links:   make(chan *fakeLink, 16),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go r.auth(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRelay) addr() string {
+	return r.ln.Addr().String()
+}
+
+func (r *fakeRelay) auth(conn net.Conn) {
+	pubkey, nonce, err := common.ReadX25519(conn, r.authKey, &[chacha20poly1305.NonceSizeX]byte{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	psk, err := privkey.ECDH(pubkey)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	link := &fakeLink{relayLink: relayLink{conn: conn}}
+	link.send, link.recv, err = common.NewCipherStates(psk, true)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if _, err = common.WriteX25519(conn, privkey.PublicKey(), r.authKey, &nonce); err != nil {
+		conn.Close()
+		return
+	}
+	var buf [common.MaxRecvBufferSize]byte
+	packet, err := common.ReadPacket(conn, link.recv, buf[:])
+	if err != nil || len(packet) < 2 {
+		conn.Close()
+		return
+	}
+	link.hello = packet[0]
+	if packet[1]&common.FeatureRekey != 0 {
+		link.send.EnableRekey()
+	}
+	r.links <- link
+}
+
+// nextLink waits for the next relay link authorized by the fake relay.
+func (r *fakeRelay) nextLink(t *testing.T) *fakeLink {
+	t.Helper()
+	select {
+	case link := <-r.links:
+		return link
+	case <-time.After(5 * time.Second):
+		t.Fatal("no relay link")
+		return nil
+	}
+}
+
+// handOff passes a public connection to the listener on a classic link, and
+// returns the relay side of it.
+func (link *fakeLink) handOff(t *testing.T, payload []byte) io.ReadWriter {
+	t.Helper()
+	var buf [common.MaxRecvBufferSize]byte
+	if err := common.WritePacket(link.conn, payload, link.send, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := common.ReadPacket(link.conn, link.recv, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(ack, []byte{0xd}) {
+		t.Fatalf("handoff acknowledged with %x", ack[:1])
+	}
+	return newTunnelConn(&link.relayLink, nil, nil)
+}
+
+func TestListener(t *testing.T) {
+	publicAddr := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1).To4(), Port: 443}
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 50000}
+	payload, err := proxy_v2.EncodeAcceptPayload(proxy_v2.NewAcceptHeader(publicAddr, remoteAddr, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		mux   bool
+		hello byte
+	}{
+		{"classic", false, 0},
+		{"mux", true, mux.PacketHello},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newFakeRelay(t, "secret")
+			l, err := Listen(context.Background(), relay.addr(), Credentials{Passphrase: "secret"}, &Options{Mux: tt.mux})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			link := relay.nextLink(t)
+			if link.hello != tt.hello {
+				t.Fatalf("mode %#x, want %#x", link.hello, tt.hello)
+			}
+
+			var stream io.ReadWriter
+			if tt.mux {
+				sess := mux.NewSession(link.conn, link.send, link.recv, true, log.New(io.Discard, "", 0))
+				defer sess.Close()
+				stream, err = sess.Open(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				stream = link.handOff(t, payload)
+			}
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if conn.RemoteAddr().String() != remoteAddr.String() {
+				t.Errorf("remote address %v, want %v", conn.RemoteAddr(), remoteAddr)
+			}
+			if conn.LocalAddr().String() != publicAddr.String() {
+				t.Errorf("local address %v, want %v", conn.LocalAddr(), publicAddr)
+			}
+			if l.Addr().String() != publicAddr.String() {
+				t.Errorf("listener address %v, want %v", l.Addr(), publicAddr)
+			}
+
+			if _, err := stream.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			expectRead(t, conn, "request")
+			if _, err := conn.Write([]byte("response")); err != nil {
+				t.Fatal(err)
+			}
+			expectRead(t, stream, "response")
+
+			// Classic mode keeps an idle link waiting for the next connection.
+			if !tt.mux {
+				relay.nextLink(t)
+			}
+		})
+	}
+}
+
+func expectRead(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+	buf := make([]byte, len(want))
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		n += m
+	}
+	if string(buf) != want {
+		t.Errorf("read %q, want %q", buf, want)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	for _, useMux := range []bool{false, true} {
+		relay := newFakeRelay(t, "secret")
+		l, err := Listen(context.Background(), relay.addr(), Credentials{Passphrase: "secret"}, &Options{Mux: useMux, Idle: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay.nextLink(t)
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := l.Accept()
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("mux=%v: Accept after Close returned %v, %v, want net.ErrClosed", useMux, conn, err)
+		}
+	}
+}
+
+func TestListenerContext(t *testing.T) {
+	relay := newFakeRelay(t, "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := Listen(ctx, relay.addr(), Credentials{Passphrase: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := relay.nextLink(t)
+	cancel()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after cancel returned %v, want net.ErrClosed", err)
+	}
+	// The idle link is closed along with the listener.
+	_ = link.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := link.conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("idle link still open: %v", err)
+	}
+}
+
+func TestListenWrongPassphrase(t *testing.T) {
+	relay := newFakeRelay(t, "secret")
+	l, err := Listen(context.Background(), relay.addr(), Credentials{Passphrase: "wrong"}, nil)
+	if err == nil {
+		l.Close()
+		t.Fatal("Listen succeeded with a wrong passphrase")
+	}
+}
@@ -0,0 +1,1087 @@
+package popub
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/drain"
+	"github.com/m13253/popub/internal/mux"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Reasons passed to RelayHooks.ConnRejected, in addition to errors reading
+// the PROXY header of a load balancer.
+var (
+	ErrQueueFull    = errors.New("queue full")
+	ErrQueueTimeout = errors.New("queue timeout")
+	ErrRelayClosed  = errors.New("relay closed")
+)
+
+// TenantConfig holds the settings of one tenant of a relay. Zero values are
+// replaced by the same defaults as popub-relay uses.
+type TenantConfig struct {
+	// Passphrase is shared with popub-local. Each tenant must have a
+	// different one. It may also be a key generated by popub keygen. It may
+	// be empty with RequireIdentity, as popub-local is then authorized by
+	// its key alone.
+	Passphrase string
+	// PassphraseParams are the salt and Argon2 parameters generated by
+	// popub keygen -params, also shared with popub-local. The default is the
+	// fixed ones of earlier versions.
+	PassphraseParams string
+	// Keys are additional passphrases of the tenant, keyed by name, which
+	// are accepted as well, so that passphrases can be rotated without
+	// updating every popub-local at once.
+	Keys map[string]TenantKey
+	// RelayKey is the private identity key generated by popub keygen
+	// -identity, whose public key popub-local may pin, so that others
+	// knowing the passphrase cannot impersonate the relay.
+	RelayKey string
+
+	// PublicProxy expects a PROXY v1 or v2 header from a load balancer at the
+	// start of each public connection, from peers in PublicProxyTrusted, or
+	// on Unix sockets. Other peers are refused, as they could forge their
+	// address.
+	PublicProxy        bool
+	PublicProxyTrusted []netip.Prefix
+	PublicProxyTimeout time.Duration
+
+	QueueSize    int
+	QueueTimeout time.Duration
+	// QueueFallback is the action on public connections that cannot be
+	// served: "rst", "close", or "response", which sends QueueResponse.
+	QueueFallback string
+	QueueResponse []byte
+
+	UDPTimeout time.Duration
+
+	// BindPorts are the public ports popub-local may ask for, such as
+	// "20000-20999".
+	BindPorts []string
+	BindMax   int
+	BindHost  string
+	// BindLinger is how long a requested port stays open after its last
+	// relay link is gone. A negative value closes it at once.
+	BindLinger time.Duration
+
+	// RequireIdentity only accepts popub-local with one of AuthorizedKeys as
+	// its identity or SSH key, in addition to the passphrase. Without it,
+	// identities are optional, and unknown ones are logged by their public
+	// key.
+	RequireIdentity bool
+	AuthorizedKeys  []AuthorizedKey
+}
+
+func (c *TenantConfig) setDefaults() {
+	if c.PublicProxyTimeout == 0 {
+		c.PublicProxyTimeout = 10 * time.Second
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 1024
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = 30 * time.Second
+	}
+	if c.QueueFallback == "" {
+		c.QueueFallback = "close"
+	}
+	if c.UDPTimeout == 0 {
+		c.UDPTimeout = 60 * time.Second
+	}
+	if c.BindMax == 0 {
+		c.BindMax = 4
+	}
+	if c.BindLinger == 0 {
+		c.BindLinger = 30 * time.Second
+	}
+}
+
+// RelayConfig configures a Relay.
+type RelayConfig struct {
+	// Tenants are keyed by name. The tenant named "" is the top-level tenant,
+	// which serves the public listener passed to Serve.
+	Tenants map[string]TenantConfig
+
+	Hooks RelayHooks
+
+	// Logger receives the same messages as popub-relay prints. The default
+	// discards them.
+	Logger *log.Logger
+}
+
+// RelayHooks are called on events of a relay, to make authorization
+// decisions or to collect metrics. Any of them may be nil. They are called
+// synchronously, so they should return quickly.
+type RelayHooks struct {
+	// Authorize is called when a popub-local proves that it knows the
+	// passphrase of a tenant, and owns its identity key, if any. Returning an
+	// error refuses it.
+	Authorize func(link LinkInfo) error
+
+	// LinkUp is called when a relay link starts waiting for connections.
+	// LinkDown is called when it stops, either because it failed, or in
+	// classic mode, because it was handed a connection.
+	LinkUp   func(link LinkInfo)
+	LinkDown func(link LinkInfo)
+
+	// ConnQueued is called when a public connection starts waiting for a
+	// relay link, and ConnAccepted when it is handed to one.
+	ConnQueued   func(conn ConnInfo)
+	ConnAccepted func(conn ConnInfo)
+
+	// ConnRejected is called when a public connection cannot be served.
+	ConnRejected func(conn ConnInfo, reason error)
+
+	// ConnClosed is called when an accepted connection is finished.
+	ConnClosed func(conn ConnInfo, stats ConnStats)
+}
+
+// LinkInfo describes a connection from popub-local.
+type LinkInfo struct {
+	Tenant string
+	// Identity is the name of the authorized key of popub-local, its public
+	// key if it is not authorized, or "" if it has no identity.
+	Identity string
+	// Key is the name of the key in TenantConfig.Keys popub-local used, or
+	// "" for the passphrase of the tenant.
+	Key        string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// ConnInfo describes a public connection. PublicAddr and RemoteAddr are taken
+// from the PROXY header of the load balancer, if any.
+type ConnInfo struct {
+	Tenant     string
+	PublicAddr net.Addr
+	RemoteAddr net.Addr
+	// Waited is the time spent in the queue.
+	Waited time.Duration
+}
+
+// ConnStats are the totals of a finished connection.
+type ConnStats struct {
+	// BytesIn are received from the client, and BytesOut are sent to it.
+	BytesIn  uint64
+	BytesOut uint64
+	Duration time.Duration
+}
+
+// RelayStats is a snapshot of the counters of a relay.
+type RelayStats struct {
+	// Links is the number of relay links waiting for connections.
+	Links int
+	// Pending is the number of public connections in the queues.
+	Pending int
+	// Active is the number of connections being forwarded.
+	Active int
+
+	Accepted uint64
+	Rejected uint64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+type relayCounters struct {
+	links    atomic.Int64
+	pending  atomic.Int64
+	active   atomic.Int64
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// Relay is the server side of popub, which hands public connections to the
+// popub-local instances connected to it.
+type Relay struct {
+	hooks RelayHooks
+	log   *log.Logger
+	stats relayCounters
+
+	// conns are the connections in progress, which Shutdown waits for.
+	conns *drain.Group
+	// stopCtx is cancelled by Shutdown, to stop Serve and the public
+	// listeners.
+	stopCtx context.Context
+	stop    context.CancelFunc
+
+	reloadMu sync.Mutex
+
+	mu      sync.Mutex
+	tenants []*tenant
+	// authKeys are the keys of all tenants, tried in turn on new relay
+	// links, and keyOwners tell which key of which tenant each one is.
+	authKeys  [][]byte
+	keyOwners []keyOwner
+	links     map[io.Closer]struct{}
+	closed    bool
+}
+
+// NewRelay checks the configuration and creates a relay. Argon2 is run on
+// each passphrase, which takes a while.
+func NewRelay(cfg RelayConfig) (*Relay, error) {
+	r := &Relay{
+		hooks: cfg.Hooks,
+		log:   cfg.Logger,
+		links: make(map[io.Closer]struct{}),
+		conns: drain.New(),
+	}
+	r.stopCtx, r.stop = context.WithCancel(context.Background())
+	if r.log == nil {
+		r.log = log.New(io.Discard, "", 0)
+	}
+
+	settings, err := checkTenants(cfg.Tenants, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		t := newTenant(r, name, settings[name])
+		t.logRelayKey()
+		r.tenants = append(r.tenants, t)
+		r.authKeys, r.keyOwners = appendAuthKeys(r.authKeys, r.keyOwners, t, t.config())
+	}
+	return r, nil
+}
+
+// checkTenants checks the settings of each tenant. Passphrases are only
+// derived again if they are different from those of the current tenants.
+func checkTenants(tenants map[string]TenantConfig, current []*tenant) (map[string]*tenantSettings, error) {
+	if len(tenants) == 0 {
+		return nil, errors.New("no tenants configured")
+	}
+	passphrases := make(map[string]string)
+	settings := make(map[string]*tenantSettings)
+	for _, name := range slices.Sorted(maps.Keys(tenants)) {
+		tc := tenants[name]
+		// The same passphrase with different parameters is a different key.
+		passphrase := tc.Passphrase + "\x00" + tc.PassphraseParams
+		if other, ok := passphrases[passphrase]; ok {
+			return nil, fmt.Errorf("%s has the same passphrase as %s", tenantDisplayName(name), other)
+		}
+		passphrases[passphrase] = tenantDisplayName(name)
+		for _, keyName := range slices.Sorted(maps.Keys(tc.Keys)) {
+			key := tc.Keys[keyName]
+			passphrase := key.Passphrase + "\x00" + key.PassphraseParams
+			if other, ok := passphrases[passphrase]; ok {
+				return nil, fmt.Errorf("%s: key %q has the same passphrase as %s", tenantDisplayName(name), keyName, other)
+			}
+			passphrases[passphrase] = fmt.Sprintf("key %q of %s", keyName, tenantDisplayName(name))
+		}
+
+		var old *tenantSettings
+		for _, t := range current {
+			if t.name == name {
+				old = t.config()
+			}
+		}
+		s, err := newTenantSettings(name, tc, old)
+		if err != nil {
+			return nil, err
+		}
+		settings[name] = s
+	}
+	return settings, nil
+}
+
+// Reload replaces the settings of the tenants. Tenants are matched by name.
+// New relay links are authorized with the new passphrases, while the relay
+// links already authorized keep running. Removed tenants stop serving their
+// public listeners and close their idle relay links, leaving the connections
+// in progress to finish. The public listeners of added tenants are served
+// with ServePublic. Hooks and Logger are not changed. If cfg is invalid,
+// nothing is changed.
+func (r *Relay) Reload(cfg RelayConfig) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	r.mu.Lock()
+	current := r.tenants
+	r.mu.Unlock()
+	settings, err := checkTenants(cfg.Tenants, current)
+	if err != nil {
+		return err
+	}
+
+	var tenants, removed []*tenant
+	var authKeys [][]byte
+	var keyOwners []keyOwner
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		s := settings[name]
+		i := slices.IndexFunc(current, func(t *tenant) bool {
+			return t.name == name
+		})
+		var t *tenant
+		if i >= 0 {
+			t = current[i]
+			old := t.settings.Swap(s)
+			for _, change := range changedFields(&old.TenantConfig, &s.TenantConfig) {
+				t.log.Println(change)
+			}
+			if old.RelayKey != s.RelayKey {
+				t.logRelayKey()
+			}
+		} else {
+			t = newTenant(r, name, s)
+			t.log.Println("added")
+			t.logRelayKey()
+		}
+		tenants = append(tenants, t)
+		authKeys, keyOwners = appendAuthKeys(authKeys, keyOwners, t, s)
+	}
+	for _, t := range current {
+		if _, ok := settings[t.name]; !ok {
+			removed = append(removed, t)
+		}
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		for _, t := range tenants {
+			t.close()
+		}
+		return ErrRelayClosed
+	}
+	r.tenants, r.authKeys, r.keyOwners = tenants, authKeys, keyOwners
+	r.mu.Unlock()
+
+	for _, t := range removed {
+		t.close()
+		t.log.Println("removed")
+	}
+	return nil
+}
+
+func (r *Relay) tenant(name string) (*tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.tenants {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tenant: %q", name)
+}
+
+// Stats returns the current counters of the relay.
+func (r *Relay) Stats() RelayStats {
+	return RelayStats{
+		Links:    int(r.stats.links.Load()),
+		Pending:  int(r.stats.pending.Load()),
+		Active:   int(r.stats.active.Load()),
+		Accepted: r.stats.accepted.Load(),
+		Rejected: r.stats.rejected.Load(),
+		BytesIn:  r.stats.bytesIn.Load(),
+		BytesOut: r.stats.bytesOut.Load(),
+	}
+}
+
+// Serve accepts popub-local connections on relayListener, and public
+// connections of the top-level tenant on publicListener, which may be nil.
+// When ctx is done or Shutdown is called, it closes both listeners, rejects
+// the pending connections, closes the idle relay links, and returns nil.
+// Connections in progress, and the multiplexed sessions carrying them, keep
+// running until Shutdown.
+func (r *Relay) Serve(ctx context.Context, relayListener, publicListener net.Listener) error {
+	ctx, cancel := withStop(ctx, r.stopCtx)
+	defer cancel()
+
+	if publicListener != nil {
+		t, err := r.tenant("")
+		if err != nil {
+			return err
+		}
+		go func() {
+			_ = t.servePublic(ctx, publicListener)
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = relayListener.Close()
+	}()
+	err := r.serveRelay(relayListener)
+	cancel()
+	r.shutdown()
+	if errors.Is(err, net.ErrClosed) && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// ServePublic accepts public connections of the named tenant on listener,
+// until ctx is done, the tenant is removed, or the relay is shut down.
+func (r *Relay) ServePublic(ctx context.Context, tenant string, listener net.Listener) error {
+	t, err := r.tenant(tenant)
+	if err != nil {
+		return err
+	}
+	return t.servePublic(ctx, listener)
+}
+
+// ServePublicUDP forwards the UDP datagrams received on conn through the
+// multiplexed sessions of the named tenant, until ctx is done, the tenant is
+// removed, or the relay is shut down.
+func (r *Relay) ServePublicUDP(ctx context.Context, tenant string, conn *net.UDPConn) error {
+	t, err := r.tenant(tenant)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withStop(ctx, t.stopCtx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	err = t.servePublicUDP(conn)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops Serve and the public listeners, then waits for the
+// connections in progress to finish until ctx is done. The remaining
+// connections are closed, and ctx.Err() is returned. A summary is logged.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.stop()
+	r.shutdown()
+
+	active := r.conns.Len()
+	if active != 0 {
+		r.log.Printf("waiting for %d connections to finish", active)
+	}
+	remaining := r.conns.Shutdown(ctx)
+	s := r.Stats()
+	r.log.Printf("shutdown: %d connections finished, %d closed (%d accepted, %d rejected, %d bytes in, %d bytes out in total)", active-remaining, remaining, s.Accepted, s.Rejected, s.BytesIn, s.BytesOut)
+	if remaining != 0 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// withStop returns a context which is also cancelled along with stopCtx.
+func withStop(ctx, stopCtx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(stopCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (t *tenant) servePublic(ctx context.Context, listener net.Listener) error {
+	ctx, cancel := withStop(ctx, t.stopCtx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stop()
+	defer t.addPublicAddr(listener.Addr())()
+
+	d := backoff.NewWithContext(ctx, t.log)
+	for {
+		publicConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !d.ProcessError(err) {
+			t.acceptPublic(t.queue, publicConn)
+		}
+	}
+}
+
+func (r *Relay) serveRelay(relayListener net.Listener) error {
+	d := backoff.NewWithLogger(r.log)
+	for {
+		relayConn, err := relayListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if !d.ProcessError(err) {
+			go r.authConn(relayConn)
+		}
+	}
+}
+
+// shutdown rejects all pending connections, and closes the idle relay links
+// and the ports opened on request.
+func (r *Relay) shutdown() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	tenants := r.tenants
+	links := r.links
+	r.links = make(map[io.Closer]struct{})
+	r.mu.Unlock()
+
+	for _, t := range tenants {
+		t.close()
+	}
+	for c := range links {
+		_ = c.Close()
+	}
+}
+
+// track registers a relay link to be closed on shutdown. It returns false if
+// the relay is already shut down.
+func (r *Relay) track(c io.Closer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.links[c] = struct{}{}
+	return true
+}
+
+func (r *Relay) untrack(c io.Closer) {
+	r.mu.Lock()
+	delete(r.links, c)
+	r.mu.Unlock()
+}
+
+// authConn finds out the tenant of a relay connection by trying the
+// passphrase of each tenant.
+func (r *Relay) authConn(relayConn net.Conn) {
+	if !r.track(relayConn) {
+		relayConn.Close()
+		return
+	}
+	defer r.untrack(relayConn)
+
+	r.mu.Lock()
+	authKeys, keyOwners := r.authKeys, r.keyOwners
+	r.mu.Unlock()
+
+	_ = relayConn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
+	index, pubkey, nonce, err := common.ReadX25519Any(relayConn, authKeys, &[chacha20poly1305.NonceSizeX]byte{})
+	if err != nil {
+		r.log.Printf("authorization failure from %s: %v", relayConn.RemoteAddr(), err)
+		relayConn.Close()
+		return
+	}
+	t, key := keyOwners[index].tenant, keyOwners[index].key
+	cfg := t.config()
+	link := LinkInfo{Tenant: t.name, LocalAddr: relayConn.LocalAddr(), RemoteAddr: relayConn.RemoteAddr()}
+	if key != nil {
+		link.Key = key.name
+		if err := key.check(time.Now()); err != nil {
+			t.log.Printf("authorization refused for %s: %v", linkDisplayName(link), err)
+			relayConn.Close()
+			return
+		}
+	}
+
+	privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.log.Println(err)
+		relayConn.Close()
+		return
+	}
+
+	psk, err := privkey.ECDH(pubkey)
+	if err != nil {
+		t.log.Println(err)
+		relayConn.Close()
+		return
+	}
+	if len(psk) != chacha20poly1305.KeySize {
+		panic("ECDH returned incorrect key size")
+	}
+
+	send, recv, err := common.NewCipherStates(psk, true)
+	if err != nil {
+		t.log.Println(err)
+		relayConn.Close()
+		return
+	}
+
+	_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	_, err = common.WriteX25519(relayConn, privkey.PublicKey(), authKeys[index], &nonce)
+	if err != nil {
+		t.log.Println(err)
+		relayConn.Close()
+		return
+	}
+
+	// Tunnels serve the public addresses of the tenant, unless they ask for
+	// a port of their own.
+	queue, sessions := t.queue, t.sessions
+	var port *dynamicPort
+	defer func() {
+		if port != nil {
+			port.Release()
+		}
+	}()
+
+	// The relay key is sent if popub-local asks for it before any other
+	// packet. It is proven by the next packet, sealed with the key mixed
+	// with it.
+	//
+	// The identity of popub-local, if any, is sent before any other packet,
+	// and acknowledged with the key mixed with it, so that popub-local
+	// knows it is accepted. It is only proven when the next packet from
+	// popub-local can be opened with that key. An SSH key is sent instead
+	// of an identity, and proven at once by its signature.
+	var id *identity
+	relayKeySent, identified, proving, authorized := false, false, false, false
+	remote := linkDisplayName(link)
+	var buf [common.MaxRecvBufferSize]byte
+	for {
+		_ = relayConn.SetReadDeadline(time.Now().Add(common.NetworkTimeout))
+		packet, err := common.ReadPacket(relayConn, recv, buf[:])
+		if err != nil {
+			if proving && !authorized {
+				t.log.Printf("identity proof failed from %s: %v", remote, err)
+			} else {
+				t.log.Println(err)
+			}
+			relayConn.Close()
+			return
+		}
+
+		if !authorized && !identified && !relayKeySent && bytes.HasPrefix(packet, []byte{common.PacketRelayKey}) {
+			relayKeySent = true
+			psk, err = sendRelayKey(relayConn, cfg, pubkey, psk, send, recv, buf[:])
+			if err != nil {
+				t.log.Println(err)
+				relayConn.Close()
+				return
+			}
+			continue
+		}
+		if !authorized && !identified && (bytes.HasPrefix(packet, []byte{common.PacketIdentity}) || bytes.HasPrefix(packet, []byte{common.PacketSSH})) {
+			identified = true
+			kind := packet[0]
+			if kind == common.PacketIdentity {
+				proving = true
+				id, link.Identity, err = identify(cfg, packet, privkey, psk, send, recv)
+			} else {
+				id, link.Identity, err = identifySSH(cfg, packet, psk)
+			}
+			if err != nil {
+				t.log.Printf("invalid identity from %s: %v", remote, err)
+				relayConn.Close()
+				return
+			}
+			remote = linkDisplayName(link)
+			if cfg.RequireIdentity && id == nil {
+				t.log.Printf("authorization refused for %s: unknown identity", remote)
+				relayConn.Close()
+				return
+			}
+			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			err = common.WritePacket(relayConn, (&[256 - common.PacketOverhead]byte{kind})[:], send, buf[:])
+			if err != nil {
+				t.log.Println(err)
+				relayConn.Close()
+				return
+			}
+			continue
+		}
+		if !authorized {
+			authorized = true
+			if cfg.RequireIdentity && id == nil {
+				t.log.Printf("authorization refused for %s: identity required", remote)
+				relayConn.Close()
+				return
+			}
+			if r.hooks.Authorize != nil {
+				err = r.hooks.Authorize(link)
+				if err != nil {
+					t.log.Printf("authorization refused for %s: %v", remote, err)
+					relayConn.Close()
+					return
+				}
+			}
+			if key != nil {
+				key.warnRetiring(t.log, remote)
+			}
+		}
+
+		// popub-local tells in the mode packet whether it understands
+		// rekeyed packets.
+		if len(packet) > 1 && (packet[0] == 0 || packet[0] == mux.PacketHello) && packet[1]&common.FeatureRekey != 0 {
+			send.EnableRekey()
+		}
+		// Without a port of its own, the tunnel serves the public
+		// listeners, whose ports must be permitted to its identity.
+		if port == nil && (bytes.HasPrefix(packet, []byte{0}) || bytes.HasPrefix(packet, []byte{mux.PacketHello})) && !t.permitsPublic(id) {
+			t.log.Printf("authorization refused for %s: public ports not permitted", remote)
+			relayConn.Close()
+			return
+		}
+		if bytes.HasPrefix(packet, []byte{0}) {
+			break
+		} else if bytes.HasPrefix(packet, []byte{mux.PacketHello}) {
+			t.log.Println("authorized (multiplexed):", relayConn.LocalAddr(), "←", remote)
+			// The session is kept through shutdown, until the
+			// connections it carries are finished.
+			r.untrack(relayConn)
+			r.linkUp(link)
+			defer r.linkDown(link)
+			relayMux(t, relayConn, queue, sessions, id, send, recv)
+			return
+		} else if bytes.HasPrefix(packet, []byte{bind.PacketBind}) && port == nil {
+			token, rng, err := bind.DecodeRequest(packet)
+			if err == nil {
+				port, err = t.bindPort(token, rng, id)
+			}
+			addr := ""
+			if err == nil {
+				// The port is released on return if it cannot be used.
+				addr, err = port.Addr(relayConn.LocalAddr())
+			}
+			if err == nil {
+				queue, sessions = port.queue, nil
+			} else {
+				t.log.Printf("bind request from %s refused: %v", remote, err)
+			}
+			reply := bind.EncodeReply(addr, err)
+			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			writeErr := common.WritePacket(relayConn, reply[:], send, buf[:])
+			if err != nil || writeErr != nil {
+				relayConn.Close()
+				return
+			}
+		}
+	}
+	_ = relayConn.SetReadDeadline(time.Time{})
+
+	t.log.Println("authorized:", relayConn.LocalAddr(), "←", remote)
+	r.linkUp(link)
+	defer r.linkDown(link)
+
+	recvChan := make(chan []byte, 1)
+
+	go relayLoopRecv(t, relayConn, recvChan, recv)
+	relayLoopSend(t, relayConn, queue, id, recvChan, send, recv)
+}
+
+// sendRelayKey sends the relay key of the tenant, or zeros if it has none.
+// The key is then proven with a packet sealed with the key mixed with it,
+// which is returned, and set on send and recv.
+func sendRelayKey(relayConn net.Conn, cfg *tenantSettings, pubkey *ecdh.PublicKey, ephkey []byte, send, recv *common.CipherState, buf []byte) ([]byte, error) {
+	reply := [256 - common.PacketOverhead]byte{common.PacketRelayKey}
+	if cfg.relayKey != nil {
+		copy(reply[1:], cfg.relayKey.PublicKey().Bytes())
+	}
+	_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+	err := common.WritePacket(relayConn, reply[:], send, buf)
+	if err != nil || cfg.relayKey == nil {
+		return ephkey, err
+	}
+	relayDH, err := cfg.relayKey.ECDH(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	ephkey, err = common.MixRelayKey(ephkey, relayDH)
+	if err != nil {
+		return nil, err
+	}
+	err = common.SetKeys(ephkey, send, recv)
+	if err != nil {
+		return nil, err
+	}
+	err = common.WritePacket(relayConn, (&[256 - common.PacketOverhead]byte{common.PacketRelayKey})[:], send, buf)
+	return ephkey, err
+}
+
+// identify reads the identity packet of popub-local, sets the key mixed with
+// its identity key on send and recv, and returns the authorized key, if any,
+// and its name.
+func identify(cfg *tenantSettings, packet []byte, privkey *ecdh.PrivateKey, ephkey []byte, send, recv *common.CipherState) (*identity, string, error) {
+	if len(packet) < 1+curve25519.PointSize {
+		return nil, "", errors.New("packet too short")
+	}
+	pubkey, err := ecdh.X25519().NewPublicKey(packet[1 : 1+curve25519.PointSize])
+	if err != nil {
+		return nil, "", err
+	}
+	identityDH, err := privkey.ECDH(pubkey)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := common.MixIdentity(ephkey, identityDH)
+	if err != nil {
+		return nil, "", err
+	}
+	err = common.SetKeys(key, send, recv)
+	if err != nil {
+		return nil, "", err
+	}
+	if id := cfg.identities[[32]byte(pubkey.Bytes())]; id != nil {
+		return id, id.name, nil
+	}
+	return nil, common.FormatPublicKey(pubkey), nil
+}
+
+// identifySSH checks the SSH packet of popub-local, and returns the
+// authorized key, if any, and its name.
+func identifySSH(cfg *tenantSettings, packet []byte, ephkey []byte) (*identity, string, error) {
+	pubkey, err := common.DecodeSSHPacket(packet, ephkey)
+	if err != nil {
+		return nil, "", err
+	}
+	if id := cfg.sshKeys[string(pubkey.Marshal())]; id != nil {
+		return id, id.name, nil
+	}
+	return nil, ssh.FingerprintSHA256(pubkey), nil
+}
+
+func (r *Relay) linkUp(link LinkInfo) {
+	r.stats.links.Add(1)
+	if r.hooks.LinkUp != nil {
+		r.hooks.LinkUp(link)
+	}
+}
+
+func (r *Relay) linkDown(link LinkInfo) {
+	r.stats.links.Add(-1)
+	if r.hooks.LinkDown != nil {
+		r.hooks.LinkDown(link)
+	}
+}
+
+func relayLoopSend(t *tenant, relayConn net.Conn, queue *pendingQueue, id *identity, recvChan <-chan []byte, send, recv *common.CipherState) {
+	var pending *pendingConn
+	pingBalance := 0
+	pingTicker := time.NewTicker(common.PingInterval)
+
+	var buf [common.MaxPacketSize]byte
+	for {
+		select {
+		case pending = <-queue.Chan():
+			pingTicker.Stop()
+			// Public listeners may be added after the link is authorized.
+			if queue == t.queue && !t.permitsPublic(id) {
+				t.log.Printf("closing %s: public ports not permitted", relayConn.RemoteAddr())
+				relayConn.Close()
+				queue.Requeue(pending)
+				return
+			}
+
+			t.log.Printf("accept: %s ← %s (waited %.1f seconds)", pending.publicAddr, pending.remoteAddr, time.Since(pending.acceptTime).Seconds())
+			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			err := common.WritePacket(relayConn, pending.payload, send, buf[:])
+			if err != nil {
+				t.log.Println(err)
+				relayConn.Close()
+				queue.Requeue(pending)
+				return
+			}
+			_ = relayConn.SetWriteDeadline(time.Time{})
+			goto accepted
+
+		case packet, ok := <-recvChan:
+			if !ok {
+				pingTicker.Stop()
+				return
+			} else if bytes.HasPrefix(packet, []byte{0}) && pingBalance > 0 {
+				pingBalance -= 1
+			}
+
+		case <-t.stopCtx.Done():
+			pingTicker.Stop()
+			relayConn.Close()
+			return
+
+		case <-pingTicker.C:
+			if pingBalance > 1 {
+				t.log.Println("connection timed out")
+				pingTicker.Stop()
+				relayConn.Close()
+				return
+			}
+			_ = relayConn.SetWriteDeadline(time.Now().Add(common.NetworkTimeout))
+			err := common.WritePacket(relayConn, (&[256 - common.PacketOverhead]byte{})[:], send, buf[:])
+			if err != nil {
+				t.log.Println(err)
+				pingTicker.Stop()
+				relayConn.Close()
+				return
+			}
+			pingBalance += 1
+		}
+	}
+
+accepted:
+	for {
+		select {
+		case packet, ok := <-recvChan:
+			if !ok {
+				queue.Requeue(pending)
+				return
+			} else if bytes.HasPrefix(packet, []byte{0xd}) {
+				t.forward(pending, func(ctx context.Context, publicConn net.Conn) {
+					common.Forward(ctx, publicConn, relayConn, send, recv)
+				})
+				return
+			}
+
+		case <-time.After(common.NetworkTimeout):
+			t.log.Println("connection timed out")
+			relayConn.Close()
+			queue.Requeue(pending)
+			return
+		}
+	}
+}
+
+func relayLoopRecv(t *tenant, relayConn net.Conn, recvChan chan<- []byte, recv *common.CipherState) {
+	var buf [common.MaxRecvBufferSize]byte
+	for {
+		packet, err := common.ReadPacket(relayConn, recv, buf[:])
+		if err != nil {
+			// The relay link is closed by relayLoopSend or on shutdown.
+			if !errors.Is(err, net.ErrClosed) {
+				t.log.Println(err)
+			}
+			relayConn.Close()
+			break
+		}
+
+		packet = bytes.Clone(packet) // Allow reusing buf
+		recvChan <- packet
+
+		if !bytes.HasPrefix(packet, []byte{0}) {
+			break
+		}
+	}
+	close(recvChan)
+}
+
+func relayMux(t *tenant, relayConn net.Conn, queue *pendingQueue, sessions *muxRegistry, id *identity, send, recv *common.CipherState) {
+	sess := mux.NewSession(relayConn, send, recv, true, t.log)
+	stop := context.AfterFunc(t.relay.conns.Context(), func() {
+		_ = sess.Close()
+	})
+	defer stop()
+	// Sessions serving a requested port do not carry the UDP flows of the
+	// tenant.
+	if sessions != nil {
+		sessions.Add(sess, id)
+		defer sessions.Remove(sess)
+	}
+
+	for {
+		select {
+		case pending := <-queue.Chan():
+			if sessions != nil && !t.permitsPublic(id) {
+				t.log.Printf("closing %s once idle: public ports not permitted", relayConn.RemoteAddr())
+				queue.Requeue(pending)
+				sessions.Remove(sess)
+				sess.CloseWhenIdle()
+				<-sess.Done()
+				return
+			}
+			st, err := sess.Open(pending.payload)
+			if err != nil {
+				t.log.Println(err)
+				queue.Requeue(pending)
+				return
+			}
+			t.log.Printf("accept: %s ← %s (waited %.1f seconds, stream %d)", pending.publicAddr, pending.remoteAddr, time.Since(pending.acceptTime).Seconds(), st.ID())
+			t.forward(pending, func(ctx context.Context, publicConn net.Conn) {
+				mux.Forward(ctx, st, publicConn)
+			})
+
+		case <-t.stopCtx.Done():
+			// Keep the session until the connections it carries are
+			// finished.
+			sess.CloseWhenIdle()
+			<-sess.Done()
+			return
+
+		case <-sess.Done():
+			t.log.Println("multiplexed session closed:", relayConn.RemoteAddr())
+			return
+		}
+	}
+}
+
+// forward serves an accepted public connection with fn in a new goroutine,
+// counting the bytes it carries. fn must close the connection when ctx is
+// done.
+func (t *tenant) forward(p *pendingConn, fn func(ctx context.Context, publicConn net.Conn)) {
+	r := t.relay
+	info := t.connInfo(p)
+	r.stats.accepted.Add(1)
+	r.stats.active.Add(1)
+	if r.hooks.ConnAccepted != nil {
+		r.hooks.ConnAccepted(info)
+	}
+
+	r.conns.Go(func(ctx context.Context) {
+		conn := &countingConn{Conn: p.conn, stats: &r.stats}
+		start := time.Now()
+		fn(ctx, conn)
+
+		r.stats.active.Add(-1)
+		if r.hooks.ConnClosed != nil {
+			r.hooks.ConnClosed(info, ConnStats{
+				BytesIn:  conn.bytesIn.Load(),
+				BytesOut: conn.bytesOut.Load(),
+				Duration: time.Since(start),
+			})
+		}
+	})
+}
+
+// countingConn counts the bytes read from and written to a public connection,
+// keeping its ability to half-close.
+type countingConn struct {
+	net.Conn
+	stats    *relayCounters
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(uint64(n))
+	c.stats.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(uint64(n))
+	c.stats.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	return common.CloseWrite(c.Conn)
+}
+
+func (c *countingConn) CloseRead() error {
+	return common.CloseRead(c.Conn)
+}
@@ -0,0 +1,176 @@
+package popub
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/bind"
+)
+
+// dynamicPort is a public port opened on request of popub-local. All relay
+// links of the requesting tunnel share the port, and it is closed once none
+// of them has been connected for bind_linger.
+type dynamicPort struct {
+	t        *tenant
+	token    bind.Token
+	port     uint16
+	listener *net.TCPListener
+	queue    *pendingQueue
+
+	// Protected by t.mu
+	refs    int
+	release *time.Timer
+}
+
+// bindPort returns the port opened for the tunnel identified by token, or
+// opens a new one within r, and the ports permitted to id.
+func (t *tenant) bindPort(token bind.Token, r bind.Range, id *identity) (*dynamicPort, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p := t.ports[token]; p != nil {
+		if !r.IsAny() && !r.Contains(p.port) {
+			return nil, fmt.Errorf("tunnel already has port %d", p.port)
+		}
+		if !id.permits(p.port) {
+			return nil, fmt.Errorf("port %d is not permitted", p.port)
+		}
+		p.refs++
+		if p.release != nil {
+			p.release.Stop()
+			p.release = nil
+		}
+		return p, nil
+	}
+
+	if t.stopCtx.Err() != nil {
+		return nil, ErrRelayClosed
+	}
+	if len(t.ports) >= t.config().BindMax {
+		return nil, fmt.Errorf("too many ports open (limit %d)", t.config().BindMax)
+	}
+	listener, port, err := t.listenPortRange(r, id)
+	if err != nil {
+		return nil, err
+	}
+	p := &dynamicPort{
+		t:        t,
+		token:    token,
+		port:     port,
+		listener: listener,
+		refs:     1,
+	}
+	p.queue = newPendingQueue(t)
+	t.ports[token] = p
+	t.log.Printf("opened public port %s (requested %s, %d open)", listener.Addr(), r, len(t.ports))
+	go p.serve()
+	return p, nil
+}
+
+// listenPortRange listens on the first free port permitted by r, the tenant's
+// bind_ports, and id, starting from a random one.
+func (t *tenant) listenPortRange(r bind.Range, id *identity) (*net.TCPListener, uint16, error) {
+	var candidates []uint16
+	for _, allowed := range t.config().bindPorts {
+		lo, hi := allowed.Min, allowed.Max
+		if !r.IsAny() {
+			lo, hi = max(lo, r.Min), min(hi, r.Max)
+		}
+		for port := int(lo); port <= int(hi); port++ {
+			if id.permits(uint16(port)) {
+				candidates = append(candidates, uint16(port))
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, 0, fmt.Errorf("port %s is not permitted", r)
+	}
+
+	start := rand.IntN(len(candidates))
+	for i := range candidates {
+		port := candidates[(start+i)%len(candidates)]
+		listener, err := net.Listen("tcp", net.JoinHostPort(t.config().BindHost, strconv.Itoa(int(port))))
+		if err == nil {
+			return listener.(*net.TCPListener), port, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no free port in %s", r)
+}
+
+// Addr returns the public address reported to popub-local, which reached the
+// relay at localAddr. Without a bind_host, it is only known if the relay
+// link is TCP.
+func (p *dynamicPort) Addr(localAddr net.Addr) (string, error) {
+	host := p.t.config().BindHost
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		tcpAddr, ok := localAddr.(*net.TCPAddr)
+		if !ok {
+			return "", errors.New("bind requires a TCP relay address, or bind_host")
+		}
+		host = tcpAddr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.port))), nil
+}
+
+// Release is called when a relay link using the port is gone.
+func (p *dynamicPort) Release() {
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+
+	p.refs--
+	if p.refs == 0 {
+		p.release = time.AfterFunc(p.t.config().BindLinger, p.close)
+	}
+}
+
+func (p *dynamicPort) close() {
+	p.t.mu.Lock()
+	if p.refs != 0 || p.t.ports[p.token] != p {
+		p.t.mu.Unlock()
+		return
+	}
+	delete(p.t.ports, p.token)
+	open := len(p.t.ports)
+	p.t.mu.Unlock()
+
+	_ = p.listener.Close()
+	p.queue.Close()
+	p.t.log.Printf("closed public port %s (%d open)", p.listener.Addr(), open)
+}
+
+func (p *dynamicPort) serve() {
+	d := backoff.NewWithLogger(p.t.log)
+	for {
+		publicConn, err := p.listener.AcceptTCP()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if !d.ProcessError(err) {
+			p.t.acceptPublic(p.queue, publicConn)
+		}
+	}
+}
+
+// closePorts closes all ports opened on request, regardless of the relay
+// links still using them.
+func (t *tenant) closePorts() {
+	t.mu.Lock()
+	ports := t.ports
+	t.ports = make(map[bind.Token]*dynamicPort)
+	for _, p := range ports {
+		if p.release != nil {
+			p.release.Stop()
+		}
+	}
+	t.mu.Unlock()
+
+	for _, p := range ports {
+		_ = p.listener.Close()
+		p.queue.Close()
+	}
+}
@@ -0,0 +1,175 @@
+package popub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKey permits a popub-local to connect to a tenant with its
+// identity key, or with an SSH key.
+type AuthorizedKey struct {
+	// Name identifies the popub-local in logs and hooks.
+	Name string
+	// PublicKey is the public key printed by popub keygen -identity, or an
+	// SSH public key, such as "ssh-ed25519 AAAA…".
+	PublicKey string
+	// BindPorts are the public ports it may ask for, within those of the
+	// tenant, such as "20000-20099". The default is all of them. If set, the
+	// key only serves the public listeners of the tenant if their ports are
+	// all listed.
+	BindPorts []string
+}
+
+func (k AuthorizedKey) String() string {
+	return k.Name
+}
+
+// ParseAuthorizedKeys reads authorized keys, one per line, each with a name,
+// a public key, and optionally the public ports it may ask for:
+//
+//	laptop popub-pub:… 20000-20099 8080
+//
+// Empty lines and lines starting with "#" are skipped.
+func ParseAuthorizedKeys(r io.Reader) ([]AuthorizedKey, error) {
+	keys := []AuthorizedKey{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a name and a public key", line)
+		}
+		k := AuthorizedKey{Name: fields[0], PublicKey: fields[1], BindPorts: fields[2:]}
+		_, _, err := parseAuthorizedKeys([]AuthorizedKey{k})
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, _, err := parseAuthorizedKeys(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// sshIgnoredOptions are options of OpenSSH authorized_keys files which do not
+// matter to popub.
+var sshIgnoredOptions = []string{"no-agent-forwarding", "no-pty", "no-user-rc", "no-x11-forwarding"}
+
+// ParseSSHAuthorizedKeys reads an OpenSSH authorized_keys file. The comment
+// of each key is its name, or the fingerprint of the key if there is none.
+// The permitlisten option lists the public ports the key may ask for, as a
+// port or a range:
+//
+//	permitlisten="20000-20099",permitlisten="8080" ssh-ed25519 AAAA… alice@laptop
+//
+// Other options are refused, except those which do not matter to popub, such
+// as no-pty.
+func ParseSSHAuthorizedKeys(r io.Reader) ([]AuthorizedKey, error) {
+	keys := []AuthorizedKey{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pubkey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		k := AuthorizedKey{Name: comment, PublicKey: strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pubkey)), "\n")}
+		if k.Name == "" {
+			k.Name = ssh.FingerprintSHA256(pubkey)
+		}
+		for _, option := range options {
+			name, value, ok := strings.Cut(option, "=")
+			switch {
+			case ok && strings.EqualFold(name, "permitlisten"):
+				k.BindPorts = append(k.BindPorts, strings.Trim(value, `"`))
+			case !ok && slices.Contains(sshIgnoredOptions, strings.ToLower(name)):
+			default:
+				return nil, fmt.Errorf("line %d: unsupported option: %s", line, option)
+			}
+		}
+		if _, _, err := parseAuthorizedKeys([]AuthorizedKey{k}); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, _, err := parseAuthorizedKeys(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// identity is an authorized key of a tenant.
+type identity struct {
+	name      string
+	bindPorts []bind.Range
+}
+
+// parseAuthorizedKeys returns the identities of keys, keyed by public key,
+// and those of SSH keys, keyed by SSH public key in the wire format.
+func parseAuthorizedKeys(keys []AuthorizedKey) (map[[32]byte]*identity, map[string]*identity, error) {
+	identities := make(map[[32]byte]*identity)
+	sshKeys := make(map[string]*identity)
+	for _, k := range keys {
+		id := &identity{name: k.Name}
+		for _, s := range k.BindPorts {
+			r, err := bind.ParseRange(s)
+			if err == nil && r.IsAny() {
+				err = fmt.Errorf("invalid port range: %q", s)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("authorized key %q: %v", k.Name, err)
+			}
+			id.bindPorts = append(id.bindPorts, r)
+		}
+
+		var other *identity
+		if strings.HasPrefix(k.PublicKey, common.PublicKeyPrefix) {
+			pubkey, err := common.ParsePublicKey(k.PublicKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("authorized key %q: %v", k.Name, err)
+			}
+			b := [32]byte(pubkey.Bytes())
+			other = identities[b]
+			identities[b] = id
+		} else {
+			pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+			if err != nil {
+				return nil, nil, fmt.Errorf("authorized key %q: %v", k.Name, err)
+			}
+			b := string(pubkey.Marshal())
+			other = sshKeys[b]
+			sshKeys[b] = id
+		}
+		if other != nil {
+			return nil, nil, fmt.Errorf("authorized key %q is the same as %q", k.Name, other.name)
+		}
+	}
+	return identities, sshKeys, nil
+}
+
+// permits reports whether the identity may use port. A nil identity, which is
+// a popub-local without an identity key, may use any port of the tenant.
+func (id *identity) permits(port uint16) bool {
+	return id == nil || len(id.bindPorts) == 0 || slices.ContainsFunc(id.bindPorts, func(r bind.Range) bool {
+		return r.Contains(port)
+	})
+}
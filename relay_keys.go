@@ -0,0 +1,147 @@
+package popub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+// retiringWarnInterval is how often the use of a key scheduled to retire is
+// logged, for each key.
+const retiringWarnInterval = 10 * time.Minute
+
+// TenantKey is an additional passphrase of a tenant. It is only accepted
+// from NotBefore until NotAfter, if they are set, and popub-local still
+// using it once NotAfter is set are logged.
+type TenantKey struct {
+	Passphrase       string
+	PassphraseParams string
+	NotBefore        time.Time
+	NotAfter         time.Time
+}
+
+// tenantKey is a checked TenantKey.
+type tenantKey struct {
+	TenantKey
+	name    string
+	authKey []byte
+	// warned is when the use of the key was last logged, in Unix
+	// nanoseconds.
+	warned atomic.Int64
+}
+
+// keyOwner tells which tenant, and which of its keys, an entry of
+// Relay.authKeys belongs to.
+type keyOwner struct {
+	tenant *tenant
+	// key is nil for the passphrase of the tenant.
+	key *tenantKey
+}
+
+// appendAuthKeys appends the passphrase and the keys of t, whose settings
+// are s, to keys and owners.
+func appendAuthKeys(keys [][]byte, owners []keyOwner, t *tenant, s *tenantSettings) ([][]byte, []keyOwner) {
+	keys = append(keys, s.authKey)
+	owners = append(owners, keyOwner{tenant: t})
+	for _, key := range s.keys {
+		keys = append(keys, key.authKey)
+		owners = append(owners, keyOwner{tenant: t, key: key})
+	}
+	return keys, owners
+}
+
+// newTenantKeys checks keys, sorted by name. Argon2 is only run on the
+// passphrases which are not among those of old, which may be nil.
+func newTenantKeys(keys map[string]TenantKey, old *tenantSettings) ([]*tenantKey, error) {
+	var result []*tenantKey
+	for _, name := range slices.Sorted(maps.Keys(keys)) {
+		k := keys[name]
+		if name == "" {
+			return nil, errors.New("key name required")
+		}
+		if k.Passphrase == "" {
+			return nil, fmt.Errorf("key %q: passphrase required", name)
+		}
+		if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+			return nil, fmt.Errorf("key %q: retires before it is valid", name)
+		}
+		key := &tenantKey{TenantKey: k, name: name}
+		if old != nil {
+			key.authKey = old.findAuthKey(k.Passphrase, k.PassphraseParams)
+		}
+		if key.authKey == nil {
+			var err error
+			key.authKey, err = common.PassphraseToPSK(k.Passphrase, k.PassphraseParams)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", name, err)
+			}
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// findAuthKey returns the derived key of passphrase and params among those
+// of s, or nil.
+func (s *tenantSettings) findAuthKey(passphrase, params string) []byte {
+	if s.Passphrase == passphrase && s.PassphraseParams == params && s.authKey != nil {
+		return s.authKey
+	}
+	for _, key := range s.keys {
+		if key.Passphrase == passphrase && key.PassphraseParams == params {
+			return key.authKey
+		}
+	}
+	return nil
+}
+
+// check returns an error if the key is not valid at now.
+func (k *tenantKey) check(now time.Time) error {
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return fmt.Errorf("key %q is not valid before %s", k.name, k.NotBefore.Format(time.RFC3339))
+	}
+	if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) {
+		return fmt.Errorf("key %q retired at %s", k.name, k.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// warnRetiring logs that remote still uses the key, if it is scheduled to
+// retire, at most once per retiringWarnInterval.
+func (k *tenantKey) warnRetiring(logger *log.Logger, remote string) {
+	if k.NotAfter.IsZero() {
+		return
+	}
+	now := time.Now()
+	last := k.warned.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < retiringWarnInterval {
+		return
+	}
+	if !k.warned.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	logger.Printf("warning: %s uses a key which retires at %s", remote, k.NotAfter.Format(time.RFC3339))
+}
+
+// linkDisplayName describes the popub-local of link in logs, with its
+// identity and the key it used, if any.
+func linkDisplayName(link LinkInfo) string {
+	var about []string
+	if link.Identity != "" {
+		about = append(about, link.Identity)
+	}
+	if link.Key != "" {
+		about = append(about, "key "+link.Key)
+	}
+	if len(about) == 0 {
+		return link.RemoteAddr.String()
+	}
+	return fmt.Sprintf("%s (%s)", link.RemoteAddr, strings.Join(about, ", "))
+}
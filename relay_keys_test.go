@@ -0,0 +1,131 @@
+package popub
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKDFParams make Argon2 cheap enough for tests.
+const testKDFParams = "argon2id:t=1,m=8,p=1:c2FsdHNhbHQ"
+
+func TestTenantKeyCheck(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		now       time.Time
+		want      string
+	}{
+		{"no window", time.Time{}, time.Time{}, notBefore, ""},
+		{"not yet valid", notBefore, notAfter, notBefore.Add(-time.Second), `key "next" is not valid before 2026-01-01T00:00:00Z`},
+		{"valid from", notBefore, notAfter, notBefore, ""},
+		{"valid", notBefore, notAfter, notBefore.Add(24 * time.Hour), ""},
+		{"retired", notBefore, notAfter, notAfter, `key "next" retired at 2026-02-01T00:00:00Z`},
+		{"retired without start", time.Time{}, notAfter, notAfter.Add(time.Hour), `key "next" retired at 2026-02-01T00:00:00Z`},
+		{"valid without end", notBefore, time.Time{}, notAfter.Add(time.Hour), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &tenantKey{TenantKey: TenantKey{NotBefore: tt.notBefore, NotAfter: tt.notAfter}, name: "next"}
+			err := k.check(tt.now)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnRetiring(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	warnings := func() int { return strings.Count(buf.String(), "warning:") }
+
+	k := &tenantKey{TenantKey: TenantKey{NotAfter: time.Now().Add(time.Hour)}, name: "old"}
+	k.warnRetiring(logger, "192.0.2.1:1234")
+	k.warnRetiring(logger, "192.0.2.1:1234")
+	if n := warnings(); n != 1 {
+		t.Fatalf("%d warnings within the interval, want 1: %q", n, buf.String())
+	}
+
+	// Move the last warning back past the interval.
+	k.warned.Store(time.Now().Add(-retiringWarnInterval - time.Second).UnixNano())
+	k.warnRetiring(logger, "192.0.2.1:1234")
+	if n := warnings(); n != 2 {
+		t.Fatalf("%d warnings after the interval, want 2: %q", n, buf.String())
+	}
+
+	// Keys not scheduled to retire are never logged.
+	buf.Reset()
+	(&tenantKey{name: "current"}).warnRetiring(logger, "192.0.2.1:1234")
+	if buf.Len() != 0 {
+		t.Errorf("warning for a key without NotAfter: %q", buf.String())
+	}
+}
+
+func TestNewTenantKeysReuse(t *testing.T) {
+	oldKeys, err := newTenantKeys(map[string]TenantKey{
+		"a": {Passphrase: "passphrase a", PassphraseParams: testKDFParams},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &tenantSettings{
+		TenantConfig: TenantConfig{Passphrase: "passphrase", PassphraseParams: testKDFParams},
+		authKey:      []byte("derived key of the tenant"),
+		keys:         oldKeys,
+	}
+
+	// On reload, a is kept, b takes over the passphrase of the tenant, and c
+	// uses the passphrase of a with other parameters.
+	keys, err := newTenantKeys(map[string]TenantKey{
+		"a": {Passphrase: "passphrase a", PassphraseParams: testKDFParams, NotAfter: time.Now()},
+		"b": {Passphrase: "passphrase", PassphraseParams: testKDFParams},
+		"c": {Passphrase: "passphrase a", PassphraseParams: "argon2id:t=2,m=8,p=1:c2FsdHNhbHQ"},
+	}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].name != "a" || keys[1].name != "b" || keys[2].name != "c" {
+		t.Fatalf("keys not sorted by name: %v", keys)
+	}
+	if &keys[0].authKey[0] != &oldKeys[0].authKey[0] {
+		t.Error("key a derived again")
+	}
+	if &keys[1].authKey[0] != &old.authKey[0] {
+		t.Error("key b derived again instead of reusing the passphrase of the tenant")
+	}
+	if bytes.Equal(keys[2].authKey, oldKeys[0].authKey) {
+		t.Error("key c reused a key derived with other parameters")
+	}
+}
+
+func TestNewTenantKeysErrors(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		keys map[string]TenantKey
+		want string
+	}{
+		{"no name", map[string]TenantKey{"": {Passphrase: "p"}}, "key name required"},
+		{"no passphrase", map[string]TenantKey{"a": {}}, `key "a": passphrase required`},
+		{"empty window", map[string]TenantKey{"a": {Passphrase: "p", NotBefore: now, NotAfter: now}}, `key "a": retires before it is valid`},
+		{"invalid params", map[string]TenantKey{"a": {Passphrase: "p", PassphraseParams: "scrypt"}}, `key "a": invalid passphrase parameters: "scrypt" (expected argon2id:t=TIME,m=MEMORY,p=THREADS:SALT)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTenantKeys(tt.keys, nil)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
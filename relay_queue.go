@@ -0,0 +1,199 @@
+package popub
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+const fallbackResponseTimeout = 5 * time.Second
+
+type fallbackAction int
+
+const (
+	fallbackReset fallbackAction = iota
+	fallbackClose
+	fallbackResponse
+)
+
+func parseFallbackAction(s string) (fallbackAction, error) {
+	switch s {
+	case "rst":
+		return fallbackReset, nil
+	case "close":
+		return fallbackClose, nil
+	case "response":
+		return fallbackResponse, nil
+	default:
+		return 0, fmt.Errorf("invalid fallback action: %q (expected rst, close, or response)", s)
+	}
+}
+
+type pendingConn struct {
+	conn net.Conn
+	// publicAddr and remoteAddr are the addresses reported to popub-local,
+	// which may come from a PROXY header instead of conn itself.
+	publicAddr net.Addr
+	remoteAddr net.Addr
+	// payload is the accept payload sent to popub-local.
+	payload    []byte
+	acceptTime time.Time
+}
+
+// pendingQueue holds public connections until a tunnel picks them up.
+// Connections that wait longer than the queue timeout of the tenant, or
+// arrive when the queue is already full, are rejected using the fallback
+// action.
+type pendingQueue struct {
+	t       *tenant
+	in      chan *pendingConn
+	out     chan *pendingConn
+	requeue chan *pendingConn
+	done    chan struct{}
+	log     *log.Logger
+}
+
+func newPendingQueue(t *tenant) *pendingQueue {
+	q := &pendingQueue{
+		t:       t,
+		in:      make(chan *pendingConn),
+		out:     make(chan *pendingConn),
+		requeue: make(chan *pendingConn),
+		done:    make(chan struct{}),
+		log:     t.log,
+	}
+	go q.run()
+	return q
+}
+
+// Push adds a newly accepted public connection to the tail of the queue.
+func (q *pendingQueue) Push(conn net.Conn, publicAddr, remoteAddr net.Addr, payload []byte) {
+	p := &pendingConn{
+		conn:       conn,
+		publicAddr: publicAddr,
+		remoteAddr: remoteAddr,
+		payload:    payload,
+		acceptTime: time.Now(),
+	}
+	select {
+	case q.in <- p:
+	case <-q.done:
+		go q.reject(p, ErrRelayClosed)
+	}
+}
+
+// Requeue puts a connection back to the head of the queue, after the tunnel
+// which took it failed before handing off.
+func (q *pendingQueue) Requeue(p *pendingConn) {
+	select {
+	case q.requeue <- p:
+	case <-q.done:
+		go q.reject(p, ErrRelayClosed)
+	}
+}
+
+// Close rejects all pending connections, and any connection pushed later.
+func (q *pendingQueue) Close() {
+	close(q.done)
+}
+
+// Chan returns the channel from which tunnels receive pending connections.
+func (q *pendingQueue) Chan() <-chan *pendingConn {
+	return q.out
+}
+
+func (q *pendingQueue) run() {
+	queue := list.New()
+	timer := time.NewTimer(q.t.config().QueueTimeout)
+
+	for {
+		// The settings may be changed by Relay.Reload.
+		cfg := q.t.config()
+		var out chan<- *pendingConn
+		var head *pendingConn
+		if front := queue.Front(); front != nil {
+			out = q.out
+			head = front.Value.(*pendingConn)
+			timer.Reset(time.Until(head.acceptTime.Add(cfg.QueueTimeout)))
+		} else {
+			timer.Stop()
+		}
+
+		select {
+		case p := <-q.in:
+			if queue.Len() >= cfg.QueueSize {
+				q.log.Printf("queue full (%d pending), rejecting: %s ← %s", queue.Len(), p.publicAddr, p.remoteAddr)
+				go q.reject(p, ErrQueueFull)
+			} else {
+				queue.PushBack(p)
+				q.log.Printf("queued: %s ← %s (%d pending)", p.publicAddr, p.remoteAddr, queue.Len())
+				q.t.relay.stats.pending.Add(1)
+				if q.t.relay.hooks.ConnQueued != nil {
+					q.t.relay.hooks.ConnQueued(q.t.connInfo(p))
+				}
+			}
+
+		case p := <-q.requeue:
+			queue.PushFront(p)
+			q.t.relay.stats.pending.Add(1)
+
+		case out <- head:
+			queue.Remove(queue.Front())
+			q.t.relay.stats.pending.Add(-1)
+
+		case <-timer.C:
+			for front := queue.Front(); front != nil; front = queue.Front() {
+				p := front.Value.(*pendingConn)
+				if time.Since(p.acceptTime) < cfg.QueueTimeout {
+					break
+				}
+				queue.Remove(front)
+				q.t.relay.stats.pending.Add(-1)
+				q.log.Printf("queue timeout after %.1f seconds (%d pending), rejecting: %s ← %s", time.Since(p.acceptTime).Seconds(), queue.Len(), p.publicAddr, p.remoteAddr)
+				go q.reject(p, ErrQueueTimeout)
+			}
+
+		case <-q.done:
+			timer.Stop()
+			for front := queue.Front(); front != nil; front = front.Next() {
+				q.t.relay.stats.pending.Add(-1)
+				go q.reject(front.Value.(*pendingConn), ErrRelayClosed)
+			}
+			return
+		}
+	}
+}
+
+func (q *pendingQueue) reject(p *pendingConn, reason error) {
+	q.t.rejected(p.publicAddr, p.remoteAddr, reason)
+	cfg := q.t.config()
+	switch cfg.fallback {
+	case fallbackReset:
+		if tcpConn, ok := p.conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+		_ = p.conn.Close()
+
+	case fallbackClose:
+		_ = p.conn.Close()
+
+	case fallbackResponse:
+		_ = p.conn.SetWriteDeadline(time.Now().Add(fallbackResponseTimeout))
+		_, err := p.conn.Write(cfg.QueueResponse)
+		if err != nil {
+			_ = p.conn.Close()
+			return
+		}
+		// Discard the request so that closing the socket does not send RST,
+		// which may cause the client to drop the response.
+		_ = common.CloseWrite(p.conn)
+		_ = p.conn.SetReadDeadline(time.Now().Add(fallbackResponseTimeout))
+		_, _ = io.Copy(io.Discard, p.conn)
+		_ = p.conn.Close()
+	}
+}
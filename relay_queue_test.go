@@ -0,0 +1,207 @@
+package popub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection. The first one
+// plays the public connection accepted by the relay.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// newTestQueue returns the queue of a tenant with the given settings.
+func newTestQueue(t *testing.T, size int, timeout time.Duration, fallback string, response []byte) *pendingQueue {
+	t.Helper()
+	r, err := NewRelay(RelayConfig{Tenants: map[string]TenantConfig{"": {
+		Passphrase:    "secret",
+		QueueSize:     size,
+		QueueTimeout:  timeout,
+		QueueFallback: fallback,
+		QueueResponse: response,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := r.tenant("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tenant.close)
+	return tenant.queue
+}
+
+func push(q *pendingQueue, conn *net.TCPConn) {
+	q.Push(conn, conn.LocalAddr(), conn.RemoteAddr(), nil)
+}
+
+// pop receives the next connection handed to a tunnel, or nil if there is
+// none within wait.
+func pop(q *pendingQueue, wait time.Duration) *pendingConn {
+	select {
+	case p := <-q.Chan():
+		return p
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// readAll reads what the relay sends to a public client until it closes the
+// connection.
+func readAll(t *testing.T, client *net.TCPConn) ([]byte, error) {
+	t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return io.ReadAll(client)
+}
+
+func TestQueueFull(t *testing.T) {
+	q := newTestQueue(t, 1, time.Minute, "close", nil)
+	first, _ := tcpPair(t)
+	second, client := tcpPair(t)
+	push(q, first)
+	push(q, second)
+
+	if data, err := readAll(t, client); err != nil || len(data) != 0 {
+		t.Errorf("rejected connection: got %q, %v, want EOF", data, err)
+	}
+	if p := pop(q, time.Second); p == nil || p.conn != first {
+		t.Fatal("queued connection not handed out")
+	}
+	if p := pop(q, 100*time.Millisecond); p != nil {
+		t.Error("rejected connection handed out")
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	q := newTestQueue(t, 10, 50*time.Millisecond, "close", nil)
+	conn, client := tcpPair(t)
+	start := time.Now()
+	push(q, conn)
+
+	if data, err := readAll(t, client); err != nil || len(data) != 0 {
+		t.Errorf("timed out connection: got %q, %v, want EOF", data, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("rejected after %v, before the timeout", elapsed)
+	}
+	if p := pop(q, 100*time.Millisecond); p != nil {
+		t.Error("timed out connection handed out")
+	}
+}
+
+func TestQueueRequeue(t *testing.T) {
+	q := newTestQueue(t, 10, time.Minute, "close", nil)
+	first, _ := tcpPair(t)
+	second, _ := tcpPair(t)
+	push(q, first)
+	push(q, second)
+
+	p := pop(q, time.Second)
+	if p == nil || p.conn != first {
+		t.Fatal("first connection not handed out first")
+	}
+	// The handoff failed, so the connection goes back ahead of the second.
+	q.Requeue(p)
+	for _, want := range []*net.TCPConn{first, second} {
+		if p := pop(q, time.Second); p == nil || p.conn != want {
+			t.Fatal("requeued connection not handed out before the others")
+		}
+	}
+}
+
+func TestQueueFallback(t *testing.T) {
+	response := []byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+	tests := []struct {
+		fallback string
+		check    func(t *testing.T, data []byte, err error)
+	}{
+		{"rst", func(t *testing.T, data []byte, err error) {
+			if err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("got %q, %v, want a connection reset", data, err)
+			}
+		}},
+		{"close", func(t *testing.T, data []byte, err error) {
+			if err != nil || len(data) != 0 {
+				t.Errorf("got %q, %v, want EOF", data, err)
+			}
+		}},
+		{"response", func(t *testing.T, data []byte, err error) {
+			if err != nil || !bytes.Equal(data, response) {
+				t.Errorf("got %q, %v, want %q", data, err, response)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fallback, func(t *testing.T) {
+			q := newTestQueue(t, 1, time.Minute, tt.fallback, response)
+			conn, client := tcpPair(t)
+			if tt.fallback == "response" {
+				// A request that the relay never reads, which makes closing
+				// the socket send RST unless it is drained first.
+				if _, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			go q.reject(&pendingConn{conn: conn, acceptTime: time.Now()}, ErrQueueFull)
+
+			data, err := readAll(t, client)
+			tt.check(t, data, err)
+		})
+	}
+}
+
+// TestQueueResponseDrain checks that the response fallback half-closes the
+// connection and keeps reading, so that the client may finish sending its
+// request after receiving the response.
+func TestQueueResponseDrain(t *testing.T) {
+	response := []byte("busy\n")
+	q := newTestQueue(t, 1, time.Minute, "response", response)
+	conn, client := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		q.reject(&pendingConn{conn: conn, acceptTime: time.Now()}, ErrQueueFull)
+		close(done)
+	}()
+
+	if data, err := readAll(t, client); err != nil || !bytes.Equal(data, response) {
+		t.Fatalf("got %q, %v, want %q", data, err, response)
+	}
+	if _, err := client.Write([]byte("late request")); err != nil {
+		t.Errorf("write after the response: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("connection closed before the client finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = client.CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after the client finished")
+	}
+}
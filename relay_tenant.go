@@ -0,0 +1,341 @@
+package popub
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m13253/popub/internal/bind"
+	"github.com/m13253/popub/internal/common"
+	"github.com/m13253/popub/internal/proxy_v2"
+)
+
+var errUntrustedProxy = errors.New("PROXY header from untrusted address")
+
+// tenant is a set of public listeners served by the popub-local instances
+// that know its passphrase. Each tenant has its own queue of pending
+// connections and its own multiplexed sessions, as well as the ports opened on
+// request of its popub-local instances.
+type tenant struct {
+	relay    *Relay
+	name     string
+	queue    *pendingQueue
+	sessions *muxRegistry
+	log      *log.Logger
+
+	// settings are replaced by Relay.Reload.
+	settings atomic.Pointer[tenantSettings]
+
+	// stopCtx is cancelled when the tenant is removed by Relay.Reload, or
+	// when the relay is shut down.
+	stopCtx   context.Context
+	stop      context.CancelFunc
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	ports map[bind.Token]*dynamicPort
+	// publicAddrs are the addresses of the public listeners being served.
+	publicAddrs map[net.Addr]struct{}
+}
+
+// tenantSettings is a checked TenantConfig, along with the values parsed
+// from it.
+type tenantSettings struct {
+	TenantConfig
+	authKey   []byte
+	keys      []*tenantKey
+	fallback  fallbackAction
+	bindPorts []bind.Range
+	// identities are keyed by public key, and sshKeys by SSH public key in
+	// the wire format.
+	identities map[[32]byte]*identity
+	sshKeys    map[string]*identity
+	relayKey   *ecdh.PrivateKey
+}
+
+// newTenantSettings checks cfg. Argon2 is only run if the passphrase or its
+// parameters are different from those of old, which may be nil.
+func newTenantSettings(name string, cfg TenantConfig, old *tenantSettings) (*tenantSettings, error) {
+	cfg.setDefaults()
+	if cfg.Passphrase == "" && !cfg.RequireIdentity {
+		return nil, fmt.Errorf("%s: passphrase required unless identities are required", tenantDisplayName(name))
+	}
+	fallback, err := parseFallbackAction(cfg.QueueFallback)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tenantDisplayName(name), err)
+	}
+	var bindPorts []bind.Range
+	for _, s := range cfg.BindPorts {
+		r, err := bind.ParseRange(s)
+		if err == nil && r.IsAny() {
+			err = fmt.Errorf("invalid port range: %q", s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tenantDisplayName(name), err)
+		}
+		bindPorts = append(bindPorts, r)
+	}
+
+	identities, sshKeys, err := parseAuthorizedKeys(cfg.AuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tenantDisplayName(name), err)
+	}
+
+	s := &tenantSettings{
+		TenantConfig: cfg,
+		fallback:     fallback,
+		bindPorts:    bindPorts,
+		identities:   identities,
+		sshKeys:      sshKeys,
+	}
+	if cfg.RelayKey != "" {
+		s.relayKey, err = common.ParseIdentity(cfg.RelayKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: relay key: %v", tenantDisplayName(name), err)
+		}
+	}
+	if old != nil {
+		s.authKey = old.findAuthKey(cfg.Passphrase, cfg.PassphraseParams)
+	}
+	if s.authKey == nil {
+		s.authKey, err = common.PassphraseToPSK(cfg.Passphrase, cfg.PassphraseParams)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tenantDisplayName(name), err)
+		}
+	}
+	s.keys, err = newTenantKeys(cfg.Keys, old)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", tenantDisplayName(name), err)
+	}
+	return s, nil
+}
+
+func newTenant(r *Relay, name string, s *tenantSettings) *tenant {
+	prefix := ""
+	if name != "" {
+		prefix = "[" + name + "] "
+	}
+	t := &tenant{
+		relay:       r,
+		name:        name,
+		sessions:    &muxRegistry{},
+		log:         log.New(r.log.Writer(), prefix, r.log.Flags()|log.Lmsgprefix),
+		ports:       make(map[bind.Token]*dynamicPort),
+		publicAddrs: make(map[net.Addr]struct{}),
+	}
+	t.settings.Store(s)
+	t.stopCtx, t.stop = context.WithCancel(r.stopCtx)
+	t.queue = newPendingQueue(t)
+	return t
+}
+
+// config returns the current settings of the tenant.
+func (t *tenant) config() *tenantSettings {
+	return t.settings.Load()
+}
+
+// close stops the public listeners of the tenant, rejects its pending
+// connections, and closes its requested ports. Its idle relay links are
+// closed, and its multiplexed sessions once they carry no more streams.
+func (t *tenant) close() {
+	t.closeOnce.Do(func() {
+		t.stop()
+		t.queue.Close()
+		t.closePorts()
+	})
+}
+
+// changedFields describes the fields which differ between old and new. The
+// values of secrets are not shown.
+func changedFields(old, new *TenantConfig) []string {
+	var changes []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := range ov.NumField() {
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		name := ov.Type().Field(i).Name
+		switch name {
+		case "Passphrase", "RelayKey", "QueueResponse":
+			changes = append(changes, name+" changed")
+		case "Keys":
+			o, n := slices.Sorted(maps.Keys(old.Keys)), slices.Sorted(maps.Keys(new.Keys))
+			if slices.Equal(o, n) {
+				changes = append(changes, name+" changed")
+			} else {
+				changes = append(changes, fmt.Sprintf("%s: %v → %v", name, o, n))
+			}
+		case "AuthorizedKeys":
+			changes = append(changes, fmt.Sprintf("%s: %d → %d keys", name, len(old.AuthorizedKeys), len(new.AuthorizedKeys)))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", name, o, n))
+		}
+	}
+	return changes
+}
+
+// logRelayKey prints the public relay key of the tenant, for popub-local to
+// pin.
+func (t *tenant) logRelayKey() {
+	if key := t.config().relayKey; key != nil {
+		t.log.Println("relay key:", common.FormatPublicKey(key.PublicKey()))
+	}
+}
+
+func tenantDisplayName(name string) string {
+	if name == "" {
+		return "the top-level tenant"
+	}
+	return fmt.Sprintf("tenant %q", name)
+}
+
+func (t *tenant) connInfo(p *pendingConn) ConnInfo {
+	return ConnInfo{
+		Tenant:     t.name,
+		PublicAddr: p.publicAddr,
+		RemoteAddr: p.remoteAddr,
+		Waited:     time.Since(p.acceptTime),
+	}
+}
+
+// rejected records a public connection rejected for reason.
+func (t *tenant) rejected(publicAddr, remoteAddr net.Addr, reason error) {
+	t.relay.stats.rejected.Add(1)
+	if t.relay.hooks.ConnRejected != nil {
+		t.relay.hooks.ConnRejected(ConnInfo{Tenant: t.name, PublicAddr: publicAddr, RemoteAddr: remoteAddr}, reason)
+	}
+}
+
+// acceptPublic puts a public connection into queue, after reading its PROXY
+// header if configured.
+func (t *tenant) acceptPublic(queue *pendingQueue, conn net.Conn) {
+	publicAddr := conn.LocalAddr()
+	remoteAddr := conn.RemoteAddr()
+	if !t.config().PublicProxy {
+		t.push(queue, conn, publicAddr, remoteAddr, nil)
+		return
+	}
+
+	if !t.isTrustedProxy(remoteAddr) {
+		t.log.Printf("PROXY header from untrusted address, rejecting: %s ← %s", publicAddr, remoteAddr)
+		t.rejected(publicAddr, remoteAddr, errUntrustedProxy)
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		_ = conn.SetReadDeadline(time.Now().Add(t.config().PublicProxyTimeout))
+		h, err := proxy_v2.ReadProxyHeader(conn)
+		if err != nil {
+			t.log.Printf("cannot read PROXY header from %s: %v", remoteAddr, err)
+			t.rejected(publicAddr, remoteAddr, err)
+			_ = conn.Close()
+			return
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		// LOCAL commands, such as health checks, carry no addresses.
+		if h.Command == proxy_v2.CommandLocal {
+			t.push(queue, conn, publicAddr, remoteAddr, nil)
+			return
+		}
+		if h.Src != nil {
+			publicAddr, remoteAddr = h.Dst, h.Src
+		}
+		t.push(queue, conn, publicAddr, remoteAddr, h.TLVs)
+	}()
+}
+
+// push encodes the accept payload of a public connection and puts it into
+// queue. A unique ID is added unless the load balancer already provides one.
+func (t *tenant) push(queue *pendingQueue, conn net.Conn, publicAddr, remoteAddr net.Addr, tlvs []proxy_v2.TLV) {
+	payload, err := proxy_v2.EncodeAcceptPayload(t.acceptHeader(publicAddr, remoteAddr, tlvs))
+	if err != nil {
+		t.log.Printf("rejecting %s ← %s: %v", publicAddr, remoteAddr, err)
+		t.rejected(publicAddr, remoteAddr, err)
+		_ = conn.Close()
+		return
+	}
+	queue.Push(conn, publicAddr, remoteAddr, payload)
+}
+
+func (t *tenant) acceptHeader(publicAddr, remoteAddr net.Addr, tlvs []proxy_v2.TLV) *proxy_v2.Header {
+	// The TLVs of popub are only set by the relay, so that clients of the
+	// load balancer cannot forge them.
+	tlvs = slices.DeleteFunc(slices.Clone(tlvs), func(tlv proxy_v2.TLV) bool {
+		return tlv.Type == proxy_v2.TypePopubTenant
+	})
+	h := proxy_v2.NewAcceptHeader(publicAddr, remoteAddr, tlvs)
+	if _, ok := h.TLV(proxy_v2.TypeUniqueID); !ok {
+		var id [16]byte
+		_, _ = rand.Read(id[:])
+		h.SetTLV(proxy_v2.TypeUniqueID, id[:])
+	}
+	if t.name != "" {
+		h.SetTLV(proxy_v2.TypePopubTenant, []byte(t.name))
+	}
+	return h
+}
+
+// addPublicAddr records the address of a public listener until the returned
+// function is called.
+func (t *tenant) addPublicAddr(addr net.Addr) func() {
+	t.mu.Lock()
+	t.publicAddrs[addr] = struct{}{}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.publicAddrs, addr)
+		t.mu.Unlock()
+	}
+}
+
+// permitsPublic reports whether id may serve the public listeners of the
+// tenant, which requires every one of their ports to be permitted to it.
+func (t *tenant) permitsPublic(id *identity) bool {
+	if id == nil || len(id.bindPorts) == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr := range t.publicAddrs {
+		var port int
+		switch addr := addr.(type) {
+		case *net.TCPAddr:
+			port = addr.Port
+		case *net.UDPAddr:
+			port = addr.Port
+		default:
+			return false
+		}
+		if !id.permits(uint16(port)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTrustedProxy also trusts peers on Unix sockets, which are protected by
+// file permissions. Without trusted networks, no TCP peer is trusted.
+func (t *tenant) isTrustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range t.config().PublicProxyTrusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package popub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	old := TenantConfig{QueueSize: 1}
+	new := TenantConfig{QueueSize: 2}
+	if got, want := changedFields(&old, &new), []string{"QueueSize: 1 → 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := changedFields(&old, &old); len(got) != 0 {
+		t.Errorf("got %q for the same settings", got)
+	}
+}
+
+// TestChangedFieldsSecrets checks that the values of secrets are never
+// logged on reload.
+func TestChangedFieldsSecrets(t *testing.T) {
+	tests := []struct {
+		field string
+		set   func(c *TenantConfig, secret string)
+		want  string
+	}{
+		{"Passphrase", func(c *TenantConfig, secret string) { c.Passphrase = secret }, "Passphrase changed"},
+		{"RelayKey", func(c *TenantConfig, secret string) { c.RelayKey = secret }, "RelayKey changed"},
+		{"QueueResponse", func(c *TenantConfig, secret string) { c.QueueResponse = []byte(secret) }, "QueueResponse changed"},
+		{"Keys", func(c *TenantConfig, secret string) {
+			c.Keys = map[string]TenantKey{"next": {Passphrase: secret}}
+		}, "Keys changed"},
+		{"AuthorizedKeys", func(c *TenantConfig, secret string) {
+			c.AuthorizedKeys = []AuthorizedKey{{Name: "laptop", PublicKey: secret}}
+		}, "AuthorizedKeys: 1 → 1 keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			var old, new TenantConfig
+			tt.set(&old, "old-secret")
+			tt.set(&new, "new-secret")
+			got := changedFields(&old, &new)
+			if want := []string{tt.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			for _, change := range got {
+				if strings.Contains(change, "secret") {
+					t.Errorf("secret shown: %q", change)
+				}
+			}
+		})
+	}
+}
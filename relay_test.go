@@ -0,0 +1,322 @@
+package popub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m13253/popub/internal/common"
+)
+
+// startRelay serves a relay on loopback listeners until the end of the test.
+// It returns the relay address, and the public address of the top-level
+// tenant if there is one.
+func startRelay(t *testing.T, cfg RelayConfig) (r *Relay, relayAddr, publicAddr string) {
+	t.Helper()
+	r, err := NewRelay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicListener net.Listener
+	if _, ok := cfg.Tenants[""]; ok {
+		publicListener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicAddr = publicListener.Addr().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Serve(ctx, relayListener, publicListener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return r, relayListener.Addr().String(), publicAddr
+}
+
+// recordHooks returns hooks that describe each event on the returned channel.
+func recordHooks() (RelayHooks, <-chan string) {
+	events := make(chan string, 100)
+	return RelayHooks{
+		LinkUp: func(link LinkInfo) {
+			events <- "link up " + link.Tenant
+		},
+		LinkDown: func(link LinkInfo) {
+			events <- "link down " + link.Tenant
+		},
+		ConnQueued: func(conn ConnInfo) {
+			events <- "queued " + conn.RemoteAddr.String()
+		},
+		ConnAccepted: func(conn ConnInfo) {
+			events <- "accepted " + conn.RemoteAddr.String()
+		},
+		ConnRejected: func(conn ConnInfo, reason error) {
+			events <- fmt.Sprintf("rejected %s: %v", conn.RemoteAddr, reason)
+		},
+		ConnClosed: func(conn ConnInfo, stats ConnStats) {
+			events <- fmt.Sprintf("closed %s: %d in, %d out", conn.RemoteAddr, stats.BytesIn, stats.BytesOut)
+		},
+	}, events
+}
+
+// expectEvent skips events until want.
+func expectEvent(t *testing.T, events <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event %q", want)
+		}
+	}
+}
+
+// expectStats waits until the counters of the relay match want.
+func expectStats(t *testing.T, r *Relay, want RelayStats) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Stats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want %+v", r.Stats(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	for _, useMux := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mux=%v", useMux), func(t *testing.T) {
+			hooks, events := recordHooks()
+			r, relayAddr, publicAddr := startRelay(t, RelayConfig{
+				Tenants: map[string]TenantConfig{"": {Passphrase: "secret"}},
+				Hooks:   hooks,
+			})
+			l, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret"}, &Options{Mux: useMux})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			expectEvent(t, events, "link up ")
+			expectStats(t, r, RelayStats{Links: 1})
+
+			client, err := net.Dial("tcp", publicAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			expectEvent(t, events, "queued "+client.LocalAddr().String())
+			expectEvent(t, events, "accepted "+client.LocalAddr().String())
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.RemoteAddr().String() != client.LocalAddr().String() {
+				t.Errorf("remote address %v, want %v", conn.RemoteAddr(), client.LocalAddr())
+			}
+
+			if _, err := client.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			expectRead(t, conn, "request")
+			if _, err := conn.Write([]byte("response!")); err != nil {
+				t.Fatal(err)
+			}
+			expectRead(t, client, "response!")
+			// In classic mode, the link is handed off and the listener
+			// opens another one.
+			expectStats(t, r, RelayStats{Links: 1, Active: 1, Accepted: 1, BytesIn: 7, BytesOut: 9})
+
+			conn.Close()
+			client.Close()
+			expectEvent(t, events, fmt.Sprintf("closed %s: 7 in, 9 out", client.LocalAddr()))
+			expectStats(t, r, RelayStats{Links: 1, Accepted: 1, BytesIn: 7, BytesOut: 9})
+		})
+	}
+}
+
+func TestRelayRejected(t *testing.T) {
+	hooks, events := recordHooks()
+	r, _, publicAddr := startRelay(t, RelayConfig{
+		Tenants: map[string]TenantConfig{"": {
+			Passphrase:   "secret",
+			QueueSize:    1,
+			QueueTimeout: 200 * time.Millisecond,
+		}},
+		Hooks: hooks,
+	})
+
+	// No popub-local is connected, so the first connection waits until the
+	// timeout, and the second one finds the queue full.
+	first, err := net.Dial("tcp", publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	expectEvent(t, events, "queued "+first.LocalAddr().String())
+	expectStats(t, r, RelayStats{Pending: 1})
+
+	second, err := net.Dial("tcp", publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectEvent(t, events, fmt.Sprintf("rejected %s: %v", second.LocalAddr(), ErrQueueFull))
+	expectEvent(t, events, fmt.Sprintf("rejected %s: %v", first.LocalAddr(), ErrQueueTimeout))
+	expectStats(t, r, RelayStats{Rejected: 2})
+}
+
+func TestRelayAuthorize(t *testing.T) {
+	hooks, events := recordHooks()
+	refused := make(chan struct{}, 16)
+	hooks.Authorize = func(link LinkInfo) error {
+		if link.Tenant == "denied" {
+			refused <- struct{}{}
+			return errors.New("denied by hook")
+		}
+		return nil
+	}
+	r, relayAddr, _ := startRelay(t, RelayConfig{
+		Tenants: map[string]TenantConfig{
+			"allowed": {Passphrase: "allowed secret"},
+			"denied":  {Passphrase: "denied secret"},
+		},
+		Hooks: hooks,
+	})
+
+	// Authorize is called on the first packet of a link, so Listen may
+	// return before the link is refused.
+	l, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "denied secret"}, nil)
+	if err == nil {
+		defer l.Close()
+	}
+	select {
+	case <-refused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Authorize not called")
+	}
+	l, err = Listen(context.Background(), relayAddr, Credentials{Passphrase: "allowed secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	expectEvent(t, events, "link up allowed")
+	expectStats(t, r, RelayStats{Links: 1})
+}
+
+// TestRelayPublicPortsAtDispatch checks that a link whose identity is only
+// permitted some ports stops serving the public listeners once one on another
+// port is added.
+func TestRelayPublicPortsAtDispatch(t *testing.T) {
+	for _, useMux := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mux=%v", useMux), func(t *testing.T) {
+			identity, publicKey := common.GenerateIdentity()
+			hooks, events := recordHooks()
+			r, relayAddr, _ := startRelay(t, RelayConfig{
+				Tenants: map[string]TenantConfig{"a": {
+					Passphrase:     "secret",
+					QueueTimeout:   200 * time.Millisecond,
+					AuthorizedKeys: []AuthorizedKey{{Name: "web", PublicKey: publicKey, BindPorts: []string{"1"}}},
+				}},
+				Hooks: hooks,
+			})
+			l, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret", Identity: identity}, &Options{Mux: useMux})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			expectEvent(t, events, "link up a")
+
+			publicListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go r.ServePublic(context.Background(), "a", publicListener)
+			client, err := net.Dial("tcp", publicListener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			expectEvent(t, events, "link down a")
+			expectEvent(t, events, fmt.Sprintf("rejected %s: %v", client.LocalAddr(), ErrQueueTimeout))
+			expectStats(t, r, RelayStats{Rejected: 1})
+		})
+	}
+}
+
+func TestRelayReload(t *testing.T) {
+	hooks, events := recordHooks()
+	r, relayAddr, _ := startRelay(t, RelayConfig{
+		Tenants: map[string]TenantConfig{"a": {Passphrase: "secret a"}},
+		Hooks:   hooks,
+	})
+	publicListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- r.ServePublic(context.Background(), "a", publicListener)
+	}()
+
+	if l, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret b"}, nil); err == nil {
+		l.Close()
+		t.Fatal("Listen succeeded for a tenant not added yet")
+	}
+	la, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer la.Close()
+	expectEvent(t, events, "link up a")
+
+	// Replacing a with b closes the idle link and the public listener of a.
+	err = r.Reload(RelayConfig{Tenants: map[string]TenantConfig{"b": {Passphrase: "secret b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, "link down a")
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServePublic of a removed tenant: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("ServePublic still running for a removed tenant")
+	}
+	if l, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret a"}, nil); err == nil {
+		l.Close()
+		t.Fatal("Listen succeeded for a removed tenant")
+	}
+	lb, err := Listen(context.Background(), relayAddr, Credentials{Passphrase: "secret b"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	expectEvent(t, events, "link up b")
+
+	// An invalid configuration changes nothing.
+	err = r.Reload(RelayConfig{Tenants: map[string]TenantConfig{"b": {Passphrase: "secret b", QueueFallback: "drop"}}})
+	if err == nil {
+		t.Error("Reload accepted an invalid configuration")
+	}
+	if _, err := r.tenant("b"); err != nil {
+		t.Error(err)
+	}
+}
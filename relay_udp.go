@@ -0,0 +1,198 @@
+package popub
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m13253/popub/internal/backoff"
+	"github.com/m13253/popub/internal/mux"
+	"github.com/m13253/popub/internal/proxy_v2"
+)
+
+// muxRegistry keeps track of multiplexed sessions, which are able to carry
+// UDP flows, along with the identity of their popub-local.
+type muxRegistry struct {
+	mu       sync.Mutex
+	sessions []muxEntry
+	next     int
+}
+
+type muxEntry struct {
+	sess *mux.Session
+	id   *identity
+}
+
+func (r *muxRegistry) Add(sess *mux.Session, id *identity) {
+	r.mu.Lock()
+	r.sessions = append(r.sessions, muxEntry{sess: sess, id: id})
+	r.mu.Unlock()
+}
+
+func (r *muxRegistry) Remove(sess *mux.Session) {
+	r.mu.Lock()
+	for i, e := range r.sessions {
+		if e.sess == sess {
+			r.sessions = append(r.sessions[:i], r.sessions[i+1:]...)
+			break
+		}
+	}
+	r.mu.Unlock()
+}
+
+// Pick returns a session whose identity is permitted, in a round-robin
+// manner, or nil if there is none.
+func (r *muxRegistry) Pick(permitted func(id *identity) bool) *mux.Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range r.sessions {
+		r.next = (r.next + 1) % len(r.sessions)
+		if e := r.sessions[r.next]; permitted(e.id) {
+			return e.sess
+		}
+	}
+	return nil
+}
+
+type udpFlow struct {
+	flow       *mux.Flow
+	lastActive atomic.Int64
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - f.lastActive.Load())
+}
+
+// servePublicUDP forwards the datagrams received on publicConn through the
+// multiplexed sessions of the tenant, until publicConn is closed.
+func (t *tenant) servePublicUDP(publicConn *net.UDPConn) error {
+	localAddr := publicConn.LocalAddr().(*net.UDPAddr)
+	defer t.addPublicAddr(localAddr)()
+
+	var mu sync.Mutex
+	flows := make(map[netip.AddrPort]*udpFlow)
+	done := make(chan struct{})
+	defer close(done)
+	go expireUDPFlows(t, &mu, flows, done)
+
+	d := backoff.NewWithLogger(t.log)
+	var buf [65536]byte
+	for {
+		n, remoteAddr, err := publicConn.ReadFromUDPAddrPort(buf[:])
+		if errors.Is(err, net.ErrClosed) {
+			mu.Lock()
+			for _, f := range flows {
+				go f.flow.Close()
+			}
+			mu.Unlock()
+			return err
+		}
+		if d.ProcessError(err) {
+			continue
+		}
+		if n > mux.MaxFrameDataSize {
+			t.log.Printf("dropping UDP datagram from %s: %v (%d bytes)", remoteAddr, mux.ErrDatagramTooLarge, n)
+			continue
+		}
+
+		mu.Lock()
+		f := flows[remoteAddr]
+		if f != nil {
+			select {
+			case <-f.flow.Done():
+				delete(flows, remoteAddr)
+				f = nil
+			default:
+			}
+		}
+		if f == nil {
+			sess := t.sessions.Pick(t.permitsPublic)
+			if sess == nil {
+				mu.Unlock()
+				t.log.Println("no multiplexed tunnel available, dropping UDP datagram from", remoteAddr)
+				continue
+			}
+			payload, err := proxy_v2.EncodeAcceptPayload(t.acceptHeader(localAddr, net.UDPAddrFromAddrPort(remoteAddr), nil))
+			if err != nil {
+				mu.Unlock()
+				t.log.Println(err)
+				continue
+			}
+			flow, err := sess.OpenFlow(payload)
+			if err != nil {
+				mu.Unlock()
+				t.log.Println(err)
+				continue
+			}
+			f = &udpFlow{flow: flow}
+			f.touch()
+			flows[remoteAddr] = f
+			t.log.Printf("accept UDP: %s ← %s (flow %d)", localAddr, remoteAddr, flow.ID())
+			go udpFlowLoopSend(t, publicConn, remoteAddr, f)
+		}
+		mu.Unlock()
+
+		f.touch()
+		err = f.flow.Send(buf[:n])
+		if err != nil {
+			t.log.Println(err)
+		}
+	}
+}
+
+func udpFlowLoopSend(t *tenant, publicConn *net.UDPConn, remoteAddr netip.AddrPort, f *udpFlow) {
+	for {
+		datagram, err := f.flow.Recv()
+		if err != nil {
+			return
+		}
+		f.touch()
+		_, err = publicConn.WriteToUDPAddrPort(datagram, remoteAddr)
+		if err != nil {
+			t.log.Println(err)
+		}
+	}
+}
+
+// expireUDPFlows closes the flows idle for longer than UDPTimeout, which is
+// read on each tick, so that a reload changes it.
+func expireUDPFlows(t *tenant, mu *sync.Mutex, flows map[netip.AddrPort]*udpFlow, done <-chan struct{}) {
+	idleTimeout := t.config().UDPTimeout
+	interval := max(idleTimeout/4, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		idleTimeout = t.config().UDPTimeout
+		if next := max(idleTimeout/4, time.Second); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+		mu.Lock()
+		for remoteAddr, f := range flows {
+			select {
+			case <-f.flow.Done():
+				delete(flows, remoteAddr)
+				continue
+			default:
+			}
+			if f.idleTime() >= idleTimeout {
+				delete(flows, remoteAddr)
+				t.log.Printf("UDP flow %d expired: %s", f.flow.ID(), remoteAddr)
+				go f.flow.Close()
+			}
+		}
+		mu.Unlock()
+	}
+}